@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strconv"
+	"strings"
+
+	"mindoktor.io/modl"
+)
+
+// generate returns the formatted source of a file in package pkg, with a
+// struct per table of schema and a function fn registering them.
+func generate(schema *modl.Schema, pkg, fn string) ([]byte, error) {
+	imports := map[string]bool{}
+	body := bytes.Buffer{}
+	reg := bytes.Buffer{}
+
+	fmt.Fprintf(&reg, "// %s registers the generated tables on dbmap.\n", fn)
+	fmt.Fprintf(&reg, "func %s(dbmap *modl.DbMap) {\n", fn)
+	// tables such as order-line and order_line get the same name, so later
+	// ones are suffixed, as columns are
+	names := map[string]bool{fn: true}
+	for _, t := range schema.Tables {
+		name := exportedName(t.Name)
+		for names[name] {
+			name += "_"
+		}
+		names[name] = true
+		fmt.Fprintf(&body, "// %s maps the %s table.\n", name, t.Name)
+		fmt.Fprintf(&body, "type %s struct {\n", name)
+		fields := map[string]bool{}
+		pk := map[string]bool{}
+		for _, k := range t.PrimaryKey {
+			pk[k] = true
+		}
+		for _, c := range t.Columns {
+			field := exportedName(c.Name)
+			for fields[field] {
+				field += "_"
+			}
+			typ, imp := goType(c, !c.NotNull && !pk[c.Name])
+			if imp != "" {
+				imports[imp] = true
+			}
+			// modl uses a field named Version as the optimistic lock
+			// column, which must be an integer
+			if field == "Version" {
+				if typ == "int64" {
+					body.WriteString("\t// Version is used by modl as the optimistic lock column: it is\n" +
+						"\t// incremented by every update, which fails if it has changed.\n")
+				} else {
+					field += "_"
+					for fields[field] {
+						field += "_"
+					}
+					fmt.Fprintf(&body, "\t// %s is not named Version, which modl would use as the\n"+
+						"\t// optimistic lock column.\n", field)
+				}
+			}
+			fields[field] = true
+			fmt.Fprintf(&body, "\t%s %s `db:%q`\n", field, typ, c.Name)
+		}
+		body.WriteString("}\n\n")
+
+		fmt.Fprintf(&reg, "\t{\n\t\tt := dbmap.AddTableWithName(%s{}, %q)\n", name, t.Name)
+		if len(t.PrimaryKey) > 0 {
+			autoIncr := len(t.PrimaryKey) == 1 && t.Column(t.PrimaryKey[0]).AutoIncr
+			keys := make([]string, len(t.PrimaryKey))
+			for i, k := range t.PrimaryKey {
+				keys[i] = strconv.Quote(k)
+			}
+			fmt.Fprintf(&reg, "\t\tt.SetKeys(%v, %s)\n", autoIncr, strings.Join(keys, ", "))
+		}
+		for _, c := range t.Columns {
+			if size := maxSize(c.Type); size > 0 {
+				fmt.Fprintf(&reg, "\t\tt.ColMap(%q).SetMaxSize(%d)\n", c.Name, size)
+			}
+		}
+		reg.WriteString("\t}\n")
+	}
+	reg.WriteString("}\n")
+
+	src := bytes.Buffer{}
+	src.WriteString("// Code generated by modl-gen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&src, "package %s\n\nimport (\n", pkg)
+	var imps []string
+	for imp := range imports {
+		imps = append(imps, imp)
+	}
+	sort.Strings(imps)
+	for _, imp := range imps {
+		fmt.Fprintf(&src, "\t%q\n", imp)
+	}
+	if len(imps) > 0 {
+		src.WriteString("\n")
+	}
+	src.WriteString("\t\"mindoktor.io/modl\"\n)\n\n")
+	src.Write(body.Bytes())
+	src.Write(reg.Bytes())
+	return format.Source(src.Bytes())
+}
+
+// goType returns the Go type for a column and the package it needs, if any.
+// Types are matched by name much as sqlite assigns type affinity, so that
+// the types of all three databases are covered.  Nullable columns get the
+// database/sql Null types, and unknown types are mapped to strings.
+func goType(c *modl.ColumnSchema, nullable bool) (typ, imp string) {
+	t := strings.ToLower(c.Type)
+	switch {
+	case strings.HasPrefix(t, "bool") || strings.HasPrefix(t, "tinyint(1)"):
+		if nullable {
+			return "sql.NullBool", "database/sql"
+		}
+		return "bool", ""
+	case strings.Contains(t, "int") && !strings.Contains(t, "interval") && !strings.Contains(t, "point"),
+		strings.Contains(t, "serial"):
+		if nullable {
+			return "sql.NullInt64", "database/sql"
+		}
+		return "int64", ""
+	case strings.Contains(t, "real"), strings.Contains(t, "floa"), strings.Contains(t, "doub"):
+		if nullable {
+			return "sql.NullFloat64", "database/sql"
+		}
+		return "float64", ""
+	case strings.Contains(t, "blob"), strings.Contains(t, "bytea"), strings.Contains(t, "binary"):
+		return "[]byte", ""
+	case strings.HasPrefix(t, "date"), strings.HasPrefix(t, "time"):
+		if nullable {
+			return "sql.NullTime", "database/sql"
+		}
+		return "time.Time", "time"
+	}
+	if nullable {
+		return "sql.NullString", "database/sql"
+	}
+	return "string", ""
+}
+
+// maxSize returns the length of character types such as "varchar(64)", or 0.
+func maxSize(typ string) int {
+	t := strings.ToLower(typ)
+	if !strings.Contains(t, "char") {
+		return 0
+	}
+	i, j := strings.Index(t, "("), strings.Index(t, ")")
+	if i < 0 || j < i {
+		return 0
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(t[i+1 : j]))
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+// initialisms are spelled in upper case in generated names, as golint
+// expects.
+var initialisms = map[string]bool{
+	"id": true, "url": true, "uri": true, "uuid": true, "http": true, "ip": true,
+	"json": true, "xml": true, "html": true, "sql": true, "api": true,
+}
+
+// exportedName returns a camel cased Go identifier for a table or column
+// name, such as "ParentID" for "parent_id".
+func exportedName(name string) string {
+	var b strings.Builder
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) {
+		if initialisms[strings.ToLower(part)] {
+			b.WriteString(strings.ToUpper(part))
+		} else {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	s := b.String()
+	if s == "" || s[0] >= '0' && s[0] <= '9' {
+		s = "T" + s
+	}
+	return s
+}
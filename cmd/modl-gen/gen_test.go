@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestGenerateSqlite(t *testing.T) {
+	dir := t.TempDir()
+	dsn := filepath.Join(dir, "legacy.db")
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range []string{
+		`create table customer (id integer primary key, full_name varchar(64) not null,
+			email text, balance real not null, created_at datetime not null, avatar blob)`,
+		`create table order_line (order_id integer not null, line_no integer not null,
+			sku varchar(32), version text, primary key (order_id, line_no))`,
+		`create table "order-line" (id integer primary key, version integer not null)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := filepath.Join(dir, "tables.go")
+	if err := run("sqlite3", dsn, "models", "AddTables", out, ""); err != nil {
+		t.Fatal(err)
+	}
+	src, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"package models",
+		"type Customer struct {",
+		"ID        int64          `db:\"id\"`",
+		"FullName  string         `db:\"full_name\"`",
+		"Email     sql.NullString `db:\"email\"`",
+		"Balance   float64        `db:\"balance\"`",
+		"CreatedAt time.Time      `db:\"created_at\"`",
+		"Avatar    []byte         `db:\"avatar\"`",
+		"type OrderLine struct {",
+		`t := dbmap.AddTableWithName(Customer{}, "customer")`,
+		`t.SetKeys(true, "id")`,
+		`t.ColMap("full_name").SetMaxSize(64)`,
+		`t.SetKeys(false, "order_id", "line_no")`,
+		`t.ColMap("sku").SetMaxSize(32)`,
+		"// OrderLine_ maps the order_line table.",
+		"Version_ sql.NullString `db:\"version\"`",
+		"// Version is used by modl as the optimistic lock column",
+		"Version int64 `db:\"version\"`",
+	} {
+		if !strings.Contains(string(src), expected) {
+			t.Errorf("Expected %q in generated source:\n%s", expected, src)
+		}
+	}
+
+	if err := run("sqlite3", dsn, "models", "AddTables", out, "customer, missing"); err == nil {
+		t.Errorf("Expected an error for a missing table")
+	}
+}
+
+func TestExportedName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"parent_id":   "ParentID",
+		"order-line":  "OrderLine",
+		"api_url":     "APIURL",
+		"2fa_enabled": "T2faEnabled",
+		"Name":        "Name",
+	} {
+		if got := exportedName(name); got != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, name, got)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Command modl-gen generates Go structs and modl table registrations from the
+// tables of an existing database.
+//
+// Usage:
+//
+//     modl-gen -driver sqlite3 -dsn app.db -package models -out models/tables.go
+//
+// The generated file holds a struct per table, with db tags naming the
+// columns, and a function registering the tables on a DbMap with
+// AddTableWithName, SetKeys and SetMaxSize.  Supported drivers are sqlite3,
+// postgres and mysql.
+//
+// Tables and columns whose names give the same Go name, such as order-line
+// and order_line, are told apart by appending underscores.  A Version field
+// is the optimistic lock column to modl, so a version column which is not an
+// integer becomes a Version_ field instead.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"mindoktor.io/modl"
+)
+
+func main() {
+	driver := flag.String("driver", "sqlite3", "database driver: sqlite3, postgres or mysql")
+	dsn := flag.String("dsn", "", "data source name, a file path for sqlite3")
+	pkg := flag.String("package", "models", "package name of the generated file")
+	fn := flag.String("func", "AddTables", "name of the generated registration function")
+	out := flag.String("out", "", "output file, stdout if empty")
+	tables := flag.String("tables", "", "comma separated tables to generate, all if empty")
+	flag.Parse()
+
+	if err := run(*driver, *dsn, *pkg, *fn, *out, *tables); err != nil {
+		fmt.Fprintln(os.Stderr, "modl-gen:", err)
+		os.Exit(1)
+	}
+}
+
+func run(driver, dsn, pkg, fn, out, tables string) error {
+	if dsn == "" {
+		return fmt.Errorf("-dsn is required")
+	}
+	dialect, err := dialectFor(driver)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	schema, err := modl.NewDbMap(db, dialect).InspectSchema(context.Background())
+	if err != nil {
+		return err
+	}
+	if tables != "" {
+		schema, err = filterTables(schema, strings.Split(tables, ","))
+		if err != nil {
+			return err
+		}
+	}
+	src, err := generate(schema, pkg, fn)
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		_, err = os.Stdout.Write(src)
+		return err
+	}
+	return os.WriteFile(out, src, 0644)
+}
+
+func dialectFor(driver string) (modl.Dialect, error) {
+	switch driver {
+	case "sqlite3":
+		return modl.SqliteDialect{}, nil
+	case "postgres":
+		return modl.PostgresDialect{}, nil
+	case "mysql":
+		return modl.MySQLDialect{Engine: "InnoDB", Encoding: "UTF8"}, nil
+	}
+	return nil, fmt.Errorf("unsupported driver %q", driver)
+}
+
+func filterTables(schema *modl.Schema, names []string) (*modl.Schema, error) {
+	filtered := &modl.Schema{}
+	for _, name := range names {
+		t := schema.Table(strings.TrimSpace(name))
+		if t == nil {
+			return nil, fmt.Errorf("no table %q in the database", name)
+		}
+		filtered.Tables = append(filtered.Tables, t)
+	}
+	return filtered, nil
+}
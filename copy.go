@@ -0,0 +1,188 @@
+package modl
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// CopyFromContext bulk loads the rows in src into the table registered for
+// its element type, in a transaction of its own.  src must be a slice or a
+// channel of structs or struct pointers; a channel is read until it is
+// closed.  Returns the number of rows loaded.
+//
+// On dialects which support it, such as PostgreSQL, rows are streamed with
+// COPY FROM STDIN.  The column list is every non-transient column except an
+// auto-increment key, which is left to the database and not bound back to
+// the struct.  Other dialects fall back to InsertBatchContext, which does
+// bind auto-increment keys.
+//
+// Hook functions PreInsert() and PostInsert() are executed for each row as
+// with InsertBatchContext.  While a COPY is open the transaction cannot run
+// other statements, so PreInsert() must not use the SqlExecutor it is
+// passed, and PostInsert() is only run once all rows have been copied.  The
+// rows are kept until then if the table has a PostInsert() hook.
+func (m *DbMap) CopyFromContext(ctx context.Context, src interface{}) (int64, error) {
+	t, err := m.BeginContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n, err := copyFrom(ctx, m, t, src)
+	if err != nil {
+		t.Rollback()
+		return 0, err
+	}
+	return n, t.Commit()
+}
+
+// CopyFromContext has the same behavior as DbMap.CopyFromContext(), but runs
+// in this transaction.
+func (t *Transaction) CopyFromContext(ctx context.Context, src interface{}) (int64, error) {
+	return copyFrom(ctx, t.dbmap, t, src)
+}
+
+// rowSource returns a function yielding successive elements of a slice or
+// channel, and false once they are exhausted.
+func rowSource(ctx context.Context, v reflect.Value) (func() (reflect.Value, bool, error), error) {
+	switch v.Kind() {
+	case reflect.Slice:
+		i := 0
+		return func() (reflect.Value, bool, error) {
+			if i >= v.Len() {
+				return reflect.Value{}, false, nil
+			}
+			i++
+			return v.Index(i - 1), true, nil
+		}, nil
+	case reflect.Chan:
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: v},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+		}
+		return func() (reflect.Value, bool, error) {
+			chosen, row, ok := reflect.Select(cases)
+			if chosen == 1 {
+				return reflect.Value{}, false, ctx.Err()
+			}
+			return row, ok, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("modl: cannot copy from %v, need a slice or channel", v.Type())
+}
+
+func copyFrom(ctx context.Context, m *DbMap, t *Transaction, src interface{}) (int64, error) {
+	v := reflect.ValueOf(src)
+	next, err := rowSource(ctx, v)
+	if err != nil {
+		return 0, err
+	}
+
+	elemType := v.Type().Elem()
+	if elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+	table := m.TableForType(elemType)
+	if table == nil {
+		return 0, fmt.Errorf("could not find table for %v", elemType)
+	}
+
+	// return a pointer to each row so hooks and auto-increment keys can
+	// modify it; slice elements are modified in place
+	pointer := func(row reflect.Value) interface{} {
+		if row.Kind() == reflect.Ptr {
+			return row.Interface()
+		}
+		if row.CanAddr() {
+			return row.Addr().Interface()
+		}
+		p := reflect.New(row.Type())
+		p.Elem().Set(row)
+		return p.Interface()
+	}
+
+	var columns []string
+	for _, col := range table.Columns {
+		if !col.Transient && !col.isAutoIncr {
+			columns = append(columns, col.ColumnName)
+		}
+	}
+	clause := m.Dialect.CopyInClause(table.SchemaName, table.TableName, columns)
+
+	if clause == "" {
+		var count int64
+		size := batchSize(m, table, 1000)
+		batch := make([]interface{}, 0, size)
+		for {
+			row, ok, err := next()
+			if err != nil {
+				return count, err
+			}
+			if ok {
+				batch = append(batch, pointer(row))
+			}
+			if len(batch) == size || (!ok && len(batch) > 0) {
+				err = insertBatch(ctx, m, t, batch...)
+				if err != nil {
+					return count, err
+				}
+				count += int64(len(batch))
+				batch = batch[:0]
+			}
+			if !ok {
+				return count, nil
+			}
+		}
+	}
+
+	m.trace(clause)
+	stmt, err := t.Tx.PrepareContext(ctx, clause)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	plan := table.insertBatchPlan()
+	var count int64
+	var copied []interface{}
+	for {
+		row, ok, err := next()
+		if err != nil {
+			return count, err
+		}
+		if !ok {
+			break
+		}
+		ptr := pointer(row)
+
+		if table.CanPreInsert {
+			err = ptr.(PreInserter).PreInsert(ctx, t)
+			if err != nil {
+				return count, err
+			}
+		}
+
+		bi := plan.createBindInstance(reflect.ValueOf(ptr).Elem())
+		_, err = stmt.ExecContext(ctx, bi.args...)
+		if err != nil {
+			return count, err
+		}
+		count++
+
+		if table.CanPostInsert {
+			copied = append(copied, ptr)
+		}
+	}
+
+	// an Exec without arguments ends the copy and flushes the rows
+	_, err = stmt.ExecContext(ctx)
+	if err != nil {
+		return count, err
+	}
+	for _, ptr := range copied {
+		err = ptr.(PostInserter).PostInsert(ctx, t)
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
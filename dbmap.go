@@ -44,6 +44,13 @@ type DbMap struct {
 	// Dialect implementation to use with this map
 	Dialect Dialect
 
+	// SchemaName is the schema of tables added to this map, or "" for the
+	// connection's default schema.  TablePrefix is prepended to the names
+	// of tables added to this map.  Both are applied by AddTable, so they
+	// must be set before tables are added.
+	SchemaName  string
+	TablePrefix string
+
 	tables    []*TableMap
 	logger    *log.Logger
 	logPrefix string
@@ -85,6 +92,37 @@ func (m *DbMap) TraceOff() {
 // AddTable registers the given interface type with modl. The table name
 // will be given the name of the TypeOf(i), lowercased.
 //
+// Columns can optionally be configured with a "modl" struct tag holding a
+// comma separated list of options:
+//
+//     pk          the column is part of the primary key, as with SetKeys
+//     autoincr    the key is auto-incremented by the database
+//     size:64     the column's MaxSize, as with SetMaxSize
+//     unique      the column is unique, as with SetUnique
+//     type:jsonb  the column's sql type, as with SetSqlType
+//     version     the column is the version column, as with SetVersionCol
+//     prefix      flatten a struct field, see below
+//
+// For example:
+//
+//     type Person struct {
+//         ID    int64  `modl:"pk,autoincr"`
+//         Email string `modl:"size:64,unique"`
+//     }
+//
+// Calling the corresponding setters after AddTable overrides the tag.
+//
+// The fields of embedded structs are mapped as columns of the table, as if
+// they were declared on the outer struct; as in Go, a field declared at a
+// shallower depth shadows deeper ones of the same name.  Embedded pointers
+// to structs are flattened the same way, and nil ones are allocated when a
+// row is read into or written from the struct.  A named struct field tagged
+// with "prefix" is flattened too, with its columns prefixed by the field's
+// column name and an underscore, or by the tag's argument if given, as in
+// "prefix:home_".
+// Such columns are aliased in generated selects to the dotted names sqlx
+// expects (eg. "address.street"), which hand written queries must also use.
+//
 // This operation is idempotent. If i's type is already mapped, the
 // existing *TableMap is returned.
 func (m *DbMap) AddTable(i interface{}, name ...string) *TableMap {
@@ -98,6 +136,7 @@ func (m *DbMap) AddTable(i interface{}, name ...string) *TableMap {
 	if len(Name) == 0 {
 		Name = TableNameMapper(t.Name())
 	}
+	Name = m.TablePrefix + Name
 
 	// check if we have a table for this type already
 	// if so, update the name and return the existing pointer
@@ -105,34 +144,18 @@ func (m *DbMap) AddTable(i interface{}, name ...string) *TableMap {
 		table := m.tables[i]
 		if table.gotype == t {
 			table.TableName = Name
+			table.SchemaName = m.SchemaName
 			return table
 		}
 	}
 
-	tmap := &TableMap{gotype: t, TableName: Name, dbmap: m, mapper: m.mapper}
+	tmap := &TableMap{gotype: t, TableName: Name, SchemaName: m.SchemaName, dbmap: m, mapper: m.mapper}
 	tmap.setupHooks(i)
 
-	n := t.NumField()
-	tmap.Columns = make([]*ColumnMap, 0, n)
-	for i := 0; i < n; i++ {
-		f := t.Field(i)
-		columnName := f.Tag.Get("db")
-		if columnName == "" {
-			columnName = sqlx.NameMapper(f.Name)
-		}
-
-		cm := &ColumnMap{
-			ColumnName: columnName,
-			Transient:  columnName == "-",
-			fieldName:  f.Name,
-			gotype:     f.Type,
-			table:      tmap,
-		}
-		tmap.Columns = append(tmap.Columns, cm)
-		if cm.fieldName == "Version" {
-			tmap.version = tmap.Columns[len(tmap.Columns)-1]
-		}
-	}
+	tmap.Columns = make([]*ColumnMap, 0, t.NumField())
+	tmap.addColumns(t, nil, "", "", "")
+	tmap.Columns = shadowColumns(tmap.Columns)
+	tmap.parseTags()
 	m.tables = append(m.tables, tmap)
 
 	return tmap
@@ -144,8 +167,18 @@ func (m *DbMap) AddTableWithName(i interface{}, name string) *TableMap {
 	return m.AddTable(i, name)
 }
 
+// AddTableWithNameAndSchema adds a new mapping of the interface to a table
+// name in the given schema, overriding the map's SchemaName.
+func (m *DbMap) AddTableWithNameAndSchema(i interface{}, schema, name string) *TableMap {
+	table := m.AddTable(i, name)
+	table.SchemaName = schema
+	table.ResetSql()
+	return table
+}
+
 // CreateTablesSql returns create table SQL as a map of table names to
-// their associated CREATE TABLE statements.
+// their associated CREATE TABLE statements, each followed by the table's
+// CREATE INDEX statements on separate lines.
 func (m *DbMap) CreateTablesSql(ctx context.Context) (map[string]string, error) {
 	return m.createTables(ctx, false, false)
 }
@@ -158,6 +191,9 @@ func (m *DbMap) CreateTablesIfNotExistsSql(ctx context.Context) (map[string]stri
 
 // CreateTables iterates through TableMaps registered to this DbMap and
 // executes "create table" statements against the database for each.
+// Tables are created after the tables their foreign keys reference; an error
+// is returned if the references form a cycle.  The indexes added to each
+// table are created right after it.
 //
 // This is particularly useful in unit tests where you want to create
 // and destroy the schema automatically.
@@ -174,21 +210,42 @@ func (m *DbMap) CreateTablesIfNotExists(ctx context.Context) error {
 	return err
 }
 
+// writeForeignKeySql writes a table level foreign key constraint for col,
+// which mysql requires as it ignores references in column definitions.
+func writeForeignKeySql(sql *bytes.Buffer, col *ColumnMap) {
+	d := col.table.dbmap.Dialect
+	fk := col.ForeignKey
+	sql.WriteString("foreign key (")
+	sql.WriteString(d.QuoteField(col.ColumnName))
+	sql.WriteString(") references ")
+	sql.WriteString(d.QuotedTableForQuery(fk.Table.SchemaName, fk.Table.TableName))
+	sql.WriteString(" (")
+	sql.WriteString(d.QuoteField(fk.Column.ColumnName))
+	sql.WriteString(")")
+	if fk.OnDelete != "" {
+		sql.WriteString(" on delete ")
+		sql.WriteString(string(fk.OnDelete))
+	}
+	if fk.OnUpdate != "" {
+		sql.WriteString(" on update ")
+		sql.WriteString(string(fk.OnUpdate))
+	}
+}
+
 func writeColumnSql(sql *bytes.Buffer, col *ColumnMap) {
 	if len(col.createSql) > 0 {
 		sql.WriteString(col.createSql)
 		return
 	}
-	sqltype := col.sqltype
-	if len(sqltype) == 0 {
-		sqltype = col.table.dbmap.Dialect.ToSqlType(col)
-	}
-	sql.WriteString(fmt.Sprintf("%s %s", col.table.dbmap.Dialect.QuoteField(col.ColumnName), sqltype))
-	if col.isPK {
+	sql.WriteString(fmt.Sprintf("%s %s", col.table.dbmap.Dialect.QuoteField(col.ColumnName), col.sqlType()))
+	if col.isPK || col.NotNull {
 		sql.WriteString(" not null")
-		if len(col.table.Keys) == 1 {
-			sql.WriteString(" primary key")
-		}
+	}
+	if col.Default != "" {
+		sql.WriteString(" default " + col.Default)
+	}
+	if col.isPK && len(col.table.Keys) == 1 {
+		sql.WriteString(" primary key")
 	}
 	if col.Unique {
 		sql.WriteString(" unique")
@@ -196,73 +253,117 @@ func writeColumnSql(sql *bytes.Buffer, col *ColumnMap) {
 	if col.isAutoIncr {
 		sql.WriteString(" " + col.table.dbmap.Dialect.AutoIncrStr())
 	}
+	if col.Check != "" {
+		sql.WriteString(" check (" + col.Check + ")")
+	}
 }
 
 func (m *DbMap) createTables(ctx context.Context, ifNotExists, exec bool) (map[string]string, error) {
-	var err error
 	ret := map[string]string{}
+	tables, err := m.sortedTables()
+	if err != nil {
+		return ret, err
+	}
+	for _, table := range tables {
+		stmts, err := m.createTableSql(table, ifNotExists, !exec)
+		if err != nil {
+			return ret, err
+		}
+		if exec {
+			for _, stmt := range stmts {
+				_, err = m.ExecContext(ctx, stmt)
+				if err != nil {
+					return ret, err
+				}
+			}
+		} else {
+			ret[table.TableName] = strings.Join(stmts, "\n")
+		}
+	}
+	return ret, nil
+}
 
+// createTableSql returns the "create table" statement for table followed by
+// the statements creating its indexes.  If pretty is true, columns are put on
+// separate lines.
+func (m *DbMap) createTableSql(table *TableMap, ifNotExists, pretty bool) ([]string, error) {
 	sep := ", "
 	prefix := ""
-	if !exec {
+	if pretty {
 		sep = ",\n"
 		prefix = "    "
 	}
 
-	for i := range m.tables {
-		table := m.tables[i]
-
-		s := bytes.Buffer{}
-		s.WriteString("create table ")
-		if ifNotExists {
-			s.WriteString("if not exists ")
-		}
-		s.WriteString(m.Dialect.QuoteField(table.TableName))
-		s.WriteString(" (")
-		if !exec {
-			s.WriteString("\n")
-		}
-		x := 0
-		for _, col := range table.Columns {
-			if !col.Transient {
-				if x > 0 {
-					s.WriteString(sep)
-				}
-				s.WriteString(prefix)
-				writeColumnSql(&s, col)
-				x++
+	s := bytes.Buffer{}
+	s.WriteString("create table ")
+	if ifNotExists {
+		s.WriteString("if not exists ")
+	}
+	s.WriteString(table.quotedTableName())
+	s.WriteString(" (")
+	if pretty {
+		s.WriteString("\n")
+	}
+	x := 0
+	for _, col := range table.Columns {
+		if !col.Transient {
+			if x > 0 {
+				s.WriteString(sep)
 			}
+			s.WriteString(prefix)
+			writeColumnSql(&s, col)
+			x++
 		}
-		if len(table.Keys) > 1 {
-			s.WriteString(", primary key (")
-			for x := range table.Keys {
-				if x > 0 {
-					s.WriteString(", ")
-				}
-				s.WriteString(m.Dialect.QuoteField(table.Keys[x].ColumnName))
+	}
+	if len(table.Keys) > 1 {
+		s.WriteString(", primary key (")
+		for x := range table.Keys {
+			if x > 0 {
+				s.WriteString(", ")
 			}
-			s.WriteString(")")
+			s.WriteString(m.Dialect.QuoteField(table.Keys[x].ColumnName))
 		}
-		s.WriteString(fmt.Sprintf(")%s;", m.Dialect.CreateTableSuffix()))
-		if exec {
-			_, err = m.ExecContext(ctx, s.String())
-			if err != nil {
-				break
-			}
-		} else {
-			ret[table.TableName] = s.String()
+		s.WriteString(")")
+	}
+	for _, col := range table.Columns {
+		if !col.Transient && col.ForeignKey != nil {
+			s.WriteString(sep)
+			s.WriteString(prefix)
+			writeForeignKeySql(&s, col)
+		}
+	}
+	s.WriteString(fmt.Sprintf(")%s;", m.Dialect.CreateTableSuffix()))
+	stmts := []string{s.String()}
+	for _, idx := range table.Indexes {
+		stmt, err := m.createIndexSql(idx, ifNotExists)
+		if err != nil {
+			return nil, err
 		}
+		stmts = append(stmts, stmt)
 	}
-	return ret, err
+	return stmts, nil
+}
+
+func (m *DbMap) createIndexSql(idx *IndexMap, ifNotExists bool) (string, error) {
+	stmt := m.Dialect.CreateIndexSql(idx, ifNotExists)
+	if stmt == "" {
+		return "", fmt.Errorf("modl: index %s on table %s is not supported by the dialect", idx.IndexName, idx.table.TableName)
+	}
+	return stmt, nil
 }
 
 // DropTables iterates through TableMaps registered to this DbMap and
-// executes "drop table" statements against the database for each.
+// executes "drop table" statements against the database for each.  Tables
+// are dropped before the tables their foreign keys reference.
 func (m *DbMap) DropTables(ctx context.Context) error {
-	var err error
-	for i := range m.tables {
-		table := m.tables[i]
-		_, e := m.ExecContext(ctx, fmt.Sprintf("drop table %s;", m.Dialect.QuoteField(table.TableName)))
+	tables, err := m.sortedTables()
+	if err != nil {
+		return err
+	}
+	// drop referencing tables before the tables they reference
+	for i := len(tables) - 1; i >= 0; i-- {
+		table := tables[i]
+		_, e := m.ExecContext(ctx, fmt.Sprintf("drop table %s;", table.quotedTableName()))
 		if e != nil {
 			err = e
 		}
@@ -280,12 +381,49 @@ func (m *DbMap) InsertContext(ctx context.Context, list ...interface{}) error {
 	return insert(ctx, m, m, list...)
 }
 
+// InsertBatchContext inserts the elements of list using multi-row INSERT
+// statements rather than one statement per element.  Statements are split to
+// stay under the dialect's bindvar limit, and consecutive elements of the
+// same type are written together.  As with Insert, list items must be
+// pointers and auto-increment PKs are bound back to the struct fields.
+//
+// Hook function PreInsert() is executed for every element of a batch
+// before it is written, and PostInsert() for every element afterwards.
+func (m *DbMap) InsertBatchContext(ctx context.Context, list ...interface{}) error {
+	return insertBatch(ctx, m, m, list...)
+}
+
+// UpsertContext inserts each element in list, or updates the existing row if
+// one conflicts with it.  Rows are matched on the columns set with
+// TableMap.SetConflictKeys, or the primary keys by default.  On MySQL, a
+// conflict on any unique key updates the existing row.  List items must be
+// pointers.
+//
+// Auto-increment keys and the version column are bound to the struct from the
+// inserted or updated row, which returns them on PostgreSQL and SQLite; on
+// MySQL they are read back by the conflict columns.  Upsert always increments
+// the version of an existing row and does not return an
+// OptimisticLockError; use Update when concurrent modifications must be
+// detected.  Note that on PostgreSQL, inserting a row with a non-zero
+// auto-increment key does not advance the key's sequence.
+//
+// Hook functions PreInsert() and/or PostInsert() will be executed
+// before/after the statement if the interface defines them.  They run
+// whether the row is inserted or updated, as it is not known beforehand;
+// PreUpdate() and PostUpdate() are never run by Upsert.
+func (m *DbMap) UpsertContext(ctx context.Context, list ...interface{}) error {
+	return upsert(ctx, m, m, list...)
+}
+
 // Update runs a SQL UPDATE statement for each element in list.  List
 // items must be pointers.
 //
 // Hook functions PreUpdate() and/or PostUpdate() will be executed
 // before/after the UPDATE statement if the interface defines them.
 //
+// If the struct embeds a Snapshot, only the columns changed since it was
+// loaded are updated, and no statement is run if none have changed.
+//
 // Returns number of rows updated.
 //
 // Returns an error if SetKeys has not been called on the TableMap or if
@@ -294,6 +432,19 @@ func (m *DbMap) UpdateContext(ctx context.Context, list ...interface{}) (int64,
 	return update(ctx, m, m, list...)
 }
 
+// UpdateColumnsContext runs a SQL UPDATE statement which only sets the given
+// fields of ptr, leaving other columns untouched.  fields may be struct field
+// names or column names, but not primary keys.  If the table has a version
+// column, it is checked and incremented as with Update.
+//
+// Hook functions PreUpdate() and/or PostUpdate() will be executed
+// before/after the UPDATE statement if the interface defines them.
+//
+// Returns number of rows updated.
+func (m *DbMap) UpdateColumnsContext(ctx context.Context, ptr interface{}, fields ...string) (int64, error) {
+	return updateColumns(ctx, m, m, ptr, fields...)
+}
+
 // Delete runs a SQL DELETE statement for each element in list.  List
 // items must be pointers.
 //
@@ -308,6 +459,86 @@ func (m *DbMap) DeleteContext(ctx context.Context, list ...interface{}) (int64,
 	return deletes(ctx, m, m, list...)
 }
 
+// UpdateWhere runs a single SQL UPDATE statement setting columns of the
+// rows of i's table which match where, without loading them.  i is a value
+// of, or pointer to, the mapped struct, eg. &Invoice{}.  The keys of set
+// are column or field names, as for UpdateColumnsContext, and its values are
+// bound as arguments.  where is a sql condition with "?" placeholders for
+// args, which are replaced with the dialect's bindvars; an empty where
+// updates every row.  The version column, if any, is left alone, so copies
+// loaded earlier can still be updated over the change; use
+// UpdateWhereVersioned to make them fail their optimistic lock check.
+//
+// No hooks are run, and snapshots of loaded rows are not updated.
+//
+// Returns number of rows updated.
+func (m *DbMap) UpdateWhere(ctx context.Context, i interface{}, set map[string]interface{}, where string, args ...interface{}) (int64, error) {
+	return updateWhere(ctx, m, m, i, false, set, where, args...)
+}
+
+// UpdateWhereVersioned is like UpdateWhere, but also increments the version
+// column of every updated row, so that copies loaded earlier fail their
+// optimistic lock check.  set may then be empty, to only bump the versions.
+//
+// Returns number of rows updated.
+func (m *DbMap) UpdateWhereVersioned(ctx context.Context, i interface{}, set map[string]interface{}, where string, args ...interface{}) (int64, error) {
+	return updateWhere(ctx, m, m, i, true, set, where, args...)
+}
+
+// DeleteWhere runs a single SQL DELETE statement for the rows of i's table
+// which match where, without loading them.  i and where are as for
+// UpdateWhere.  No hooks are run.
+//
+// Returns number of rows deleted.
+func (m *DbMap) DeleteWhere(ctx context.Context, i interface{}, where string, args ...interface{}) (int64, error) {
+	return deleteWhere(ctx, m, m, i, where, args...)
+}
+
+// UpdateBatchContext runs SQL UPDATE statements for the elements of list,
+// which must be pointers, setting the columns of as many rows at once as the
+// dialect's bindvar limit allows.  Consecutive elements mapped to the same
+// table are updated together, by an "update ... from (values ...)" on
+// Postgres and "case" expressions elsewhere.  Every column is set, even on
+// tables using snapshots.  Rows of tables with only key columns have nothing
+// to set, so no statement is run for them, but their hooks still are.
+//
+// Hook functions PreUpdate() and/or PostUpdate() will be executed for every
+// element of a batch before/after its UPDATE statement if the interface
+// defines them.
+//
+// If the table has a version column, the versions of a batch's rows are
+// read before it is updated, and an OptimisticLockErrors with an error for
+// each row out of date is returned if any are, leaving the batch's rows in
+// the database untouched.  The PreUpdate() hooks of the batch have already
+// run by then, and any changes they made to the structs are kept.  A row
+// changed concurrently between the read and the update is reported the
+// same way, but the batch's other rows have then been written.  Run it in
+// a transaction, so that earlier batches and the hooks' own statements can
+// be rolled back.
+//
+// An element whose row is already in list is an error, and nothing is
+// updated.
+//
+// Returns number of rows updated.
+func (m *DbMap) UpdateBatchContext(ctx context.Context, list ...interface{}) (int64, error) {
+	return updateBatch(ctx, m, m, list...)
+}
+
+// DeleteBatchContext runs SQL DELETE statements for the elements of list,
+// which must be pointers, deleting as many rows at once as the dialect's
+// bindvar limit allows by their primary keys.  Consecutive elements mapped
+// to the same table are deleted together.
+//
+// Hook functions PreDelete() and/or PostDelete() will be executed for every
+// element of a batch before/after its DELETE statement if the interface
+// defines them.  Versions are checked after the PreDelete() hooks, and
+// rows may only be listed once, as for UpdateBatchContext.
+//
+// Returns number of rows deleted.
+func (m *DbMap) DeleteBatchContext(ctx context.Context, list ...interface{}) (int64, error) {
+	return deleteBatch(ctx, m, m, list...)
+}
+
 // Get runs a SQL SELECT to fetch a single row from the table based on the
 // primary key(s)
 //
@@ -327,6 +558,26 @@ func (m *DbMap) GetContext(ctx context.Context, dest interface{}, keys ...interf
 	return get(ctx, m, m, dest, keys...)
 }
 
+// GetManyContext fetches the rows of a table by a list of primary keys, in
+// as few SELECT statements as the dialect's bindvar limit allows.
+//
+// dest should be a pointer to a slice of the struct to load, or of pointers
+// to it; the rows are appended in no particular order.  keys should be a
+// slice of key values, such as a []int64, or for a table with multiple keys
+// a slice of slices holding the values in the order given to SetKeys(), such
+// as [][]interface{}{{1, "a"}, {2, "b"}}.
+//
+// Hook function PostGet() will be executed for each row if the interface
+// defines it.
+//
+// Returns the elements of keys for which no row was found.  Keys are
+// matched to rows by their Go syntax representation, so keys should have
+// the kind of the key fields: a string key for an integer field is reported
+// missing even if a row was loaded for it.
+func (m *DbMap) GetManyContext(ctx context.Context, dest interface{}, keys interface{}) ([]interface{}, error) {
+	return getMany(ctx, m, m, dest, keys)
+}
+
 // Select runs an arbitrary SQL query, binding the columns in the result
 // to fields on the struct specified by dest.  args represent the bind
 // parameters for the SQL statement.
@@ -358,26 +609,78 @@ func (m *DbMap) SelectOneContext(ctx context.Context, dest interface{}, query st
 	return hookedget(ctx, m, m, dest, query, args...)
 }
 
+// SelectIntContext runs a query which returns a single column, and returns
+// the value of its first row as an int64, or 0 if there are no rows.  A NULL
+// value is an error; use SelectNullIntContext for queries which may return
+// one.  An error is returned if the query returns more than one column.
+func (m *DbMap) SelectIntContext(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	return selectInt(ctx, m, query, args...)
+}
+
+// SelectNullIntContext runs a query which returns a single column, and
+// returns the value of its first row as an sql.NullInt64, which is invalid if
+// the value is NULL or there are no rows.
+func (m *DbMap) SelectNullIntContext(ctx context.Context, query string, args ...interface{}) (sql.NullInt64, error) {
+	return selectNullInt(ctx, m, query, args...)
+}
+
+// SelectFloatContext behaves as SelectIntContext, but returns a float64.
+func (m *DbMap) SelectFloatContext(ctx context.Context, query string, args ...interface{}) (float64, error) {
+	return selectFloat(ctx, m, query, args...)
+}
+
+// SelectNullFloatContext behaves as SelectNullIntContext, but returns an
+// sql.NullFloat64.
+func (m *DbMap) SelectNullFloatContext(ctx context.Context, query string, args ...interface{}) (sql.NullFloat64, error) {
+	return selectNullFloat(ctx, m, query, args...)
+}
+
+// SelectStrContext behaves as SelectIntContext, but returns a string, or ""
+// if there are no rows.
+func (m *DbMap) SelectStrContext(ctx context.Context, query string, args ...interface{}) (string, error) {
+	return selectStr(ctx, m, query, args...)
+}
+
+// SelectNullStrContext behaves as SelectNullIntContext, but returns an
+// sql.NullString.
+func (m *DbMap) SelectNullStrContext(ctx context.Context, query string, args ...interface{}) (sql.NullString, error) {
+	return selectNullStr(ctx, m, query, args...)
+}
+
 // Exec runs an arbitrary SQL statement.  args represent the bind parameters.
 // This is equivalent to running Exec() using database/sql.
 func (m *DbMap) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
-	m.trace(query, args)
-	//stmt, err := m.Db.Prepare(query)
-	//if err != nil {
-	//	return nil, err
-	//}
-	//fmt.Println("Exec", query, args)
-	return m.Db.Exec(query, args...)
+	m.trace(query, args...)
+	return m.Db.ExecContext(ctx, query, args...)
 }
 
-// Begin starts a modl Transaction.
+// Begin starts a modl Transaction.  The transaction is bound to ctx; if ctx
+// is cancelled before Commit, the transaction is rolled back.
 func (m *DbMap) BeginContext(ctx context.Context) (*Transaction, error) {
-	m.trace("begin;")
-	tx, err := m.Dbx.Beginx()
+	return m.BeginTx(ctx, nil)
+}
+
+// BeginTx starts a modl Transaction with the given isolation level and
+// read-only flag.  If opts is nil, the driver's defaults are used.  The
+// options are kept on the Transaction and can be read by hooks through
+// SqlExecutor.TxOptions.
+func (m *DbMap) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Transaction, error) {
+	var o sql.TxOptions
+	if opts != nil {
+		o = *opts
+	}
+	m.trace("begin;", o.Isolation, o.ReadOnly)
+	tx, err := m.Dbx.BeginTxx(ctx, opts)
 	if err != nil {
 		return nil, err
 	}
-	return &Transaction{m, tx}, nil
+	return &Transaction{dbmap: m, Tx: tx, opts: o}, nil
+}
+
+// TxOptions returns nil, as operations run directly on the DbMap are not
+// part of a transaction.
+func (m *DbMap) TxOptions() *sql.TxOptions {
+	return nil
 }
 
 // FIXME: This is a poor interface.  Checking for nils is un-go-like, and this
@@ -420,32 +723,83 @@ func (m *DbMap) TableForType(t reflect.Type) *TableMap {
 	return nil
 }
 
-// TruncateTables truncates all tables in the DbMap.
+// TruncateTables truncates all tables in the DbMap.  Databases refuse to
+// truncate a table referenced by a foreign key on its own, so on PostgreSQL
+// all tables are truncated in one statement, and elsewhere tables referenced
+// by the foreign keys of mapped tables are emptied with "delete from" after
+// the tables referencing them.  Tables referenced by tables which are not
+// mapped can only be truncated with TruncateTablesCascade, on PostgreSQL.
 func (m *DbMap) TruncateTables(ctx context.Context) error {
-	return m.truncateTables(ctx, false)
+	return m.truncateTables(ctx, false, false)
 }
 
-// TruncateTablesIdentityRestart truncates all tables in the DbMap and
-// resets the identity counter.
+// TruncateTablesIdentityRestart truncates all tables in the DbMap as
+// TruncateTables does, and resets the identity counter.
 func (m *DbMap) TruncateTablesIdentityRestart(ctx context.Context) error {
-	return m.truncateTables(ctx, true)
+	return m.truncateTables(ctx, true, false)
 }
 
-func (m *DbMap) truncateTables(ctx context.Context, restartIdentity bool) error {
-	var err error
+// TruncateTablesCascade truncates all tables in the DbMap, also truncating
+// any other tables referencing them by foreign key on databases which support
+// it (Postgres).  If restartIdentity is true, identity counters are reset.
+func (m *DbMap) TruncateTablesCascade(ctx context.Context, restartIdentity bool) error {
+	return m.truncateTables(ctx, restartIdentity, true)
+}
+
+func (m *DbMap) truncateTables(ctx context.Context, restartIdentity, cascade bool) error {
+	tables, err := m.sortedTables()
+	if err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+	var cascadeClause string
+	if cascade {
+		cascadeClause = m.Dialect.TruncateCascadeClause()
+	}
 	var restartClause string
-	for i := range m.tables {
-		table := m.tables[i]
+
+	if m.Dialect.TruncateTogether() {
+		names := make([]string, len(tables))
+		for i, table := range tables {
+			names[i] = table.quotedTableName()
+		}
+		if restartIdentity {
+			restartClause = m.Dialect.RestartIdentityClause(tables[0].SchemaName, tables[0].TableName)
+		}
+		_, err = m.ExecContext(ctx, fmt.Sprintf("%s %s %s %s;", m.Dialect.TruncateClause(),
+			strings.Join(names, ", "), restartClause, cascadeClause))
+		return err
+	}
+
+	// tables referenced by other tables cannot be truncated
+	referenced := map[*TableMap]bool{}
+	for _, table := range tables {
+		for _, col := range table.Columns {
+			if !col.Transient && col.ForeignKey != nil && col.ForeignKey.Table != table {
+				referenced[col.ForeignKey.Table] = true
+			}
+		}
+	}
+
+	// empty referencing tables before the tables they reference
+	for i := len(tables) - 1; i >= 0; i-- {
+		table := tables[i]
+		truncate := m.Dialect.TruncateClause()
+		if referenced[table] && cascadeClause == "" {
+			truncate = "delete from"
+		}
 		if restartIdentity {
-			restartClause = m.Dialect.RestartIdentityClause(table.TableName)
+			restartClause = m.Dialect.RestartIdentityClause(table.SchemaName, table.TableName)
 		}
 
 		// if the restart clause exists and starts with ';', then assume it's an
 		// additional query to run after we truncate.  This is true with MySQL and
 		// SQLite, which do not have extra clauses for this during table truncation.
 		if len(restartClause) > 0 && restartClause[0] == ';' {
-			_, err = m.ExecContext(ctx, fmt.Sprintf("%s %s;", m.Dialect.TruncateClause(),
-				m.Dialect.QuoteField(table.TableName)))
+			_, err = m.ExecContext(ctx, fmt.Sprintf("%s %s %s;", truncate,
+				table.quotedTableName(), cascadeClause))
 			if err != nil {
 				return err
 			}
@@ -454,7 +808,7 @@ func (m *DbMap) truncateTables(ctx context.Context, restartIdentity bool) error
 				return err
 			}
 		} else {
-			_, err := m.ExecContext(ctx, fmt.Sprintf("%s %s %s;", m.Dialect.TruncateClause(), m.Dialect.QuoteField(table.TableName), restartClause))
+			_, err := m.ExecContext(ctx, fmt.Sprintf("%s %s %s %s;", truncate, table.quotedTableName(), restartClause, cascadeClause))
 			if err != nil {
 				return err
 			}
@@ -463,6 +817,67 @@ func (m *DbMap) truncateTables(ctx context.Context, restartIdentity bool) error
 	return nil
 }
 
+// sortedTables returns the tables of the DbMap ordered so that tables come
+// after the tables their foreign keys reference, keeping registration order
+// where there are no references.  It returns an error if the references form
+// a cycle.  A table referencing itself, or tables not mapped on this DbMap,
+// do not affect the order.
+func (m *DbMap) sortedTables() ([]*TableMap, error) {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[*TableMap]int, len(m.tables))
+	for _, table := range m.tables {
+		state[table] = 0
+	}
+	sorted := make([]*TableMap, 0, len(m.tables))
+	var path []*TableMap
+
+	var visit func(table *TableMap) error
+	visit = func(table *TableMap) error {
+		switch state[table] {
+		case visited:
+			return nil
+		case visiting:
+			var names []string
+			for i := len(path) - 1; i >= 0; i-- {
+				names = append(names, path[i].TableName)
+				if path[i] == table {
+					break
+				}
+			}
+			names = append(names, table.TableName)
+			return fmt.Errorf("modl: foreign key cycle between tables %s", strings.Join(names, " -> "))
+		}
+		state[table] = visiting
+		path = append(path, table)
+		for _, col := range table.Columns {
+			if col.Transient || col.ForeignKey == nil {
+				continue
+			}
+			parent := col.ForeignKey.Table
+			if _, ok := state[parent]; !ok || parent == table {
+				continue
+			}
+			if err := visit(parent); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[table] = visited
+		sorted = append(sorted, table)
+		return nil
+	}
+
+	for _, table := range m.tables {
+		if err := visit(table); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
 func (m *DbMap) handle() handle {
 	return &tracingHandle{h: m.Dbx, d: m}
 }
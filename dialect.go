@@ -1,6 +1,8 @@
 package modl
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"reflect"
@@ -33,11 +35,33 @@ type Dialect interface {
 	// vendor specific table attributes, eg. MySQL engine
 	CreateTableSuffix() string
 
-	// InsertAutoIncr
-	InsertAutoIncr(e SqlExecutor, insertSql string, params ...interface{}) (int64, error)
+	// CreateIndexSql returns a "create index" statement for idx, or "" if
+	// the database does not support the options set on it.
+	CreateIndexSql(idx *IndexMap, ifNotExists bool) string
+
+	// UpdateBatchSql returns a statement which updates n rows of table at
+	// once, as Update does each row, and for each of its bindvars in turn
+	// the index of its value among the values of the rows.  The values of a
+	// row are its key columns, then its other columns except transient ones
+	// and the version column, then its version if the table has a version
+	// column, and the rows' values follow each other.  Rows with a version
+	// are only updated if it is unchanged, and it is incremented.
+	UpdateBatchSql(table *TableMap, n int) (string, []int)
+
+	// InsertAutoIncr runs insertSql and returns the new auto-increment value.
+	// The query must be run with ctx so that cancellation is honored.
+	InsertAutoIncr(ctx context.Context, e SqlExecutor, insertSql string, params ...interface{}) (int64, error)
 	// InsertAutIncrAny takes a destination for non-integer auto-incr, like
 	// uuids which scan to strings, hashes, etc.
-	InsertAutoIncrAny(e SqlExecutor, insertSql string, dest interface{}, params ...interface{}) error
+	InsertAutoIncrAny(ctx context.Context, e SqlExecutor, insertSql string, dest interface{}, params ...interface{}) error
+
+	// InsertAutoIncrBatch runs a multi-row insertSql for n rows and returns the
+	// new auto-increment value of each row, in the order they were inserted.
+	InsertAutoIncrBatch(ctx context.Context, e SqlExecutor, insertSql string, n int, params ...interface{}) ([]int64, error)
+
+	// MaxBindVars returns the maximum number of bindvars allowed in a single
+	// statement.  Batched statements are split to stay under this limit.
+	MaxBindVars() int
 
 	// BindVar returns the variable string to use when forming SQL statements
 	// in many dbs it is "?", but Postgres requires '$#'
@@ -48,28 +72,102 @@ type Dialect interface {
 	// QuoteField returns a quoted version of the field name.
 	QuoteField(field string) string
 
+	// QuotedTableForQuery returns the quoted name of table, qualified with
+	// schema if it is not empty.
+	QuotedTableForQuery(schema, table string) string
+
 	// TruncateClause is a string used to truncate tables.
 	TruncateClause() string
 
 	// RestartIdentityClause returns a string used to reset the identity counter
 	// when truncating tables.  If the string starts with a ';', it is assumed to
 	// be a separate query and is executed separately.
-	RestartIdentityClause(table string) string
+	RestartIdentityClause(schema, table string) string
+
+	// TruncateCascadeClause returns a clause appended to a truncate statement
+	// which also truncates tables referencing the table by foreign key, or ""
+	// if the database cannot truncate that way.
+	TruncateCascadeClause() string
+
+	// TruncateTogether reports whether a truncate statement can list several
+	// tables, which may then be referenced by foreign keys of the others.
+	TruncateTogether() bool
+
+	// UpsertClause returns the clause appended to an insert statement into
+	// table which, when the insert conflicts with an existing row on the
+	// conflict columns, instead sets the update columns of that row to the
+	// inserted values and increments its version column, if not empty.
+	UpsertClause(table string, conflict, update []string, version string) string
+
+	// ReturningClause returns the clause appended to an insert statement
+	// which returns the given columns of the inserted or updated row, or ""
+	// if the database cannot return them from the statement.
+	ReturningClause(columns []string) string
+
+	// CopyInClause returns a statement which bulk loads the given columns of
+	// table from a stream of rows, like postgres' COPY FROM STDIN.  It returns
+	// the empty string if the dialect has no such statement.
+	CopyInClause(schema, table string, columns []string) string
+
+	// LimitClause returns the clause appended to a select statement which
+	// limits it to limit rows after skipping offset rows.  A negative limit
+	// means no limit and a zero offset no offset; if neither is set, it
+	// returns "".
+	LimitClause(limit, offset int) string
+
+	// ForUpdateClause returns the clause appended to a select statement
+	// which locks the rows it reads until the end of the transaction, or ""
+	// if the database has no row locks.
+	ForUpdateClause() string
+
+	// SavepointClause returns the statement which creates the named savepoint
+	// in the current transaction.
+	SavepointClause(name string) string
+
+	// RollbackToSavepointClause returns the statement which rolls back the
+	// current transaction to the named savepoint.
+	RollbackToSavepointClause(name string) string
+
+	// ReleaseSavepointClause returns the statement which releases the named
+	// savepoint, keeping the work done since it was created.
+	ReleaseSavepointClause(name string) string
 
 	// DriverName returns the driver name for a dialect.
 	DriverName() string
+
+	// IsRetryable reports whether err is a transient failure, such as a
+	// serialization failure or deadlock, after which the whole transaction
+	// can safely be run again.
+	IsRetryable(err error) bool
+
+	// InspectTables returns the names of the tables in schema, sorted.  An
+	// empty schema is the connection's default schema.
+	InspectTables(ctx context.Context, e SqlExecutor, schema string) ([]string, error)
+
+	// InspectTable reads the columns, keys and indexes of the named table in
+	// schema from the database's catalog.
+	InspectTable(ctx context.Context, e SqlExecutor, schema, table string) (*TableSchema, error)
+
+	// NormalizeType returns a canonical spelling of the sql type t, so that
+	// aliases such as "int8" and "bigint" compare equal.
+	NormalizeType(t string) string
+
+	// AlterColumnTypeSql returns a statement changing the type of the
+	// existing column col to its mapped type, or "" if the database cannot
+	// change column types.
+	AlterColumnTypeSql(col *ColumnMap) string
 }
 
-func standardInsertAutoIncr(e SqlExecutor, insertSql string, params ...interface{}) (int64, error) {
-	res, err := e.handle().Exec(insertSql, params...)
+func standardInsertAutoIncr(ctx context.Context, e SqlExecutor, insertSql string, params ...interface{}) (int64, error) {
+	res, err := e.handle().ExecContext(ctx, insertSql, params...)
 	if err != nil {
 		return 0, err
 	}
 	return res.LastInsertId()
 }
 
-func standardAutoIncrAny(e SqlExecutor, insertSql string, dest interface{}, params ...interface{}) error {
-	rows, err := e.handle().Queryx(insertSql, params...)
+func standardAutoIncrAny(ctx context.Context, e SqlExecutor, insertSql string, dest interface{}, params ...interface{}) error {
+	rows, err := e.handle().QueryxContext(ctx, insertSql, params...)
 	if err != nil {
 		return err
 	}
@@ -80,6 +178,254 @@ func standardAutoIncrAny(e SqlExecutor, insertSql string, dest interface{}, para
 	return fmt.Errorf("No auto-incr value returned for insert: `%s` error: %s", insertSql, rows.Err())
 }
 
+// onConflictClause implements UpsertClause with the "on conflict do update"
+// syntax shared by postgres and sqlite.
+func onConflictClause(d Dialect, table string, conflict, update []string, version string) string {
+	s := bytes.Buffer{}
+	s.WriteString(" on conflict (")
+	for i, col := range conflict {
+		if i > 0 {
+			s.WriteString(", ")
+		}
+		s.WriteString(d.QuoteField(col))
+	}
+	s.WriteString(")")
+
+	if len(update) == 0 && version == "" {
+		s.WriteString(" do nothing")
+		return s.String()
+	}
+	s.WriteString(" do update set ")
+	for i, col := range update {
+		if i > 0 {
+			s.WriteString(", ")
+		}
+		s.WriteString(fmt.Sprintf("%s=excluded.%s", d.QuoteField(col), d.QuoteField(col)))
+	}
+	if version != "" {
+		if len(update) > 0 {
+			s.WriteString(", ")
+		}
+		s.WriteString(fmt.Sprintf("%s=%s.%s+1", d.QuoteField(version), d.QuoteField(table), d.QuoteField(version)))
+	}
+	return s.String()
+}
+
+// returningClause implements ReturningClause with the "returning" syntax
+// shared by postgres and sqlite.
+func returningClause(d Dialect, columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, col := range columns {
+		quoted[i] = d.QuoteField(col)
+	}
+	return " returning " + strings.Join(quoted, ",")
+}
+
+// quotedTable quotes table, and schema followed by a dot if it is not empty.
+func quotedTable(d Dialect, schema, table string) string {
+	if schema == "" {
+		return d.QuoteField(table)
+	}
+	return d.QuoteField(schema) + "." + d.QuoteField(table)
+}
+
+// keysMatchSql returns a condition matching n rows of table by their primary
+// keys, and their versions if withVersion is true, with bindvars numbered
+// from x.  The values of each row are bound in turn, version last.  A single
+// key column is matched with "in", otherwise each row has its own "or"'ed
+// condition.
+func keysMatchSql(d Dialect, table *TableMap, n, x int, withVersion bool) string {
+	s := bytes.Buffer{}
+	if len(table.Keys) == 1 && !withVersion {
+		s.WriteString(d.QuoteField(table.Keys[0].ColumnName))
+		s.WriteString(" in (")
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				s.WriteString(",")
+			}
+			s.WriteString(d.BindVar(x + i))
+		}
+		s.WriteString(")")
+		return s.String()
+	}
+	cols := table.Keys
+	if withVersion {
+		cols = append(cols[:len(cols):len(cols)], table.version)
+	}
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			s.WriteString(" or ")
+		}
+		s.WriteString("(")
+		for y, col := range cols {
+			if y > 0 {
+				s.WriteString(" and ")
+			}
+			s.WriteString(d.QuoteField(col.ColumnName))
+			s.WriteString("=")
+			s.WriteString(d.BindVar(x))
+			x++
+		}
+		s.WriteString(")")
+	}
+	return s.String()
+}
+
+// updateCaseSql returns an UpdateBatchSql statement which sets each column
+// to a "case" expression choosing the value of the row by its keys.
+func updateCaseSql(d Dialect, table *TableMap, n int) (string, []int) {
+	cols := table.batchUpdateColumns()
+	nk := len(table.Keys)
+	width := nk + len(cols)
+	if table.version != nil {
+		width++
+	}
+
+	var order []int
+	s := bytes.Buffer{}
+	s.WriteString("update ")
+	s.WriteString(table.quotedTableName())
+	s.WriteString(" set ")
+	for c, col := range cols {
+		if c > 0 {
+			s.WriteString(", ")
+		}
+		s.WriteString(d.QuoteField(col.ColumnName))
+		s.WriteString("=case")
+		if nk == 1 {
+			s.WriteString(" ")
+			s.WriteString(d.QuoteField(table.Keys[0].ColumnName))
+		}
+		for r := 0; r < n; r++ {
+			s.WriteString(" when ")
+			for k, key := range table.Keys {
+				if nk > 1 {
+					if k > 0 {
+						s.WriteString(" and ")
+					}
+					s.WriteString(d.QuoteField(key.ColumnName))
+					s.WriteString("=")
+				}
+				s.WriteString(d.BindVar(len(order)))
+				order = append(order, r*width+k)
+			}
+			s.WriteString(" then ")
+			s.WriteString(d.BindVar(len(order)))
+			order = append(order, r*width+nk+c)
+		}
+		s.WriteString(" else ")
+		s.WriteString(d.QuoteField(col.ColumnName))
+		s.WriteString(" end")
+	}
+	if table.version != nil {
+		if len(cols) > 0 {
+			s.WriteString(", ")
+		}
+		v := d.QuoteField(table.version.ColumnName)
+		s.WriteString(v + "=" + v + "+1")
+	}
+	s.WriteString(" where ")
+	s.WriteString(keysMatchSql(d, table, n, len(order), table.version != nil))
+	s.WriteString(";")
+	for r := 0; r < n; r++ {
+		for k := range table.Keys {
+			order = append(order, r*width+k)
+		}
+		if table.version != nil {
+			order = append(order, r*width+width-1)
+		}
+	}
+	return s.String(), order
+}
+
+// createIndexSql returns a "create index" statement for idx.  If methodFirst
+// is true, the index method comes before the column list as Postgres expects,
+// otherwise it comes after as MySQL expects.  If qualifyIndex is true, the
+// schema of the table qualifies the index name rather than the table name,
+// as sqlite expects.
+func createIndexSql(d Dialect, idx *IndexMap, ifNotExists, methodFirst, qualifyIndex bool) string {
+	s := bytes.Buffer{}
+	s.WriteString("create ")
+	if idx.Unique {
+		s.WriteString("unique ")
+	}
+	s.WriteString("index ")
+	if ifNotExists {
+		s.WriteString("if not exists ")
+	}
+	if qualifyIndex {
+		s.WriteString(d.QuotedTableForQuery(idx.table.SchemaName, idx.IndexName))
+		s.WriteString(" on ")
+		s.WriteString(d.QuoteField(idx.table.TableName))
+	} else {
+		s.WriteString(d.QuoteField(idx.IndexName))
+		s.WriteString(" on ")
+		s.WriteString(d.QuotedTableForQuery(idx.table.SchemaName, idx.table.TableName))
+	}
+	if idx.Method != "" && methodFirst {
+		s.WriteString(" using ")
+		s.WriteString(idx.Method)
+	}
+	s.WriteString(" (")
+	for i, col := range idx.Columns {
+		if i > 0 {
+			s.WriteString(", ")
+		}
+		s.WriteString(d.QuoteField(col.ColumnName))
+	}
+	s.WriteString(")")
+	if idx.Method != "" && !methodFirst {
+		s.WriteString(" using ")
+		s.WriteString(idx.Method)
+	}
+	if idx.Where != "" {
+		s.WriteString(" where ")
+		s.WriteString(idx.Where)
+	}
+	s.WriteString(";")
+	return s.String()
+}
+
+// lastInsertIdRange runs a multi-row insertSql and derives the n new ids from
+// LastInsertId, which must be the id of the first row if first is true or
+// of the last row otherwise.  This relies on the ids of rows inserted by a
+// single statement being consecutive.
+func lastInsertIdRange(ctx context.Context, e SqlExecutor, insertSql string, n int, first bool, params ...interface{}) ([]int64, error) {
+	res, err := e.handle().ExecContext(ctx, insertSql, params...)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	if !first {
+		id -= int64(n - 1)
+	}
+	ids := make([]int64, n)
+	for i := range ids {
+		ids[i] = id + int64(i)
+	}
+	return ids, nil
+}
+
+// driverErrorField walks the chain of wrapped errors starting at err and
+// returns the value of the first struct field called name that it finds.
+// modl does not import any database drivers, so their error types are
+// inspected by reflection instead.
+func driverErrorField(err error, name string) (reflect.Value, bool) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		v := reflect.Indirect(reflect.ValueOf(err))
+		if v.Kind() != reflect.Struct {
+			continue
+		}
+		if f := v.FieldByName(name); f.IsValid() {
+			return f, true
+		}
+	}
+	return reflect.Value{}, false
+}
+
 // -- sqlite3
 
 // SqliteDialect implements the Dialect interface for Sqlite3.
@@ -144,18 +490,46 @@ func (d SqliteDialect) CreateTableSuffix() string {
 	return d.suffix
 }
 
+// CreateIndexSql returns a "create index" statement.  Partial indexes are
+// supported since sqlite 3.8.0, index methods are not supported.
+func (d SqliteDialect) CreateIndexSql(idx *IndexMap, ifNotExists bool) string {
+	if idx.Method != "" {
+		return ""
+	}
+	return createIndexSql(d, idx, ifNotExists, false, true)
+}
+
+// UpdateBatchSql returns an update setting each column to a "case"
+// expression which chooses the value of the row by its keys.
+func (d SqliteDialect) UpdateBatchSql(table *TableMap, n int) (string, []int) {
+	return updateCaseSql(d, table, n)
+}
+
 // BindVar returns "?", the simpler of the sqlite bindvars.
 func (d SqliteDialect) BindVar(i int) string {
 	return "?"
 }
 
 // InsertAutoIncr runs the standard
-func (d SqliteDialect) InsertAutoIncr(e SqlExecutor, insertSql string, params ...interface{}) (int64, error) {
-	return standardInsertAutoIncr(e, insertSql, params...)
+func (d SqliteDialect) InsertAutoIncr(ctx context.Context, e SqlExecutor, insertSql string, params ...interface{}) (int64, error) {
+	return standardInsertAutoIncr(ctx, e, insertSql, params...)
 }
 
-func (d SqliteDialect) InsertAutoIncrAny(e SqlExecutor, insertSql string, dest interface{}, params ...interface{}) error {
-	return standardAutoIncrAny(e, insertSql, dest, params...)
+func (d SqliteDialect) InsertAutoIncrAny(ctx context.Context, e SqlExecutor, insertSql string, dest interface{}, params ...interface{}) error {
+	return standardAutoIncrAny(ctx, e, insertSql, dest, params...)
+}
+
+// InsertAutoIncrBatch uses LastInsertId, which sqlite sets to the rowid of the
+// last row inserted.  The write lock held by the statement guarantees the
+// rowids of the batch are consecutive.
+func (d SqliteDialect) InsertAutoIncrBatch(ctx context.Context, e SqlExecutor, insertSql string, n int, params ...interface{}) ([]int64, error) {
+	return lastInsertIdRange(ctx, e, insertSql, n, false, params...)
+}
+
+// MaxBindVars returns 999, the default SQLITE_MAX_VARIABLE_NUMBER for sqlite
+// versions before 3.32.0.
+func (d SqliteDialect) MaxBindVars() int {
+	return 999
 }
 
 // QuoteField quotes f with "" for sqlite
@@ -163,6 +537,12 @@ func (d SqliteDialect) QuoteField(f string) string {
 	return `"` + f + `"`
 }
 
+// QuotedTableForQuery returns the quoted table, prefixed with the quoted schema
+// and a dot if schema is not empty.
+func (d SqliteDialect) QuotedTableForQuery(schema, table string) string {
+	return quotedTable(d, schema, table)
+}
+
 // TruncateClause returns the truncate clause for sqlite.  There is no TRUNCATE
 // statement in sqlite3, but DELETE FROM uses a truncate optimization:
 // http://www.sqlite.org/lang_delete.html
@@ -172,8 +552,78 @@ func (d SqliteDialect) TruncateClause() string {
 
 // RestartIdentityClause restarts the sqlite_sequence for the provided table.
 // It is executed by TruncateTable as a separate query.
-func (d SqliteDialect) RestartIdentityClause(table string) string {
-	return "; DELETE FROM sqlite_sequence WHERE name='" + table + "'"
+func (d SqliteDialect) RestartIdentityClause(schema, table string) string {
+	return "; DELETE FROM " + d.QuotedTableForQuery(schema, "sqlite_sequence") + " WHERE name='" + table + "'"
+}
+
+// TruncateCascadeClause returns "", as sqlite has no cascading truncate.
+func (d SqliteDialect) TruncateCascadeClause() string {
+	return ""
+}
+
+// TruncateTogether returns false, as sqlite truncates with "delete from".
+func (d SqliteDialect) TruncateTogether() bool {
+	return false
+}
+
+// UpsertClause returns an "on conflict do update" clause, supported since
+// sqlite 3.24.0.
+func (d SqliteDialect) UpsertClause(table string, conflict, update []string, version string) string {
+	return onConflictClause(d, table, conflict, update, version)
+}
+
+// ReturningClause returns a "returning" clause, supported since sqlite
+// 3.35.0.
+func (d SqliteDialect) ReturningClause(columns []string) string {
+	return returningClause(d, columns)
+}
+
+// CopyInClause returns "", as sqlite has no bulk load statement.
+func (d SqliteDialect) CopyInClause(schema, table string, columns []string) string {
+	return ""
+}
+
+// LimitClause returns "limit n offset m".  sqlite requires a limit with an
+// offset, for which -1 means no limit.
+func (d SqliteDialect) LimitClause(limit, offset int) string {
+	switch {
+	case offset > 0:
+		return fmt.Sprintf("limit %d offset %d", limit, offset)
+	case limit >= 0:
+		return fmt.Sprintf("limit %d", limit)
+	}
+	return ""
+}
+
+// ForUpdateClause returns "", as sqlite locks the whole database instead of
+// rows.
+func (d SqliteDialect) ForUpdateClause() string {
+	return ""
+}
+
+// SavepointClause returns "savepoint name".
+func (d SqliteDialect) SavepointClause(name string) string {
+	return "savepoint " + d.QuoteField(name)
+}
+
+// RollbackToSavepointClause returns "rollback to savepoint name".
+func (d SqliteDialect) RollbackToSavepointClause(name string) string {
+	return "rollback to savepoint " + d.QuoteField(name)
+}
+
+// ReleaseSavepointClause returns "release savepoint name".
+func (d SqliteDialect) ReleaseSavepointClause(name string) string {
+	return "release savepoint " + d.QuoteField(name)
+}
+
+// IsRetryable returns true for SQLITE_BUSY errors, which are returned when
+// another connection holds a conflicting lock on the database.
+func (d SqliteDialect) IsRetryable(err error) bool {
+	code, ok := driverErrorField(err, "Code")
+	if !ok || code.Kind() != reflect.Int {
+		return false
+	}
+	return code.Int() == 5 // SQLITE_BUSY
 }
 
 // -- PostgreSQL
@@ -253,6 +703,101 @@ func (d PostgresDialect) CreateTableSuffix() string {
 	return d.suffix
 }
 
+// CreateIndexSql returns a "create index" statement, with the index method
+// in a "using" clause before the columns.
+func (d PostgresDialect) CreateIndexSql(idx *IndexMap, ifNotExists bool) string {
+	return createIndexSql(d, idx, ifNotExists, true, false)
+}
+
+// UpdateBatchSql returns an "update ... from (values ...)" statement, which
+// joins the table to the rows' values by their keys.  The values are cast to
+// the columns' types, as Postgres would otherwise take them for text.
+func (d PostgresDialect) UpdateBatchSql(table *TableMap, n int) (string, []int) {
+	cols := append(table.Keys[:len(table.Keys):len(table.Keys)], table.batchUpdateColumns()...)
+	if table.version != nil {
+		cols = append(cols, table.version)
+	}
+	quoted := table.quotedTableName()
+
+	s := bytes.Buffer{}
+	s.WriteString("update ")
+	s.WriteString(quoted)
+	s.WriteString(" set ")
+	x := 0
+	for _, col := range cols[len(table.Keys):] {
+		if x > 0 {
+			s.WriteString(", ")
+		}
+		c := d.QuoteField(col.ColumnName)
+		if col == table.version {
+			s.WriteString(c + "=v." + c + "+1")
+		} else {
+			s.WriteString(c + "=v." + c)
+		}
+		x++
+	}
+	s.WriteString(" from (values ")
+	order := make([]int, 0, n*len(cols))
+	for r := 0; r < n; r++ {
+		if r > 0 {
+			s.WriteString(", ")
+		}
+		s.WriteString("(")
+		for c, col := range cols {
+			if c > 0 {
+				s.WriteString(",")
+			}
+			s.WriteString(d.BindVar(len(order)))
+			s.WriteString("::")
+			s.WriteString(postgresCastType(col.sqlType()))
+			order = append(order, len(order))
+		}
+		s.WriteString(")")
+	}
+	s.WriteString(") as v(")
+	for c, col := range cols {
+		if c > 0 {
+			s.WriteString(",")
+		}
+		s.WriteString(d.QuoteField(col.ColumnName))
+	}
+	s.WriteString(") where ")
+	where := table.Keys
+	if table.version != nil {
+		where = append(where[:len(where):len(where)], table.version)
+	}
+	for k, col := range where {
+		if k > 0 {
+			s.WriteString(" and ")
+		}
+		c := d.QuoteField(col.ColumnName)
+		s.WriteString(quoted + "." + c + "=v." + c)
+	}
+	s.WriteString(";")
+	return s.String(), order
+}
+
+// postgresCastType returns the type to cast values of a column of type t
+// to: serial types are cast to their integer types, and type modifiers are
+// dropped so that values are not silently truncated.
+func postgresCastType(t string) string {
+	t = strings.ToLower(t)
+	if i := strings.Index(t, "("); i >= 0 {
+		if j := strings.Index(t[i:], ")"); j >= 0 {
+			t = strings.TrimSpace(t[:i] + t[i+j+1:])
+		}
+	}
+	switch t {
+	case "smallserial", "serial2":
+		return "smallint"
+	case "serial", "serial4":
+		return "integer"
+	case "bigserial", "serial8":
+		return "bigint"
+	}
+	return t
+}
+
 // BindVar returns "$(i+1)"
 func (d PostgresDialect) BindVar(i int) string {
 	return fmt.Sprintf("$%d", i+1)
@@ -260,8 +805,8 @@ func (d PostgresDialect) BindVar(i int) string {
 
 // InsertAutoIncr inserts via a query and reads the resultant rows for the new
 // auto increment ID, as it's not returned with the result in PostgreSQL.
-func (d PostgresDialect) InsertAutoIncr(e SqlExecutor, insertSql string, params ...interface{}) (int64, error) {
-	rows, err := e.handle().Queryx(insertSql, params...)
+func (d PostgresDialect) InsertAutoIncr(ctx context.Context, e SqlExecutor, insertSql string, params ...interface{}) (int64, error) {
+	rows, err := e.handle().QueryxContext(ctx, insertSql, params...)
 	if err != nil {
 		return 0, err
 	}
@@ -276,8 +821,39 @@ func (d PostgresDialect) InsertAutoIncr(e SqlExecutor, insertSql string, params
 	return 0, errors.New("No serial value returned for insert: " + insertSql + ", error: " + rows.Err().Error())
 }
 
-func (d PostgresDialect) InsertAutoIncrAny(e SqlExecutor, insertSql string, dest interface{}, params ...interface{}) error {
-	return standardAutoIncrAny(e, insertSql, dest, params...)
+func (d PostgresDialect) InsertAutoIncrAny(ctx context.Context, e SqlExecutor, insertSql string, dest interface{}, params ...interface{}) error {
+	return standardAutoIncrAny(ctx, e, insertSql, dest, params...)
+}
+
+// InsertAutoIncrBatch reads the new serial values from the rows returned by
+// the insert's returning clause.
+func (d PostgresDialect) InsertAutoIncrBatch(ctx context.Context, e SqlExecutor, insertSql string, n int, params ...interface{}) ([]int64, error) {
+	rows, err := e.handle().QueryxContext(ctx, insertSql, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0, n)
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) != n {
+		return nil, fmt.Errorf("Expected %d serial values returned for insert, got %d: %s", n, len(ids), insertSql)
+	}
+	return ids, nil
+}
+
+// MaxBindVars returns 65535, the limit of the postgres wire protocol.
+func (d PostgresDialect) MaxBindVars() int {
+	return 65535
 }
 
 // QuoteField quotes f with ""
@@ -285,6 +861,12 @@ func (d PostgresDialect) QuoteField(f string) string {
 	return `"` + sqlx.NameMapper(f) + `"`
 }
 
+// QuotedTableForQuery returns the quoted table, prefixed with the quoted schema
+// and a dot if schema is not empty.
+func (d PostgresDialect) QuotedTableForQuery(schema, table string) string {
+	return quotedTable(d, schema, table)
+}
+
 // TruncateClause returns 'truncate'
 func (d PostgresDialect) TruncateClause() string {
 	return "truncate"
@@ -292,10 +874,91 @@ func (d PostgresDialect) TruncateClause() string {
 
 // RestartIdentityClause returns 'restart identity', which will restart serial
 // sequences for this table at the same time as a truncation is performed.
-func (d PostgresDialect) RestartIdentityClause(table string) string {
+func (d PostgresDialect) RestartIdentityClause(schema, table string) string {
 	return "restart identity"
 }
 
+// TruncateCascadeClause returns 'cascade', which also truncates all tables
+// with foreign keys referencing the truncated table.
+func (d PostgresDialect) TruncateCascadeClause() string {
+	return "cascade"
+}
+
+// TruncateTogether returns true.  A table referenced by a foreign key can
+// only be truncated in the same statement as the tables referencing it.
+func (d PostgresDialect) TruncateTogether() bool {
+	return true
+}
+
+// UpsertClause returns an "on conflict do update" clause.
+func (d PostgresDialect) UpsertClause(table string, conflict, update []string, version string) string {
+	return onConflictClause(d, table, conflict, update, version)
+}
+
+// ReturningClause returns a "returning" clause.
+func (d PostgresDialect) ReturningClause(columns []string) string {
+	return returningClause(d, columns)
+}
+
+// CopyInClause returns "copy table (columns) from stdin".  The statement is
+// recognised by drivers such as lib/pq, which stream each subsequent Exec on
+// the prepared statement as a row.
+func (d PostgresDialect) CopyInClause(schema, table string, columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = d.QuoteField(c)
+	}
+	return fmt.Sprintf("copy %s (%s) from stdin", d.QuotedTableForQuery(schema, table), strings.Join(quoted, ", "))
+}
+
+// LimitClause returns "limit n offset m", either of which may be left out.
+func (d PostgresDialect) LimitClause(limit, offset int) string {
+	var clauses []string
+	if limit >= 0 {
+		clauses = append(clauses, fmt.Sprintf("limit %d", limit))
+	}
+	if offset > 0 {
+		clauses = append(clauses, fmt.Sprintf("offset %d", offset))
+	}
+	return strings.Join(clauses, " ")
+}
+
+// ForUpdateClause returns "for update".
+func (d PostgresDialect) ForUpdateClause() string {
+	return "for update"
+}
+
+// SavepointClause returns "savepoint name".
+func (d PostgresDialect) SavepointClause(name string) string {
+	return "savepoint " + d.QuoteField(name)
+}
+
+// RollbackToSavepointClause returns "rollback to savepoint name".
+func (d PostgresDialect) RollbackToSavepointClause(name string) string {
+	return "rollback to savepoint " + d.QuoteField(name)
+}
+
+// ReleaseSavepointClause returns "release savepoint name".
+func (d PostgresDialect) ReleaseSavepointClause(name string) string {
+	return "release savepoint " + d.QuoteField(name)
+}
+
+// IsRetryable returns true for serialization failures (40001) and detected
+// deadlocks (40P01).
+func (d PostgresDialect) IsRetryable(err error) bool {
+	var state interface {
+		SQLState() string
+	}
+	if !errors.As(err, &state) {
+		return false
+	}
+	switch state.SQLState() {
+	case "40001", "40P01":
+		return true
+	}
+	return false
+}
+
 // -- MySQL
 
 // MySQLDialect is an implementation of Dialect for MySQL databases.
@@ -371,6 +1034,22 @@ func (d MySQLDialect) CreateTableSuffix() string {
 	return fmt.Sprintf(" engine=%s charset=%s", d.Engine, d.Encoding)
 }
 
+// CreateIndexSql returns a "create index" statement, with the index method
+// in a "using" clause after the columns.  MySQL supports neither partial
+// indexes nor "if not exists", which is left out.
+func (d MySQLDialect) CreateIndexSql(idx *IndexMap, ifNotExists bool) string {
+	if idx.Where != "" {
+		return ""
+	}
+	return createIndexSql(d, idx, false, false, false)
+}
+
+// UpdateBatchSql returns an update setting each column to a "case"
+// expression which chooses the value of the row by its keys.
+func (d MySQLDialect) UpdateBatchSql(table *TableMap, n int) (string, []int) {
+	return updateCaseSql(d, table, n)
+}
+
 // BindVar returns "?"
 func (d MySQLDialect) BindVar(i int) string {
 	return "?"
@@ -378,12 +1057,25 @@ func (d MySQLDialect) BindVar(i int) string {
 
 // InsertAutoIncr runs the standard Insert Exec, which uses LastInsertId to get
 // the value of the auto increment column.
-func (d MySQLDialect) InsertAutoIncr(e SqlExecutor, insertSql string, params ...interface{}) (int64, error) {
-	return standardInsertAutoIncr(e, insertSql, params...)
+func (d MySQLDialect) InsertAutoIncr(ctx context.Context, e SqlExecutor, insertSql string, params ...interface{}) (int64, error) {
+	return standardInsertAutoIncr(ctx, e, insertSql, params...)
+}
+
+func (d MySQLDialect) InsertAutoIncrAny(ctx context.Context, e SqlExecutor, insertSql string, dest interface{}, params ...interface{}) error {
+	return standardAutoIncrAny(ctx, e, insertSql, dest, params...)
 }
 
-func (d MySQLDialect) InsertAutoIncrAny(e SqlExecutor, insertSql string, dest interface{}, params ...interface{}) error {
-	return standardAutoIncrAny(e, insertSql, dest, params...)
+// InsertAutoIncrBatch uses LastInsertId, which MySQL sets to the id of the
+// first row inserted.  This assumes auto_increment_increment is 1 and that
+// innodb_autoinc_lock_mode allocates consecutive ids to a simple insert,
+// which is true of all lock modes for multi-row inserts with a known count.
+func (d MySQLDialect) InsertAutoIncrBatch(ctx context.Context, e SqlExecutor, insertSql string, n int, params ...interface{}) ([]int64, error) {
+	return lastInsertIdRange(ctx, e, insertSql, n, true, params...)
+}
+
+// MaxBindVars returns 65535, the placeholder limit for prepared statements.
+func (d MySQLDialect) MaxBindVars() int {
+	return 65535
 }
 
 // QuoteField quotes f using ``.
@@ -391,9 +1083,15 @@ func (d MySQLDialect) QuoteField(f string) string {
 	return "`" + f + "`"
 }
 
-// FIXME: use sqlx's rebind, which was written after it had been created for modl
+// QuotedTableForQuery returns the quoted table, prefixed with the quoted schema
+// and a dot if schema is not empty.
+func (d MySQLDialect) QuotedTableForQuery(schema, table string) string {
+	return quotedTable(d, schema, table)
+}
 
-// ReBind formats the bindvars in the query string (these are '?') for the dialect.
+// ReBind formats the bindvars in the query string (these are '?') for the
+// dialect.  Unlike sqlx's Rebind, it leaves a '?' inside quotes alone, as in
+// a string literal or quoted identifier.
 func ReBind(query string, dialect Dialect) string {
 
 	binder := dialect.BindVar(0)
@@ -401,11 +1099,25 @@ func ReBind(query string, dialect Dialect) string {
 		return query
 	}
 
-	for i, j := 0, strings.Index(query, "?"); j >= 0; i++ {
-		query = strings.Replace(query, "?", dialect.BindVar(i), 1)
-		j = strings.Index(query, "?")
+	s := bytes.Buffer{}
+	var quote rune
+	n := 0
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '?':
+			s.WriteString(dialect.BindVar(n))
+			n++
+			continue
+		}
+		s.WriteRune(r)
 	}
-	return query
+	return s.String()
 }
 
 // TruncateClause returns 'truncate'.
@@ -415,6 +1127,97 @@ func (d MySQLDialect) TruncateClause() string {
 
 // RestartIdentityClause alters the table's AUTO_INCREMENT value after truncation,
 // as MySQL doesn't have an identity clause for the truncate statement.
-func (d MySQLDialect) RestartIdentityClause(table string) string {
-	return "; alter table " + table + " AUTO_INCREMENT = 1"
+func (d MySQLDialect) RestartIdentityClause(schema, table string) string {
+	return "; alter table " + d.QuotedTableForQuery(schema, table) + " AUTO_INCREMENT = 1"
+}
+
+// TruncateCascadeClause returns "", as MySQL has no cascading truncate.
+func (d MySQLDialect) TruncateCascadeClause() string {
+	return ""
+}
+
+// TruncateTogether returns false.  MySQL truncates a single table, and not
+// one referenced by a foreign key of another table.
+func (d MySQLDialect) TruncateTogether() bool {
+	return false
+}
+
+// UpsertClause returns an "on duplicate key update" clause.  MySQL does not
+// take a conflict target; a conflict on any unique key triggers the update.
+func (d MySQLDialect) UpsertClause(table string, conflict, update []string, version string) string {
+	s := bytes.Buffer{}
+	s.WriteString(" on duplicate key update ")
+	for i, col := range update {
+		if i > 0 {
+			s.WriteString(", ")
+		}
+		s.WriteString(fmt.Sprintf("%s=values(%s)", d.QuoteField(col), d.QuoteField(col)))
+	}
+	if version != "" {
+		if len(update) > 0 {
+			s.WriteString(", ")
+		}
+		s.WriteString(fmt.Sprintf("%s=%s+1", d.QuoteField(version), d.QuoteField(version)))
+	}
+	if len(update) == 0 && version == "" {
+		// there is no "do nothing", so assign a conflict column to itself
+		s.WriteString(fmt.Sprintf("%s=%s", d.QuoteField(conflict[0]), d.QuoteField(conflict[0])))
+	}
+	return s.String()
+}
+
+// ReturningClause returns "", as MySQL cannot return rows from an insert.
+func (d MySQLDialect) ReturningClause(columns []string) string {
+	return ""
+}
+
+// CopyInClause returns "".  MySQL's LOAD DATA reads from files rather than
+// a stream of bound rows, so it is not used.
+func (d MySQLDialect) CopyInClause(schema, table string, columns []string) string {
+	return ""
+}
+
+// LimitClause returns "limit n offset m".  MySQL requires a limit with an
+// offset, for which the largest unsigned bigint stands in for no limit.
+func (d MySQLDialect) LimitClause(limit, offset int) string {
+	switch {
+	case offset > 0 && limit < 0:
+		return fmt.Sprintf("limit 18446744073709551615 offset %d", offset)
+	case offset > 0:
+		return fmt.Sprintf("limit %d offset %d", limit, offset)
+	case limit >= 0:
+		return fmt.Sprintf("limit %d", limit)
+	}
+	return ""
+}
+
+// ForUpdateClause returns "for update".
+func (d MySQLDialect) ForUpdateClause() string {
+	return "for update"
+}
+
+// SavepointClause returns "savepoint name".
+func (d MySQLDialect) SavepointClause(name string) string {
+	return "savepoint " + d.QuoteField(name)
+}
+
+// RollbackToSavepointClause returns "rollback to savepoint name".
+func (d MySQLDialect) RollbackToSavepointClause(name string) string {
+	return "rollback to savepoint " + d.QuoteField(name)
+}
+
+// ReleaseSavepointClause returns "release savepoint name".  MySQL does not
+// accept the shorter "release name" form.
+func (d MySQLDialect) ReleaseSavepointClause(name string) string {
+	return "release savepoint " + d.QuoteField(name)
+}
+
+// IsRetryable returns true for deadlocks (error 1213), after which MySQL has
+// already rolled back the transaction.
+func (d MySQLDialect) IsRetryable(err error) bool {
+	num, ok := driverErrorField(err, "Number")
+	if !ok || num.Kind() != reflect.Uint16 {
+		return false
+	}
+	return num.Uint() == 1213 // ER_LOCK_DEADLOCK
 }
@@ -1,20 +1,17 @@
 package modl
 
 import (
+	"context"
 	"database/sql"
 
 	"mindoktor.io/sqlx"
-	"context"
 )
 
 // a cursor is either an sqlx.Db or an sqlx.Tx
+//
+// Only the context aware methods are exposed, so that every query modl runs
+// honors the deadline and cancellation of the caller's context.
 type handle interface {
-	Select(dest interface{}, query string, args ...interface{}) error
-	Get(dest interface{}, query string, args ...interface{}) error
-	Queryx(query string, args ...interface{}) (*sqlx.Rows, error)
-	QueryRowx(query string, args ...interface{}) *sqlx.Row
-	Exec(query string, args ...interface{}) (sql.Result, error)
-
 	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
 	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
 	QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error)
@@ -28,31 +25,6 @@ type tracingHandle struct {
 	h handle
 }
 
-func (t *tracingHandle) Select(dest interface{}, query string, args ...interface{}) error {
-	t.d.trace(query, args...)
-	return t.h.Select(dest, query, args...)
-}
-
-func (t *tracingHandle) Get(dest interface{}, query string, args ...interface{}) error {
-	t.d.trace(query, args...)
-	return t.h.Get(dest, query, args...)
-}
-
-func (t *tracingHandle) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
-	t.d.trace(query, args...)
-	return t.h.Queryx(query, args...)
-}
-
-func (t *tracingHandle) QueryRowx(query string, args ...interface{}) *sqlx.Row {
-	t.d.trace(query, args...)
-	return t.h.QueryRowx(query, args...)
-}
-
-func (t *tracingHandle) Exec(query string, args ...interface{}) (sql.Result, error) {
-	t.d.trace(query, args...)
-	return t.h.Exec(query, args...)
-}
-
 func (t *tracingHandle) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
 	t.d.trace(query, args...)
 	return t.h.SelectContext(ctx, dest, query, args...)
@@ -0,0 +1,463 @@
+// Package migrate applies versioned schema migrations to a database mapped
+// with modl.
+//
+// Migrations are ordered by version and defined either as SQL statements or
+// as Go functions.  Applied versions are recorded in a bookkeeping table,
+// "schema_migrations" by default, which is created through a modl DbMap on
+// first use.  Each migration runs in its own transaction along with its
+// bookkeeping, so a failing migration is rolled back and leaves no record.
+// Note that MySQL commits DDL statements implicitly, so they cannot be rolled
+// back there.
+//
+// While migrating, a Migrator holds a lock row in a second table, so that
+// several instances starting at once do not migrate concurrently; the others
+// wait for the lock and then find nothing left to apply.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"mindoktor.io/modl"
+)
+
+// DefaultTableName is the default name of the bookkeeping table.
+const DefaultTableName = "schema_migrations"
+
+// Migration is a single versioned schema change.  Up and Down are Go
+// functions run in the migration's transaction; if Up is nil, the UpSQL
+// statements are executed instead, and likewise for Down.  A migration
+// without a down step cannot be rolled back.
+type Migration struct {
+	Version int64
+	Name    string
+	UpSQL   []string
+	DownSQL []string
+	Up      func(ctx context.Context, tx *modl.Transaction) error
+	Down    func(ctx context.Context, tx *modl.Transaction) error
+}
+
+func (mig Migration) String() string {
+	return fmt.Sprintf("%d %s", mig.Version, mig.Name)
+}
+
+// SchemaMigration is the bookkeeping row of an applied migration.
+type SchemaMigration struct {
+	Version   int64
+	Name      string
+	AppliedAt time.Time
+}
+
+// schemaLock is the row held in the lock table while migrating.
+type schemaLock struct {
+	ID       int64
+	LockedAt time.Time
+}
+
+// A Migrator applies and rolls back a set of migrations on a DbMap.
+type Migrator struct {
+	// TableName is the name of the bookkeeping table; the lock table is
+	// named after it with a "_lock" suffix.  It defaults to
+	// DefaultTableName, and must be set before the first use.  The
+	// SchemaName and TablePrefix of the DbMap apply to both tables.  Tables
+	// under other names, prefixed or not, must be passed to
+	// DbMap.DropUnmappedTablesSql, which keeps only the default ones in
+	// modl.KeptTables.
+	TableName string
+
+	// LockRetry is how often a Migrator waiting for the lock retries.
+	LockRetry time.Duration
+
+	dbmap      *modl.DbMap
+	migrations []Migration
+	dryRun     io.Writer
+	bookkeep   *modl.DbMap
+}
+
+// New returns a Migrator for the given migrations, which need not be sorted.
+func New(dbmap *modl.DbMap, migrations ...Migration) *Migrator {
+	migs := make([]Migration, len(migrations))
+	copy(migs, migrations)
+	sort.SliceStable(migs, func(i, j int) bool { return migs[i].Version < migs[j].Version })
+	return &Migrator{
+		TableName:  DefaultTableName,
+		LockRetry:  100 * time.Millisecond,
+		dbmap:      dbmap,
+		migrations: migs,
+	}
+}
+
+// SetDryRun makes the Migrator write the SQL it would run to w instead of
+// running it.  Go migrations are listed by name, as their SQL is unknown.
+// Dry runs do not create the bookkeeping tables or take the lock.  Call with
+// nil to turn dry runs off.
+func (m *Migrator) SetDryRun(w io.Writer) *Migrator {
+	m.dryRun = w
+	return m
+}
+
+// Up applies all pending migrations in order.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.UpTo(ctx, -1)
+}
+
+// UpTo applies the pending migrations up to and including version.  A
+// negative version applies all of them.
+func (m *Migrator) UpTo(ctx context.Context, version int64) error {
+	return m.run(ctx, func(applied map[int64]bool) ([]Migration, error) {
+		var pending []Migration
+		for _, mig := range m.migrations {
+			if !applied[mig.Version] && (version < 0 || mig.Version <= version) {
+				pending = append(pending, mig)
+			}
+		}
+		return pending, nil
+	}, true)
+}
+
+// Down rolls back the most recently applied migration.
+func (m *Migrator) Down(ctx context.Context) error {
+	return m.run(ctx, func(applied map[int64]bool) ([]Migration, error) {
+		migs, err := m.appliedMigrations(applied, -1)
+		if len(migs) > 1 {
+			migs = migs[:1]
+		}
+		return migs, err
+	}, false)
+}
+
+// DownTo rolls back, newest first, all applied migrations with a version
+// greater than version.
+func (m *Migrator) DownTo(ctx context.Context, version int64) error {
+	return m.run(ctx, func(applied map[int64]bool) ([]Migration, error) {
+		return m.appliedMigrations(applied, version)
+	}, false)
+}
+
+// Applied returns the bookkeeping rows of the applied migrations, ordered
+// by version.
+func (m *Migrator) Applied(ctx context.Context) ([]SchemaMigration, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	if err := m.bookkeeper().CreateTablesIfNotExists(ctx); err != nil {
+		return nil, err
+	}
+	return m.applied(ctx)
+}
+
+// Pending returns the migrations which have not been applied yet.
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	rows, err := m.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	applied := versions(rows)
+	var pending []Migration
+	for _, mig := range m.migrations {
+		if !applied[mig.Version] {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, nil
+}
+
+// appliedMigrations returns the applied migrations newer than version, newest
+// first.  It returns an error if an applied version has no migration.
+func (m *Migrator) appliedMigrations(applied map[int64]bool, version int64) ([]Migration, error) {
+	byVersion := make(map[int64]Migration, len(m.migrations))
+	for _, mig := range m.migrations {
+		byVersion[mig.Version] = mig
+	}
+	var migs []Migration
+	for v := range applied {
+		if v <= version {
+			continue
+		}
+		mig, ok := byVersion[v]
+		if !ok {
+			return nil, fmt.Errorf("migrate: applied version %d has no migration", v)
+		}
+		migs = append(migs, mig)
+	}
+	sort.Slice(migs, func(i, j int) bool { return migs[i].Version > migs[j].Version })
+	return migs, nil
+}
+
+// run selects migrations with choose from the applied versions, and applies
+// them up or down, holding the lock unless this is a dry run.
+func (m *Migrator) run(ctx context.Context, choose func(map[int64]bool) ([]Migration, error), up bool) (err error) {
+	if err := m.validate(); err != nil {
+		return err
+	}
+	if m.dryRun != nil {
+		return m.dryRunMigrations(ctx, choose, up)
+	}
+
+	if err := m.bookkeeper().CreateTablesIfNotExists(ctx); err != nil {
+		return err
+	}
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		// a lock left behind blocks every later migration, so report it
+		if uerr := m.unlock(); uerr != nil && err == nil {
+			err = fmt.Errorf("migrate: releasing lock: %w", uerr)
+		}
+	}()
+
+	rows, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	migs, err := choose(versions(rows))
+	if err != nil {
+		return err
+	}
+	for _, mig := range migs {
+		if err := m.apply(ctx, mig, up); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply runs a single migration and its bookkeeping in a transaction.
+func (m *Migrator) apply(ctx context.Context, mig Migration, up bool) error {
+	fn, stmts, record := mig.Up, mig.UpSQL, m.insertSql()
+	if !up {
+		fn, stmts, record = mig.Down, mig.DownSQL, m.deleteSql()
+		if fn == nil && len(stmts) == 0 {
+			return fmt.Errorf("migrate: migration %s cannot be rolled back", mig)
+		}
+	}
+
+	tx, err := m.dbmap.BeginContext(ctx)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		if fn != nil {
+			if err := fn(ctx, tx); err != nil {
+				return err
+			}
+		} else {
+			for _, stmt := range stmts {
+				if _, err := tx.ExecContext(ctx, stmt); err != nil {
+					return err
+				}
+			}
+		}
+		if up {
+			_, err := tx.ExecContext(ctx, record, mig.Version, mig.Name, time.Now().UTC())
+			return err
+		}
+		_, err := tx.ExecContext(ctx, record, mig.Version)
+		return err
+	}()
+	if err != nil {
+		tx.Rollback()
+		direction := "up"
+		if !up {
+			direction = "down"
+		}
+		return fmt.Errorf("migrate: migration %s %s: %w", mig, direction, err)
+	}
+	return tx.Commit()
+}
+
+func (m *Migrator) dryRunMigrations(ctx context.Context, choose func(map[int64]bool) ([]Migration, error), up bool) error {
+	w := m.dryRun
+	sqls, err := m.bookkeeper().CreateTablesIfNotExistsSql(ctx)
+	if err != nil {
+		return err
+	}
+	for _, i := range []interface{}{SchemaMigration{}, schemaLock{}} {
+		fmt.Fprintln(w, sqls[m.bookkeeper().TableFor(i).TableName])
+	}
+
+	// the bookkeeping table may not exist yet, in which case nothing has
+	// been applied
+	exists, err := m.tableExists(ctx)
+	if err != nil {
+		return err
+	}
+	var rows []SchemaMigration
+	if exists {
+		if rows, err = m.applied(ctx); err != nil {
+			return err
+		}
+	}
+	migs, err := choose(versions(rows))
+	if err != nil {
+		return err
+	}
+	for _, mig := range migs {
+		fn, stmts, record := mig.Up, mig.UpSQL, m.insertSql()
+		if !up {
+			fn, stmts, record = mig.Down, mig.DownSQL, m.deleteSql()
+		}
+		fmt.Fprintf(w, "-- migration %s\n", mig)
+		if fn != nil {
+			fmt.Fprintln(w, "-- (go function)")
+		} else {
+			for _, stmt := range stmts {
+				fmt.Fprintln(w, strings.TrimRight(strings.TrimSpace(stmt), ";")+";")
+			}
+		}
+		fmt.Fprintf(w, "%s -- version %d\n", record, mig.Version)
+	}
+	return nil
+}
+
+func (m *Migrator) validate() error {
+	seen := make(map[int64]bool, len(m.migrations))
+	for _, mig := range m.migrations {
+		if mig.Version < 0 {
+			return fmt.Errorf("migrate: migration %s has a negative version", mig)
+		}
+		if seen[mig.Version] {
+			return fmt.Errorf("migrate: duplicate migration version %d", mig.Version)
+		}
+		if mig.Up == nil && len(mig.UpSQL) == 0 {
+			return fmt.Errorf("migrate: migration %s has no up step", mig)
+		}
+		seen[mig.Version] = true
+	}
+	return nil
+}
+
+// bookkeeper returns a DbMap on the same database with only the bookkeeping
+// tables mapped, so that they are created apart from the application's, in
+// the same schema and with the same prefix.
+func (m *Migrator) bookkeeper() *modl.DbMap {
+	if m.bookkeep == nil {
+		bk := modl.NewDbMap(m.dbmap.Db, m.dbmap.Dialect)
+		bk.SchemaName = m.dbmap.SchemaName
+		bk.TablePrefix = m.dbmap.TablePrefix
+		bk.AddTableWithName(SchemaMigration{}, m.TableName).SetKeys(false, "Version")
+		bk.AddTableWithName(schemaLock{}, m.lockTableName()).SetKeys(false, "ID")
+		m.bookkeep = bk
+	}
+	return m.bookkeep
+}
+
+func (m *Migrator) lockTableName() string {
+	return m.TableName + "_lock"
+}
+
+func (m *Migrator) applied(ctx context.Context) ([]SchemaMigration, error) {
+	var rows []SchemaMigration
+	d := m.dbmap.Dialect
+	err := m.bookkeeper().SelectContext(ctx, &rows, fmt.Sprintf("select * from %s order by %s",
+		m.quotedTableName(), d.QuoteField(m.column(SchemaMigration{}, "Version"))))
+	return rows, err
+}
+
+// tableExists reports whether the bookkeeping table has been created.
+func (m *Migrator) tableExists(ctx context.Context) (bool, error) {
+	bk := m.bookkeeper()
+	t := bk.TableFor(SchemaMigration{})
+	names, err := bk.Dialect.InspectTables(ctx, bk, t.SchemaName)
+	if err != nil {
+		return false, err
+	}
+	for _, n := range names {
+		if n == t.TableName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// lock inserts the lock row, waiting while another Migrator holds it.
+func (m *Migrator) lock(ctx context.Context) error {
+	bk := m.bookkeeper()
+	retried := false
+	for {
+		err := bk.InsertContext(ctx, &schemaLock{ID: 1, LockedAt: time.Now().UTC()})
+		if err == nil {
+			return nil
+		}
+		// only wait if the insert failed because the lock is held
+		held := &schemaLock{}
+		if gerr := bk.GetContext(ctx, held, 1); gerr != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("migrate: waiting for lock: %w", ctx.Err())
+			}
+			// the lock was released since the insert, so try again at
+			// once, but only once if the insert failed for another reason
+			if errors.Is(gerr, sql.ErrNoRows) && !retried {
+				retried = true
+				continue
+			}
+			return err
+		}
+		retried = false
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("migrate: waiting for lock held since %s: %w", held.LockedAt, ctx.Err())
+		case <-time.After(m.LockRetry):
+		}
+	}
+}
+
+func (m *Migrator) unlock() error {
+	// release the lock even if the migration's context was cancelled
+	_, err := m.bookkeeper().DeleteContext(context.Background(), &schemaLock{ID: 1})
+	return err
+}
+
+// Unlock removes a lock left behind by a Migrator which did not finish, for
+// example because its process was killed.
+func (m *Migrator) Unlock(ctx context.Context) error {
+	if err := m.bookkeeper().CreateTablesIfNotExists(ctx); err != nil {
+		return err
+	}
+	_, err := m.bookkeeper().DeleteContext(ctx, &schemaLock{ID: 1})
+	return err
+}
+
+func (m *Migrator) insertSql() string {
+	d := m.dbmap.Dialect
+	return fmt.Sprintf("insert into %s (%s, %s, %s) values (%s, %s, %s);",
+		m.quotedTableName(),
+		d.QuoteField(m.column(SchemaMigration{}, "Version")),
+		d.QuoteField(m.column(SchemaMigration{}, "Name")),
+		d.QuoteField(m.column(SchemaMigration{}, "AppliedAt")),
+		d.BindVar(0), d.BindVar(1), d.BindVar(2))
+}
+
+func (m *Migrator) deleteSql() string {
+	d := m.dbmap.Dialect
+	return fmt.Sprintf("delete from %s where %s=%s;",
+		m.quotedTableName(),
+		d.QuoteField(m.column(SchemaMigration{}, "Version")),
+		d.BindVar(0))
+}
+
+// quotedTableName returns the quoted name of the bookkeeping table, qualified
+// by its schema.
+func (m *Migrator) quotedTableName() string {
+	t := m.bookkeeper().TableFor(SchemaMigration{})
+	return m.dbmap.Dialect.QuotedTableForQuery(t.SchemaName, t.TableName)
+}
+
+func (m *Migrator) column(i interface{}, field string) string {
+	return m.bookkeeper().TableFor(i).ColMap(field).ColumnName
+}
+
+func versions(rows []SchemaMigration) map[int64]bool {
+	applied := make(map[int64]bool, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = true
+	}
+	return applied
+}
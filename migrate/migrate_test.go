@@ -0,0 +1,336 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"mindoktor.io/modl"
+)
+
+func newDbMap(t *testing.T) *modl.DbMap {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "migrate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return modl.NewDbMap(db, modl.SqliteDialect{})
+}
+
+var testMigrations = []Migration{
+	{
+		Version: 2,
+		Name:    "add email",
+		UpSQL:   []string{"alter table person add column email text"},
+		DownSQL: []string{"create table person2 (id integer primary key, name text)",
+			"insert into person2 select id, name from person",
+			"drop table person",
+			"alter table person2 rename to person"},
+	},
+	{
+		Version: 1,
+		Name:    "create person",
+		UpSQL:   []string{"create table person (id integer primary key, name text)"},
+		DownSQL: []string{"drop table person"},
+	},
+	{
+		Version: 3,
+		Name:    "seed",
+		Up: func(ctx context.Context, tx *modl.Transaction) error {
+			_, err := tx.ExecContext(ctx, "insert into person (name, email) values ('bob', 'bob@example.com')")
+			return err
+		},
+		Down: func(ctx context.Context, tx *modl.Transaction) error {
+			_, err := tx.ExecContext(ctx, "delete from person")
+			return err
+		},
+	},
+}
+
+func appliedVersions(t *testing.T, m *Migrator) []int64 {
+	rows, err := m.Applied(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vs []int64
+	for _, row := range rows {
+		vs = append(vs, row.Version)
+	}
+	return vs
+}
+
+func TestUpDown(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap(t)
+	m := New(dbmap, testMigrations...)
+
+	if err := m.UpTo(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if vs := appliedVersions(t, m); len(vs) != 2 || vs[0] != 1 || vs[1] != 2 {
+		t.Errorf("Expected versions 1 and 2 to be applied, got %v", vs)
+	}
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := dbmap.Dbx.Get(&count, "select count(*) from person where email is not null"); err != nil || count != 1 {
+		t.Errorf("Expected the seed migration to run, got %d, %v", count, err)
+	}
+	// applying again is a no-op
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := m.Pending(ctx)
+	if err != nil || len(pending) != 0 {
+		t.Errorf("Expected no pending migrations, got %v, %v", pending, err)
+	}
+
+	if err := m.Down(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if vs := appliedVersions(t, m); len(vs) != 2 {
+		t.Errorf("Expected one migration to be rolled back, got %v", vs)
+	}
+	if err := m.DownTo(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if vs := appliedVersions(t, m); len(vs) != 0 {
+		t.Errorf("Expected all migrations to be rolled back, got %v", vs)
+	}
+	if err := dbmap.Dbx.Get(&count, "select count(*) from person"); err == nil {
+		t.Errorf("Expected the person table to be dropped")
+	}
+}
+
+func TestFailedMigration(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap(t)
+	boom := errors.New("boom")
+	m := New(dbmap, testMigrations[1], Migration{
+		Version: 2,
+		Name:    "fails",
+		Up: func(ctx context.Context, tx *modl.Transaction) error {
+			if _, err := tx.ExecContext(ctx, "insert into person (name) values ('bob')"); err != nil {
+				return err
+			}
+			return boom
+		},
+	})
+
+	err := m.Up(ctx)
+	if !errors.Is(err, boom) {
+		t.Fatalf("Expected the migration's error, got %v", err)
+	}
+	if vs := appliedVersions(t, m); len(vs) != 1 || vs[0] != 1 {
+		t.Errorf("Expected only version 1 to be applied, got %v", vs)
+	}
+	var count int
+	if err := dbmap.Dbx.Get(&count, "select count(*) from person"); err != nil || count != 0 {
+		t.Errorf("Expected the failed migration to be rolled back, got %d, %v", count, err)
+	}
+
+	// the lock was released, and version 2 has no down step
+	if err := m.DownTo(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	m = New(dbmap, testMigrations[1], Migration{Version: 2, UpSQL: []string{"select 1"}})
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Down(ctx); err == nil || !strings.Contains(err.Error(), "cannot be rolled back") {
+		t.Errorf("Expected an error for a migration without a down step, got %v", err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap(t)
+	out := &bytes.Buffer{}
+	m := New(dbmap, testMigrations...).SetDryRun(out)
+
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`create table if not exists "schema_migrations"`,
+		"-- migration 1 create person\ncreate table person (id integer primary key, name text);\n",
+		"-- migration 3 seed\n-- (go function)\n",
+		`insert into "schema_migrations"`,
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in dry run output:\n%s", expected, out)
+		}
+	}
+	var count int
+	if err := dbmap.Dbx.Get(&count, "select count(*) from sqlite_master"); err != nil || count != 0 {
+		t.Errorf("Expected dry run to leave the database empty, got %d tables, %v", count, err)
+	}
+
+	// only a missing bookkeeping table means nothing has been applied
+	dbmap.Dbx.MustExec("create table schema_migrations (other text)")
+	if err := m.Up(ctx); err == nil {
+		t.Errorf("Expected an error reading an unreadable bookkeeping table")
+	}
+}
+
+func TestLock(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap(t)
+	m := New(dbmap, testMigrations...)
+	m.LockRetry = time.Millisecond
+
+	// hold the lock as another instance would
+	if err := m.bookkeeper().CreateTablesIfNotExists(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	waiting, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := m.Up(waiting); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected to time out waiting for the lock, got %v", err)
+	}
+	if vs := appliedVersions(t, m); len(vs) != 0 {
+		t.Errorf("Expected nothing to be applied while locked, got %v", vs)
+	}
+
+	done := make(chan error)
+	go func() { done <- New(dbmap, testMigrations...).Up(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	if err := m.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if vs := appliedVersions(t, m); len(vs) != 3 {
+		t.Errorf("Expected all migrations to be applied after unlocking, got %v", vs)
+	}
+}
+
+func TestLockReleasedWhileChecking(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap(t)
+	m := New(dbmap, testMigrations...)
+	if err := m.bookkeeper().CreateTablesIfNotExists(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// fail the first insert of the lock row as if it were held, and leave
+	// no row behind, as if the lock were released before it was read
+	for _, stmt := range []string{
+		"create table lock_failures (n integer)",
+		"insert into lock_failures values (0)",
+		`create trigger fail_lock before insert on schema_migrations_lock
+			when (select n from lock_failures) = 0
+			begin update lock_failures set n = 1; select raise(fail, 'lock held'); end`,
+	} {
+		if _, err := dbmap.ExecContext(ctx, stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Up(ctx); err != nil {
+		t.Fatalf("Expected the lock to be taken on the retry, got %v", err)
+	}
+	if vs := appliedVersions(t, m); len(vs) != 3 {
+		t.Errorf("Expected all migrations to be applied, got %v", vs)
+	}
+}
+
+func TestUnlockError(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap(t)
+	m := New(dbmap, Migration{
+		Version: 1,
+		Name:    "drop lock",
+		UpSQL:   []string{"drop table schema_migrations_lock"},
+	})
+	if err := m.Up(ctx); err == nil || !strings.Contains(err.Error(), "releasing lock") {
+		t.Errorf("Expected an error releasing the lock, got %v", err)
+	}
+}
+
+func TestPrefixedTables(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap(t)
+	dbmap.SchemaName = "main"
+	dbmap.TablePrefix = "app_"
+	m := New(dbmap, testMigrations...)
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if vs := appliedVersions(t, m); len(vs) != 3 {
+		t.Errorf("Expected all migrations to be applied, got %v", vs)
+	}
+	var names []string
+	if err := dbmap.Dbx.Select(&names, "select name from sqlite_master where type = 'table' order by name"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"app_schema_migrations", "app_schema_migrations_lock", "person"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected tables %v, got %v", expected, names)
+	}
+
+	out := &bytes.Buffer{}
+	if err := New(dbmap, testMigrations...).SetDryRun(out).DownTo(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`create table if not exists "main"."app_schema_migrations_lock"`,
+		`delete from "main"."app_schema_migrations"`,
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in dry run output:\n%s", expected, out)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap(t)
+	m := New(dbmap, testMigrations[0], testMigrations[0])
+	if err := m.Up(ctx); err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Errorf("Expected a duplicate version error, got %v", err)
+	}
+	m = New(dbmap, Migration{Version: 1, Name: "empty"})
+	if err := m.Up(ctx); err == nil {
+		t.Errorf("Expected an error for a migration without an up step")
+	}
+}
+
+type person struct {
+	ID    int64
+	Name  string
+	Email string
+}
+
+func TestMappedDbMap(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap(t)
+	if err := New(dbmap, testMigrations...).Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	dbmap.AddTable(person{}).SetKeys(true, "ID")
+
+	changes, err := dbmap.AlterTablesSql(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drops, err := dbmap.DropUnmappedTablesSql(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range append(changes, drops...) {
+		if strings.HasPrefix(c.Table, DefaultTableName) {
+			t.Errorf("Unexpected change to the bookkeeping tables %+v", c)
+		}
+	}
+}
@@ -10,10 +10,12 @@ package modl
 // https://github.com/jmoiron/modl
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
 	"reflect"
-	"context"
+	"strings"
 )
 
 // NoKeysErr is a special error type returned when modl's CRUD helpers are
@@ -27,7 +29,8 @@ func (n NoKeysErr) Error() string {
 	return fmt.Sprintf("Could not find keys for table %v", n.Table)
 }
 
-const versFieldConst = "[modl_ver_field]"
+// versFieldConst stands in for the incremented version in a plan's argFields.
+var versFieldConst = &ColumnMap{ColumnName: "[modl_ver_field]"}
 
 // OptimisticLockError is returned by Update() or Delete() if the
 // struct being modified has a Version field and the value is not equal to
@@ -59,20 +62,35 @@ func (e OptimisticLockError) Error() string {
 	return fmt.Sprintf("OptimisticLockError no row found for table=%s keys=%v", e.TableName, e.Keys)
 }
 
+// OptimisticLockErrors is returned by DeleteBatch() or UpdateBatch() if
+// the Version of one or more of the structs is not equal to the current
+// value in the database, with an error for each of those rows.
+type OptimisticLockErrors []OptimisticLockError
+
+// Error returns a description of the first lock error and how many there are
+func (e OptimisticLockErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more)", e[0].Error(), len(e)-1)
+}
+
 // A bindPlan saves a query type (insert, get, updated, delete) so it doesn't
 // have to be re-created every time it's executed.
 type bindPlan struct {
 	query       string
-	argFields   []string
-	keyFields   []string
-	versField   string
-	autoIncrIdx int
+	argFields   []*ColumnMap
+	keyFields   []*ColumnMap
+	versField   *ColumnMap
+	autoIncrCol *ColumnMap
+	returning   []*ColumnMap
 }
 
 func (plan bindPlan) createBindInstance(elem reflect.Value) bindInstance {
-	bi := bindInstance{query: plan.query, autoIncrIdx: plan.autoIncrIdx, versField: plan.versField}
-	if plan.versField != "" {
-		bi.existingVersion = elem.FieldByName(plan.versField).Int()
+	bi := bindInstance{query: plan.query, autoIncrCol: plan.autoIncrCol, versField: plan.versField,
+		returning: plan.returning}
+	if plan.versField != nil {
+		bi.existingVersion = fieldByIndex(elem, plan.versField.fieldIndex).Int()
 	}
 
 	for i := 0; i < len(plan.argFields); i++ {
@@ -81,17 +99,17 @@ func (plan bindPlan) createBindInstance(elem reflect.Value) bindInstance {
 			newVer := bi.existingVersion + 1
 			bi.args = append(bi.args, newVer)
 			if bi.existingVersion == 0 {
-				elem.FieldByName(plan.versField).SetInt(int64(newVer))
+				fieldByIndex(elem, plan.versField.fieldIndex).SetInt(int64(newVer))
 			}
 		} else {
-			val := elem.FieldByName(k).Interface()
+			val := fieldByIndex(elem, k.fieldIndex).Interface()
 			bi.args = append(bi.args, val)
 		}
 	}
 
 	for i := 0; i < len(plan.keyFields); i++ {
 		k := plan.keyFields[i]
-		val := elem.FieldByName(k).Interface()
+		val := fieldByIndex(elem, k.fieldIndex).Interface()
 		bi.keys = append(bi.keys, val)
 	}
 
@@ -103,8 +121,10 @@ type bindInstance struct {
 	args            []interface{}
 	keys            []interface{}
 	existingVersion int64
-	versField       string
-	autoIncrIdx     int
+	versField       *ColumnMap
+	autoIncrCol     *ColumnMap
+	// the columns returned by the statement
+	returning []*ColumnMap
 }
 
 // SqlExecutor exposes modl operations that can be run from Pre/Post
@@ -115,12 +135,31 @@ type bindInstance struct {
 // information.
 type SqlExecutor interface {
 	GetContext(ctx context.Context, dest interface{}, keys ...interface{}) error
+	GetManyContext(ctx context.Context, dest interface{}, keys interface{}) ([]interface{}, error)
 	InsertContext(ctx context.Context, list ...interface{}) error
+	InsertBatchContext(ctx context.Context, list ...interface{}) error
+	UpsertContext(ctx context.Context, list ...interface{}) error
 	UpdateContext(ctx context.Context, list ...interface{}) (int64, error)
+	UpdateColumnsContext(ctx context.Context, ptr interface{}, fields ...string) (int64, error)
 	DeleteContext(ctx context.Context, list ...interface{}) (int64, error)
+	UpdateBatchContext(ctx context.Context, list ...interface{}) (int64, error)
+	DeleteBatchContext(ctx context.Context, list ...interface{}) (int64, error)
+	UpdateWhere(ctx context.Context, i interface{}, set map[string]interface{}, where string, args ...interface{}) (int64, error)
+	UpdateWhereVersioned(ctx context.Context, i interface{}, set map[string]interface{}, where string, args ...interface{}) (int64, error)
+	DeleteWhere(ctx context.Context, i interface{}, where string, args ...interface{}) (int64, error)
 	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
 	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
 	SelectOneContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	SelectIntContext(ctx context.Context, query string, args ...interface{}) (int64, error)
+	SelectNullIntContext(ctx context.Context, query string, args ...interface{}) (sql.NullInt64, error)
+	SelectFloatContext(ctx context.Context, query string, args ...interface{}) (float64, error)
+	SelectNullFloatContext(ctx context.Context, query string, args ...interface{}) (sql.NullFloat64, error)
+	SelectStrContext(ctx context.Context, query string, args ...interface{}) (string, error)
+	SelectNullStrContext(ctx context.Context, query string, args ...interface{}) (sql.NullString, error)
+
+	// TxOptions returns the options of the enclosing transaction, or nil if
+	// the operation is not running in a transaction.
+	TxOptions() *sql.TxOptions
 
 	handle() handle
 }
@@ -142,6 +181,10 @@ func hookedget(ctx context.Context, m *DbMap, e SqlExecutor, dest interface{}, q
 
 	table := m.TableFor(dest)
 
+	if table != nil {
+		table.takeSnapshot(reflect.Indirect(reflect.ValueOf(dest)))
+	}
+
 	if table != nil && table.CanPostGet {
 		err = dest.(PostGetter).PostGet(ctx, e)
 		if err != nil {
@@ -161,16 +204,27 @@ func hookedselect(ctx context.Context, m *DbMap, e SqlExecutor, dest interface{}
 	// select can use arbitrary structs for join queries, so we needn't find a table
 	table := m.TableFor(dest)
 
+	if table != nil && table.snapshot != nil {
+		v := reflect.Indirect(reflect.ValueOf(dest))
+		for i := 0; i < v.Len(); i++ {
+			table.takeSnapshot(reflect.Indirect(v.Index(i)))
+		}
+	}
+
 	if table != nil && table.CanPostGet {
-		var x interface{}
 		v := reflect.ValueOf(dest)
 		if v.Kind() == reflect.Ptr {
 			v = reflect.Indirect(v)
 		}
 		l := v.Len()
 		for i := 0; i < l; i++ {
-			x = v.Index(i).Interface()
-			err = x.(PostGetter).PostGet(ctx, e)
+			// the hook is implemented on the pointer, so take the address
+			// of elements of a slice of structs
+			x := v.Index(i)
+			if x.Kind() != reflect.Ptr {
+				x = x.Addr()
+			}
+			err = x.Interface().(PostGetter).PostGet(ctx, e)
 			if err != nil {
 				return err
 			}
@@ -180,6 +234,88 @@ func hookedselect(ctx context.Context, m *DbMap, e SqlExecutor, dest interface{}
 	return nil
 }
 
+// selectVal scans the single column of the first row of query into dest.
+// It returns sql.ErrNoRows if there are no rows.
+func selectVal(ctx context.Context, e SqlExecutor, dest interface{}, query string, args ...interface{}) error {
+	rows, err := e.handle().QueryxContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if len(cols) != 1 {
+		return fmt.Errorf("modl: expected a single column from query, got %d (%s)", len(cols), strings.Join(cols, ", "))
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	if err := rows.Scan(dest); err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+func selectInt(ctx context.Context, e SqlExecutor, query string, args ...interface{}) (int64, error) {
+	var v int64
+	err := selectVal(ctx, e, &v, query, args...)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	return v, nil
+}
+
+func selectNullInt(ctx context.Context, e SqlExecutor, query string, args ...interface{}) (sql.NullInt64, error) {
+	var v sql.NullInt64
+	err := selectVal(ctx, e, &v, query, args...)
+	if err != nil && err != sql.ErrNoRows {
+		return v, err
+	}
+	return v, nil
+}
+
+func selectFloat(ctx context.Context, e SqlExecutor, query string, args ...interface{}) (float64, error) {
+	var v float64
+	err := selectVal(ctx, e, &v, query, args...)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	return v, nil
+}
+
+func selectNullFloat(ctx context.Context, e SqlExecutor, query string, args ...interface{}) (sql.NullFloat64, error) {
+	var v sql.NullFloat64
+	err := selectVal(ctx, e, &v, query, args...)
+	if err != nil && err != sql.ErrNoRows {
+		return v, err
+	}
+	return v, nil
+}
+
+func selectStr(ctx context.Context, e SqlExecutor, query string, args ...interface{}) (string, error) {
+	var v string
+	err := selectVal(ctx, e, &v, query, args...)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	return v, nil
+}
+
+func selectNullStr(ctx context.Context, e SqlExecutor, query string, args ...interface{}) (sql.NullString, error) {
+	var v sql.NullString
+	err := selectVal(ctx, e, &v, query, args...)
+	if err != nil && err != sql.ErrNoRows {
+		return v, err
+	}
+	return v, nil
+}
+
 func get(ctx context.Context, m *DbMap, e SqlExecutor, dest interface{}, keys ...interface{}) error {
 
 	table := m.TableFor(dest)
@@ -198,6 +334,8 @@ func get(ctx context.Context, m *DbMap, e SqlExecutor, dest interface{}, keys ..
 		return err
 	}
 
+	table.takeSnapshot(reflect.Indirect(reflect.ValueOf(dest)))
+
 	if table.CanPostGet {
 		err = dest.(PostGetter).PostGet(ctx, e)
 		if err != nil {
@@ -208,6 +346,124 @@ func get(ctx context.Context, m *DbMap, e SqlExecutor, dest interface{}, keys ..
 	return nil
 }
 
+func getMany(ctx context.Context, m *DbMap, e SqlExecutor, dest interface{}, keys interface{}) ([]interface{}, error) {
+	dv := reflect.ValueOf(dest)
+	if dv.Kind() != reflect.Ptr || dv.Elem().Kind() != reflect.Slice {
+		return nil, fmt.Errorf("modl: GetMany needs a pointer to a slice, got %T", dest)
+	}
+	table := m.TableFor(dest)
+	if table == nil {
+		return nil, fmt.Errorf("could not find table for %v", dest)
+	}
+	if len(table.Keys) < 1 {
+		return nil, &NoKeysErr{table}
+	}
+
+	kv := reflect.ValueOf(keys)
+	if kv.Kind() != reflect.Slice && kv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("modl: GetMany needs a slice of keys, got %T", keys)
+	}
+	list := make([]interface{}, kv.Len())
+	args := make([][]interface{}, kv.Len())
+	for i := range list {
+		var err error
+		list[i] = kv.Index(i).Interface()
+		args[i], err = keyArgs(table, list[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	size := m.Dialect.MaxBindVars() / len(table.Keys)
+	if size < 1 {
+		size = 1
+	}
+	slice := dv.Elem()
+	found := map[string]bool{}
+	for start := 0; start < len(args); start += size {
+		end := start + size
+		if end > len(args) {
+			end = len(args)
+		}
+		var bound []interface{}
+		for _, a := range args[start:end] {
+			bound = append(bound, a...)
+		}
+
+		// select each chunk into a new slice, so that hooks run once per row
+		chunk := reflect.New(slice.Type())
+		err := e.SelectContext(ctx, chunk.Interface(), table.getManySql(end-start), bound...)
+		if err != nil {
+			return nil, err
+		}
+		rows := chunk.Elem()
+		for i := 0; i < rows.Len(); i++ {
+			row := reflect.Indirect(rows.Index(i))
+			found[keyString(table, rowKeys(table, row))] = true
+		}
+		slice = reflect.AppendSlice(slice, rows)
+	}
+	dv.Elem().Set(slice)
+
+	var missing []interface{}
+	for i, a := range args {
+		if !found[keyString(table, a)] {
+			missing = append(missing, list[i])
+		}
+	}
+	return missing, nil
+}
+
+// keyArgs returns the values of a key given to GetMany: the key itself for a
+// table with a single key column, or the elements of a slice or array of the
+// key values for a composite key.
+func keyArgs(table *TableMap, key interface{}) ([]interface{}, error) {
+	if len(table.Keys) == 1 {
+		return []interface{}{key}, nil
+	}
+	v := reflect.ValueOf(key)
+	if (v.Kind() != reflect.Slice && v.Kind() != reflect.Array) || v.Len() != len(table.Keys) {
+		return nil, fmt.Errorf("modl: key %v of table %s needs %d values", key, table.TableName, len(table.Keys))
+	}
+	args := make([]interface{}, v.Len())
+	for i := range args {
+		args[i] = v.Index(i).Interface()
+	}
+	return args, nil
+}
+
+// keyString returns a string identifying the values of the keys of table,
+// for comparing keys given as other types than their fields' with keys read
+// from rows.
+func keyString(table *TableMap, keys []interface{}) string {
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		values[i] = keyValue(table.Keys[i], key)
+	}
+	return fmt.Sprintf("%#v", values)
+}
+
+// keyValue returns key dereferenced and converted to the type of the field of
+// the key column col, or its element type for a pointer field.  Numbers are
+// not converted to strings, nor strings to numbers.
+func keyValue(col *ColumnMap, key interface{}) interface{} {
+	v := reflect.ValueOf(key)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if !v.IsValid() || v.Kind() == reflect.Ptr {
+		return nil
+	}
+	t := col.gotype
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if v.Type() != t && v.Type().ConvertibleTo(t) && (v.Kind() == reflect.String) == (t.Kind() == reflect.String) {
+		v = v.Convert(t)
+	}
+	return v.Interface()
+}
+
 func deletes(ctx context.Context, m *DbMap, e SqlExecutor, list ...interface{}) (int64, error) {
 	var err error
 	var table *TableMap
@@ -256,36 +512,103 @@ func deletes(ctx context.Context, m *DbMap, e SqlExecutor, list ...interface{})
 	return count, nil
 }
 
+func updateWhere(ctx context.Context, m *DbMap, e SqlExecutor, i interface{}, bump bool, set map[string]interface{}, where string, args ...interface{}) (int64, error) {
+	table := m.TableFor(i)
+	if table == nil {
+		return -1, fmt.Errorf("could not find table for %v", i)
+	}
+
+	query, setArgs, err := table.updateWhereSql(set, where, bump)
+	if err != nil {
+		return -1, err
+	}
+	res, err := e.ExecContext(ctx, query, append(setArgs, args...)...)
+	if err != nil {
+		return -1, err
+	}
+	return res.RowsAffected()
+}
+
+func deleteWhere(ctx context.Context, m *DbMap, e SqlExecutor, i interface{}, where string, args ...interface{}) (int64, error) {
+	table := m.TableFor(i)
+	if table == nil {
+		return -1, fmt.Errorf("could not find table for %v", i)
+	}
+
+	res, err := e.ExecContext(ctx, table.deleteWhereSql(where), args...)
+	if err != nil {
+		return -1, err
+	}
+	return res.RowsAffected()
+}
+
 func update(ctx context.Context, m *DbMap, e SqlExecutor, list ...interface{}) (int64, error) {
-	var err error
-	var table *TableMap
-	var elem reflect.Value
 	var count int64
 
 	for _, ptr := range list {
-		table, elem, err = tableForPointer(m, ptr, true)
+		table, elem, err := tableForPointer(m, ptr, true)
 		if err != nil {
 			return -1, err
 		}
 
-		if table.CanPreUpdate {
-			err = ptr.(PreUpdater).PreUpdate(ctx, e)
-			if err != nil {
-				return -1, err
-			}
+		rows, err := updateRow(ctx, m, e, ptr, table, elem, nil)
+		if err != nil {
+			return -1, err
 		}
+		count += rows
+	}
+	return count, nil
+}
+
+func updateColumns(ctx context.Context, m *DbMap, e SqlExecutor, ptr interface{}, fields ...string) (int64, error) {
+	table, elem, err := tableForPointer(m, ptr, true)
+	if err != nil {
+		return -1, err
+	}
 
-		bi := table.bindUpdate(elem)
+	cols, err := table.updateColumns(fields)
+	if err != nil {
+		return -1, err
+	}
+
+	return updateRow(ctx, m, e, ptr, table, elem, cols)
+}
+
+// updateRow updates the given columns of a single row, or all of its
+// columns if cols is nil.  If the table uses snapshots and cols is nil, only
+// the columns changed since the snapshot are updated, and no statement is
+// run if nothing has changed.
+func updateRow(ctx context.Context, m *DbMap, e SqlExecutor, ptr interface{}, table *TableMap, elem reflect.Value, cols []*ColumnMap) (int64, error) {
+	var err error
+
+	if table.CanPreUpdate {
+		err = ptr.(PreUpdater).PreUpdate(ctx, e)
 		if err != nil {
 			return -1, err
 		}
+	}
+
+	if cols == nil {
+		if dirty, ok := table.dirtyColumns(elem); ok {
+			cols = dirty
+		}
+	}
+
+	var rows int64
+	if cols == nil || len(cols) > 0 {
+		var bi bindInstance
+		if cols == nil {
+			bi = table.bindUpdate(elem)
+		} else {
+			bi = table.bindUpdateColumns(elem, cols)
+		}
 
 		res, err := e.ExecContext(ctx, bi.query, bi.args...)
 		if err != nil {
 			return -1, err
 		}
 
-		rows, err := res.RowsAffected()
+		rows, err = res.RowsAffected()
 		if err != nil {
 			return -1, err
 		}
@@ -295,21 +618,20 @@ func update(ctx context.Context, m *DbMap, e SqlExecutor, list ...interface{}) (
 				bi.existingVersion, elem, bi.keys...)
 		}
 
-		if bi.versField != "" {
-			elem.FieldByName(bi.versField).SetInt(bi.existingVersion + 1)
+		if bi.versField != nil {
+			fieldByIndex(elem, bi.versField.fieldIndex).SetInt(bi.existingVersion + 1)
 		}
+		table.takeSnapshot(elem)
+	}
 
-		count += rows
-
-		if table.CanPostUpdate {
-			err = ptr.(PostUpdater).PostUpdate(ctx, e)
+	if table.CanPostUpdate {
+		err = ptr.(PostUpdater).PostUpdate(ctx, e)
 
-			if err != nil {
-				return -1, err
-			}
+		if err != nil {
+			return -1, err
 		}
 	}
-	return count, nil
+	return rows, nil
 }
 
 func insert(ctx context.Context, m *DbMap, e SqlExecutor, list ...interface{}) error {
@@ -332,17 +654,14 @@ func insert(ctx context.Context, m *DbMap, e SqlExecutor, list ...interface{}) e
 
 		bi := table.bindInsert(elem)
 
-		if bi.autoIncrIdx > -1 {
-			id, err := m.Dialect.InsertAutoIncr(e, bi.query, bi.args...)
+		if bi.autoIncrCol != nil {
+			id, err := m.Dialect.InsertAutoIncr(ctx, e, bi.query, bi.args...)
 			if err != nil {
 				return err
 			}
-			f := elem.Field(bi.autoIncrIdx)
-			k := f.Kind()
-			if (k == reflect.Int) || (k == reflect.Int16) || (k == reflect.Int32) || (k == reflect.Int64) {
-				f.SetInt(id)
-			} else {
-				return fmt.Errorf("modl: Cannot set autoincrement value on non-Int field. SQL=%s  autoIncrIdx=%d", bi.query, bi.autoIncrIdx)
+			err = setAutoIncr(elem, bi, id)
+			if err != nil {
+				return err
 			}
 		} else {
 			_, err := e.ExecContext(ctx, bi.query, bi.args...)
@@ -351,6 +670,76 @@ func insert(ctx context.Context, m *DbMap, e SqlExecutor, list ...interface{}) e
 			}
 		}
 
+		table.takeSnapshot(elem)
+
+		if table.CanPostInsert {
+			err = ptr.(PostInserter).PostInsert(ctx, e)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func upsert(ctx context.Context, m *DbMap, e SqlExecutor, list ...interface{}) error {
+	for _, ptr := range list {
+		table, elem, err := tableForPointer(m, ptr, true)
+		if err != nil {
+			return err
+		}
+
+		// a row without its auto-increment key yet is new, so it can only
+		// conflict on some other set of columns
+		genAutoIncr := false
+		for _, k := range table.Keys {
+			if k.isAutoIncr && fieldByIndex(elem, k.fieldIndex).IsZero() {
+				genAutoIncr = true
+			}
+		}
+		if genAutoIncr && len(table.conflictKeys) == 0 {
+			err = insert(ctx, m, e, ptr)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if table.CanPreInsert {
+			err = ptr.(PreInserter).PreInsert(ctx, e)
+			if err != nil {
+				return err
+			}
+		}
+
+		// the row's key and version depend on whether it was inserted or
+		// updated, so they are returned by the statement, or else read back
+		bi := table.bindUpsert(elem, genAutoIncr)
+		readBack := genAutoIncr || bi.versField != nil
+		if len(bi.returning) > 0 {
+			m.trace(bi.query, bi.args...)
+			err = e.handle().QueryRowxContext(ctx, bi.query, bi.args...).Scan(fieldAddrs(elem, bi.returning)...)
+			// a conflict which does nothing returns no row
+			readBack = err == sql.ErrNoRows
+			if err != nil && !readBack {
+				return err
+			}
+		} else {
+			_, err = e.ExecContext(ctx, bi.query, bi.args...)
+			if err != nil {
+				return err
+			}
+		}
+		if readBack {
+			plan := table.bindUpsertGet()
+			err = e.handle().QueryRowxContext(ctx, plan.query, bi.keys...).Scan(fieldAddrs(elem, plan.argFields)...)
+			if err != nil {
+				return err
+			}
+		}
+
+		table.takeSnapshot(elem)
+
 		if table.CanPostInsert {
 			err = ptr.(PostInserter).PostInsert(ctx, e)
 			if err != nil {
@@ -361,6 +750,429 @@ func insert(ctx context.Context, m *DbMap, e SqlExecutor, list ...interface{}) e
 	return nil
 }
 
+// fieldAddrs returns pointers to the fields of elem mapped to cols.
+func fieldAddrs(elem reflect.Value, cols []*ColumnMap) []interface{} {
+	dest := make([]interface{}, len(cols))
+	for i, col := range cols {
+		dest[i] = fieldByIndex(elem, col.fieldIndex).Addr().Interface()
+	}
+	return dest
+}
+
+func setAutoIncr(elem reflect.Value, bi bindInstance, id int64) error {
+	f := fieldByIndex(elem, bi.autoIncrCol.fieldIndex)
+	k := f.Kind()
+	if (k == reflect.Int) || (k == reflect.Int16) || (k == reflect.Int32) || (k == reflect.Int64) {
+		f.SetInt(id)
+		return nil
+	}
+	return fmt.Errorf("modl: Cannot set autoincrement value on non-Int field. SQL=%s  autoIncrCol=%s", bi.query, bi.autoIncrCol.ColumnName)
+}
+
+// insertBatch inserts list using as few multi-row insert statements as the
+// dialect's bindvar limit allows.  Consecutive elements mapped to the same
+// table are written together; PreInsert hooks run for every element of a
+// batch before it is written and PostInsert hooks after.
+func insertBatch(ctx context.Context, m *DbMap, e SqlExecutor, list ...interface{}) error {
+	size := func(table *TableMap, max int) int {
+		return batchSize(m, table, max)
+	}
+	return eachBatch(m, list, false, size, func(table *TableMap, batch []interface{}, elems []reflect.Value) error {
+		return insertRows(ctx, m, e, table, batch, elems)
+	})
+}
+
+// eachBatch splits list into batches of consecutive elements mapped to the
+// same table, of at most size(table, max) elements, and calls fn for each.
+func eachBatch(m *DbMap, list []interface{}, checkPk bool, size func(table *TableMap, max int) int,
+	fn func(table *TableMap, batch []interface{}, elems []reflect.Value) error) error {
+	for len(list) > 0 {
+		table, _, err := tableForPointer(m, list[0], checkPk)
+		if err != nil {
+			return err
+		}
+
+		max := size(table, len(list))
+
+		var batch []interface{}
+		var elems []reflect.Value
+		for len(list) > 0 && len(batch) < max {
+			t, elem, err := tableForPointer(m, list[0], checkPk)
+			if err != nil {
+				return err
+			}
+			if t != table {
+				break
+			}
+			batch = append(batch, list[0])
+			elems = append(elems, elem)
+			list = list[1:]
+		}
+
+		err = fn(table, batch, elems)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDuplicateRows returns an error if two elements of list are the same
+// row, by table and primary keys, as the second would appear to have been
+// changed concurrently once the first is written.
+func checkDuplicateRows(m *DbMap, list []interface{}) error {
+	seen := map[*TableMap]map[string]bool{}
+	for _, ptr := range list {
+		table, elem, err := tableForPointer(m, ptr, true)
+		if err != nil {
+			return err
+		}
+		keys := rowKeys(table, elem)
+		key := keyString(table, keys)
+		if seen[table] == nil {
+			seen[table] = map[string]bool{}
+		}
+		if seen[table][key] {
+			return fmt.Errorf("modl: row of table %s with keys %v is listed more than once", table.TableName, keys)
+		}
+		seen[table][key] = true
+	}
+	return nil
+}
+
+// batchSize returns how many rows of table fit in a single multi-row insert
+// without exceeding the dialect's bindvar limit, capped at max.
+func batchSize(m *DbMap, table *TableMap, max int) int {
+	return rowsPerStatement(m, len(table.insertBatchPlan().argFields), max)
+}
+
+// rowsPerStatement returns how many rows with perRow bindvars each fit in a
+// single statement without exceeding the dialect's bindvar limit, capped at
+// max.
+func rowsPerStatement(m *DbMap, perRow, max int) int {
+	if perRow == 0 {
+		return max
+	}
+	size := m.Dialect.MaxBindVars() / perRow
+	if size < 1 {
+		return 1
+	}
+	if size > max {
+		return max
+	}
+	return size
+}
+
+func insertRows(ctx context.Context, m *DbMap, e SqlExecutor, table *TableMap, batch []interface{}, elems []reflect.Value) error {
+	var err error
+
+	if table.CanPreInsert {
+		for _, ptr := range batch {
+			err = ptr.(PreInserter).PreInsert(ctx, e)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	bi := table.bindInsertBatch(elems)
+
+	if bi.autoIncrCol != nil {
+		ids, err := m.Dialect.InsertAutoIncrBatch(ctx, e, bi.query, len(elems), bi.args...)
+		if err != nil {
+			return err
+		}
+		for i, elem := range elems {
+			err = setAutoIncr(elem, bi, ids[i])
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		_, err := e.ExecContext(ctx, bi.query, bi.args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, elem := range elems {
+		table.takeSnapshot(elem)
+	}
+
+	if table.CanPostInsert {
+		for _, ptr := range batch {
+			err = ptr.(PostInserter).PostInsert(ctx, e)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteBatch deletes list using as few statements as the dialect's bindvar
+// limit allows, batched as insertBatch does.
+func deleteBatch(ctx context.Context, m *DbMap, e SqlExecutor, list ...interface{}) (int64, error) {
+	if err := checkDuplicateRows(m, list); err != nil {
+		return -1, err
+	}
+	var count int64
+	size := func(table *TableMap, max int) int {
+		perRow := len(table.Keys)
+		if table.version != nil {
+			perRow++
+		}
+		return rowsPerStatement(m, perRow, max)
+	}
+	err := eachBatch(m, list, true, size, func(table *TableMap, batch []interface{}, elems []reflect.Value) error {
+		if table.CanPreDelete {
+			for _, ptr := range batch {
+				if err := ptr.(PreDeleter).PreDelete(ctx, e); err != nil {
+					return err
+				}
+			}
+		}
+
+		var args []interface{}
+		for _, elem := range elems {
+			args = append(args, rowKeys(table, elem)...)
+			if table.version != nil {
+				args = append(args, fieldByIndex(elem, table.version.fieldIndex).Int())
+			}
+		}
+		rows, err := execBatch(ctx, m, e, table, elems, table.deleteBatchSql(len(elems)), args, checkDeleted)
+		if err != nil {
+			return err
+		}
+		count += rows
+
+		if table.CanPostDelete {
+			for _, ptr := range batch {
+				if err := ptr.(PostDeleter).PostDelete(ctx, e); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return -1, err
+	}
+	return count, nil
+}
+
+// updateBatch updates list using as few statements as the dialect's bindvar
+// limit allows, batched as insertBatch does.
+func updateBatch(ctx context.Context, m *DbMap, e SqlExecutor, list ...interface{}) (int64, error) {
+	if err := checkDuplicateRows(m, list); err != nil {
+		return -1, err
+	}
+	var count int64
+	size := func(table *TableMap, max int) int {
+		_, order := m.Dialect.UpdateBatchSql(table, 1)
+		return rowsPerStatement(m, len(order), max)
+	}
+	err := eachBatch(m, list, true, size, func(table *TableMap, batch []interface{}, elems []reflect.Value) error {
+		if table.CanPreUpdate {
+			for _, ptr := range batch {
+				if err := ptr.(PreUpdater).PreUpdate(ctx, e); err != nil {
+					return err
+				}
+			}
+		}
+
+		// a table of only key columns has nothing to set, but its hooks
+		// still run as Update's do
+		if len(table.batchUpdateColumns()) > 0 || table.version != nil {
+			var values []interface{}
+			for _, elem := range elems {
+				values = append(values, rowKeys(table, elem)...)
+				for _, col := range table.batchUpdateColumns() {
+					values = append(values, fieldByIndex(elem, col.fieldIndex).Interface())
+				}
+				if table.version != nil {
+					values = append(values, fieldByIndex(elem, table.version.fieldIndex).Int())
+				}
+			}
+			query, order := m.Dialect.UpdateBatchSql(table, len(elems))
+			args := make([]interface{}, len(order))
+			for i, x := range order {
+				args[i] = values[x]
+			}
+			rows, err := execBatch(ctx, m, e, table, elems, query, args, checkUpdated)
+			if err != nil {
+				return err
+			}
+			count += rows
+		}
+
+		for _, elem := range elems {
+			if table.version != nil {
+				v := fieldByIndex(elem, table.version.fieldIndex)
+				v.SetInt(v.Int() + 1)
+			}
+			table.takeSnapshot(elem)
+		}
+
+		if table.CanPostUpdate {
+			for _, ptr := range batch {
+				if err := ptr.(PostUpdater).PostUpdate(ctx, e); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return -1, err
+	}
+	return count, nil
+}
+
+// execBatch runs a batch update or delete of the rows elems of table.  If
+// the table has a version column, the versions of the rows are checked
+// first, and an OptimisticLockErrors is returned without running query if
+// any of them is out of date.  Where the dialect can, the check locks the
+// rows until the end of a transaction.  Otherwise a concurrent writer may
+// change a row between the check and the statement, and fewer rows than
+// expected are written; the versions are then checked again against what
+// query wrote, and an OptimisticLockErrors is returned for the rows it
+// missed, which a transaction can be rolled back on.
+func execBatch(ctx context.Context, m *DbMap, e SqlExecutor, table *TableMap, elems []reflect.Value, query string, args []interface{}, after versionCheck) (int64, error) {
+	if table.version != nil {
+		errs, err := checkVersions(ctx, m, e, table, elems, checkBefore)
+		if err != nil {
+			return -1, err
+		}
+		if len(errs) > 0 {
+			return -1, errs
+		}
+	}
+
+	res, err := e.ExecContext(ctx, query, args...)
+	if err != nil {
+		return -1, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
+	if table.version != nil && rows != int64(len(elems)) {
+		errs, err := checkVersions(ctx, m, e, table, elems, after)
+		if err != nil {
+			return -1, err
+		}
+		if len(errs) > 0 {
+			return -1, errs
+		}
+		// a concurrent writer may have bumped a row to the version query
+		// would have written, so the rows missed can't always be told apart
+		return -1, fmt.Errorf("modl: %d of %d rows of table %s were changed concurrently", int64(len(elems))-rows, len(elems), table.TableName)
+	}
+	return rows, nil
+}
+
+// A versionCheck says what checkVersions expects of the rows it reads.
+type versionCheck int
+
+const (
+	// checkBefore expects the rows to have the versions on their structs.
+	checkBefore versionCheck = iota
+	// checkUpdated expects the rows to have been updated, and so to have
+	// one more than the versions on their structs.
+	checkUpdated
+	// checkDeleted expects the rows to have been deleted.
+	checkDeleted
+)
+
+// checkVersions reads the versions of the rows elems of table, and returns
+// an OptimisticLockError for each row that is not as check expects: by
+// default, whose version differs from the one on its struct, or which no
+// longer exists.
+func checkVersions(ctx context.Context, m *DbMap, e SqlExecutor, table *TableMap, elems []reflect.Value, check versionCheck) (OptimisticLockErrors, error) {
+	d := m.Dialect
+	s := bytes.Buffer{}
+	s.WriteString("select ")
+	for _, col := range append(table.Keys[:len(table.Keys):len(table.Keys)], table.version) {
+		s.WriteString(d.QuoteField(col.ColumnName))
+		s.WriteString(",")
+	}
+	s.Truncate(s.Len() - 1)
+	s.WriteString(" from ")
+	s.WriteString(table.quotedTableName())
+	s.WriteString(" where ")
+	s.WriteString(keysMatchSql(d, table, len(elems), 0, false))
+	if lock := d.ForUpdateClause(); lock != "" && check == checkBefore {
+		// in a transaction, keep the rows from changing before the
+		// statement is run
+		s.WriteString(" ")
+		s.WriteString(lock)
+	}
+	s.WriteString(";")
+
+	var args []interface{}
+	for _, elem := range elems {
+		args = append(args, rowKeys(table, elem)...)
+	}
+	rows, err := e.handle().QueryxContext(ctx, s.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := map[string]int64{}
+	for rows.Next() {
+		keys := make([]interface{}, len(table.Keys))
+		dest := make([]interface{}, len(table.Keys)+1)
+		for i, col := range table.Keys {
+			// scan into the key field's type, so keys compare equal to the
+			// structs' keys by keyString
+			dest[i] = reflect.New(col.gotype).Interface()
+		}
+		var version int64
+		dest[len(table.Keys)] = &version
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for i := range keys {
+			keys[i] = reflect.ValueOf(dest[i]).Elem().Interface()
+		}
+		versions[keyString(table, keys)] = version
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var errs OptimisticLockErrors
+	for _, elem := range elems {
+		local := fieldByIndex(elem, table.version.fieldIndex).Int()
+		keys := rowKeys(table, elem)
+		version, ok := versions[keyString(table, keys)]
+		var stale bool
+		switch check {
+		case checkBefore:
+			stale = !ok || version != local
+		case checkUpdated:
+			stale = !ok || version != local+1
+		case checkDeleted:
+			stale = ok
+		}
+		if stale {
+			errs = append(errs, OptimisticLockError{table.TableName, keys, ok, local})
+		}
+	}
+	return errs, nil
+}
+
+// rowKeys returns the values of the primary key fields of elem.
+func rowKeys(table *TableMap, elem reflect.Value) []interface{} {
+	keys := make([]interface{}, len(table.Keys))
+	for i, col := range table.Keys {
+		keys[i] = fieldByIndex(elem, col.fieldIndex).Interface()
+	}
+	return keys
+}
+
 func lockError(ctx context.Context, m *DbMap, e SqlExecutor, tableName string, existingVer int64, elem reflect.Value, keys ...interface{}) (int64, error) {
 
 	dest := reflect.New(elem.Type()).Interface()
@@ -3,10 +3,12 @@ package modl
 import (
 	"bytes"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -482,433 +484,2622 @@ func TestTransaction(t *testing.T) {
 	}
 }
 
-func TestMultiple(t *testing.T) {
+func TestCancelledContext(t *testing.T) {
 	ctx := context.Background()
 	dbmap := initDbMap(ctx)
 	defer dbmap.Cleanup(ctx)
 
-	inv1 := &Invoice{0, 100, 200, "a", 0, false}
-	inv2 := &Invoice{0, 100, 200, "b", 0, true}
-	_insert(ctx, dbmap, inv1, inv2)
+	inv := &Invoice{0, 100, 200, "cancelled", 0, false}
+	_insert(ctx, dbmap, inv)
 
-	inv1.Memo = "c"
-	inv2.Memo = "d"
-	_update(ctx, dbmap, inv1, inv2)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
 
-	count := _del(ctx, dbmap, inv1, inv2)
-	if count != 2 {
-		t.Errorf("%d != 2", count)
+	err := dbmap.InsertContext(cancelled, &Invoice{0, 100, 200, "never", 0, false})
+	if err != context.Canceled {
+		t.Errorf("insert - Expected context.Canceled, got: %v", err)
+	}
+	err = dbmap.InsertContext(cancelled, &Person{0, 0, 0, "Bob", "Smith", 0})
+	if err != context.Canceled {
+		t.Errorf("insert autoincr - Expected context.Canceled, got: %v", err)
 	}
-}
 
-func TestCrud(t *testing.T) {
-	ctx := context.Background()
-	dbmap := initDbMap(ctx)
-	defer dbmap.Cleanup(ctx)
+	inv.Memo = "updated"
+	_, err = dbmap.UpdateContext(cancelled, inv)
+	if err != context.Canceled {
+		t.Errorf("update - Expected context.Canceled, got: %v", err)
+	}
 
-	inv := &Invoice{0, 100, 200, "first order", 0, true}
+	_, err = dbmap.DeleteContext(cancelled, inv)
+	if err != context.Canceled {
+		t.Errorf("delete - Expected context.Canceled, got: %v", err)
+	}
 
-	// INSERT row
-	_insert(ctx, dbmap, inv)
-	if inv.ID == 0 {
-		t.Errorf("inv.ID was not set on INSERT")
-		return
+	err = dbmap.GetContext(cancelled, &Invoice{}, inv.ID)
+	if err != context.Canceled {
+		t.Errorf("get - Expected context.Canceled, got: %v", err)
 	}
 
-	// SELECT row
+	_, err = dbmap.BeginContext(cancelled)
+	if err != context.Canceled {
+		t.Errorf("begin - Expected context.Canceled, got: %v", err)
+	}
+
+	// nothing should have been written by the cancelled operations
 	inv2 := &Invoice{}
 	MustGet(ctx, dbmap, inv2, inv.ID)
-	if !reflect.DeepEqual(inv, inv2) {
-		t.Errorf("%v != %v", inv, inv2)
+	if inv2.Memo != "cancelled" {
+		t.Errorf("cancelled update was applied: %v", inv2)
 	}
+	var invoices []Invoice
+	MustSelect(ctx, dbmap, &invoices, "select * from invoice_test")
+	if len(invoices) != 1 {
+		t.Errorf("Expected 1 invoice row, got %d", len(invoices))
+	}
+}
 
-	// UPDATE row and SELECT
-	inv.Memo = "second order"
-	inv.Created = 999
-	inv.Updated = 11111
-	count := _update(ctx, dbmap, inv)
-	if count != 1 {
-		t.Errorf("update 1 != %d", count)
+// WithTxCheck records the transaction options seen by its PreInsert hook.
+type WithTxCheck struct {
+	ID   int64
+	Name string
+	opts *sql.TxOptions `db:"-"`
+}
+
+func (w *WithTxCheck) PreInsert(ctx context.Context, s SqlExecutor) error {
+	w.opts = s.TxOptions()
+	return nil
+}
+
+func TestTransactionOptions(t *testing.T) {
+	ctx := context.Background()
+	dbmap := initDbMap(ctx)
+	dbmap.AddTableWithName(WithTxCheck{}, "tx_check_test").SetKeys(true, "ID")
+	err := dbmap.CreateTablesIfNotExists(ctx)
+	if err != nil {
+		panic(err)
 	}
+	defer dbmap.Cleanup(ctx)
 
-	MustGet(ctx, dbmap, inv2, inv.ID)
-	if !reflect.DeepEqual(inv, inv2) {
-		t.Errorf("%v != %v", inv, inv2)
+	w1 := &WithTxCheck{Name: "outside"}
+	_insert(ctx, dbmap, w1)
+	if w1.opts != nil {
+		t.Errorf("Expected nil TxOptions outside a transaction, got %v", w1.opts)
 	}
 
-	// DELETE row
-	deleted := _del(ctx, dbmap, inv)
-	if deleted != 1 {
-		t.Errorf("Did not delete row with ID: %d", inv.ID)
-		return
+	opts := &sql.TxOptions{Isolation: sql.LevelSerializable}
+	trans, err := dbmap.BeginTx(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
 	}
+	// the transaction keeps its own copy of the options
+	opts.ReadOnly = true
 
-	// VERIFY deleted
-	err := dbmap.GetContext(ctx, inv2, inv.ID)
-	if err != sql.ErrNoRows {
-		t.Errorf("Found invoice with id: %d after Delete()", inv.ID)
+	w2 := &WithTxCheck{Name: "inside"}
+	err = trans.InsertContext(ctx, w2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = trans.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w2.opts == nil {
+		t.Fatalf("Expected TxOptions inside a transaction, got nil")
+	}
+	if w2.opts.Isolation != sql.LevelSerializable || w2.opts.ReadOnly {
+		t.Errorf("Unexpected TxOptions in hook: %+v", *w2.opts)
+	}
+
+	trans, err = dbmap.BeginContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trans.Rollback()
+	if o := trans.TxOptions(); o == nil || o.Isolation != sql.LevelDefault || o.ReadOnly {
+		t.Errorf("Expected default TxOptions, got %v", o)
 	}
 }
 
-func TestWithIgnoredColumn(t *testing.T) {
+// retryDialect wraps a Dialect and treats errRetry as retryable.
+type retryDialect struct {
+	Dialect
+}
+
+var errRetry = errors.New("retry me")
+
+func (d retryDialect) IsRetryable(err error) bool {
+	return err == errRetry || d.Dialect.IsRetryable(err)
+}
+
+func TestInTransaction(t *testing.T) {
 	ctx := context.Background()
 	dbmap := initDbMap(ctx)
 	defer dbmap.Cleanup(ctx)
+	dbmap.Dialect = retryDialect{dbmap.Dialect}
 
-	ic := &WithIgnoredColumn{-1, 0, 1}
-	_insert(ctx, dbmap, ic)
-	expected := &WithIgnoredColumn{0, 1, 1}
+	count := func() int {
+		var invoices []Invoice
+		MustSelect(ctx, dbmap, &invoices, "select * from invoice_test")
+		return len(invoices)
+	}
 
-	ic2 := &WithIgnoredColumn{}
-	MustGet(ctx, dbmap, ic2, ic.ID)
+	// retryable errors roll back and run the function again
+	attempts := 0
+	err := dbmap.InTransaction(ctx, nil, func(tx *Transaction) error {
+		attempts++
+		err := tx.InsertContext(ctx, &Invoice{0, 100, 200, "retried", 0, false})
+		if err != nil {
+			return err
+		}
+		if attempts < 3 {
+			return errRetry
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+	if c := count(); c != 1 {
+		t.Errorf("Expected 1 invoice after retries, got %d", c)
+	}
 
-	if !reflect.DeepEqual(expected, ic2) {
-		t.Errorf("%v != %v", expected, ic2)
+	// other errors roll back and are returned immediately
+	attempts = 0
+	errFail := errors.New("fail")
+	err = dbmap.InTransaction(ctx, nil, func(tx *Transaction) error {
+		attempts++
+		tx.InsertContext(ctx, &Invoice{0, 100, 200, "failed", 0, false})
+		return errFail
+	})
+	if err != errFail {
+		t.Errorf("Expected errFail, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("Expected 1 attempt, got %d", attempts)
+	}
+	if c := count(); c != 1 {
+		t.Errorf("Expected failed transaction to be rolled back, got %d invoices", c)
 	}
 
-	if _del(ctx, dbmap, ic) != 1 {
-		t.Errorf("Did not delete row with ID: %d", ic.ID)
-		return
+	// retries give up after TxMaxRetries
+	attempts = 0
+	err = dbmap.InTransaction(ctx, nil, func(tx *Transaction) error {
+		attempts++
+		return errRetry
+	})
+	if err != errRetry {
+		t.Errorf("Expected errRetry, got %v", err)
+	}
+	if attempts != TxMaxRetries+1 {
+		t.Errorf("Expected %d attempts, got %d", TxMaxRetries+1, attempts)
 	}
 
-	err := dbmap.GetContext(ctx, ic2, ic.ID)
-	if err != sql.ErrNoRows {
-		t.Errorf("Found id: %d after Delete() (%#v)", ic.ID, ic2)
+	// panics roll back and propagate
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("Expected panic to propagate, got %v", r)
+			}
+		}()
+		dbmap.InTransaction(ctx, nil, func(tx *Transaction) error {
+			tx.InsertContext(ctx, &Invoice{0, 100, 200, "panicked", 0, false})
+			panic("boom")
+		})
+	}()
+	if c := count(); c != 1 {
+		t.Errorf("Expected panicked transaction to be rolled back, got %d invoices", c)
 	}
 }
 
-func TestVersionMultipleRows(t *testing.T) {
-	ctx := context.Background()
-	dbmap := initDbMap(ctx)
-	defer dbmap.Cleanup(ctx)
+type sqlStateErr string
 
-	persons := []*Person{
-		&Person{0, 0, 0, "Bob", "Smith", 0},
-		&Person{0, 0, 0, "Jane", "Smith", 0},
-		&Person{0, 0, 0, "Mike", "Smith", 0},
-	}
+func (e sqlStateErr) Error() string    { return string(e) }
+func (e sqlStateErr) SQLState() string { return string(e) }
 
-	_insert(ctx, dbmap, persons[0], persons[1], persons[2])
+type mysqlErr struct {
+	Number  uint16
+	Message string
+}
 
-	for x, p := range persons {
-		if p.Version != 1 {
-			t.Errorf("person[%d].Version != 1: %d", x, p.Version)
+func (e *mysqlErr) Error() string { return e.Message }
+
+type sqliteErr struct {
+	Code int
+}
+
+func (e sqliteErr) Error() string { return fmt.Sprint(e.Code) }
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		err     error
+		want    bool
+	}{
+		{PostgresDialect{}, sqlStateErr("40001"), true},
+		{PostgresDialect{}, sqlStateErr("40P01"), true},
+		{PostgresDialect{}, fmt.Errorf("wrapped: %w", sqlStateErr("40001")), true},
+		{PostgresDialect{}, sqlStateErr("23505"), false},
+		{PostgresDialect{}, errors.New("40001"), false},
+		{MySQLDialect{}, &mysqlErr{1213, "deadlock"}, true},
+		{MySQLDialect{}, &mysqlErr{1062, "duplicate"}, false},
+		{MySQLDialect{}, sql.ErrNoRows, false},
+		{SqliteDialect{}, sqliteErr{5}, true},
+		{SqliteDialect{}, sqliteErr{19}, false},
+		{SqliteDialect{}, nil, false},
+	}
+	for _, tt := range tests {
+		if got := tt.dialect.IsRetryable(tt.err); got != tt.want {
+			t.Errorf("%T.IsRetryable(%v) = %v, want %v", tt.dialect, tt.err, got, tt.want)
 		}
 	}
 }
 
-func TestWithStringPk(t *testing.T) {
+func TestSavepoint(t *testing.T) {
 	ctx := context.Background()
-	dbmap := newDbMap()
-	//dbmap.TraceOn("", log.New(os.Stdout, "modltest: ", log.Lmicroseconds))
-	dbmap.AddTableWithName(WithStringPk{}, "string_pk_test").SetKeys(true, "ID")
-	_, err := dbmap.ExecContext(ctx, "create table string_pk_test (ID varchar(255), Name varchar(255));")
+	dbmap := initDbMap(ctx)
+	defer dbmap.Cleanup(ctx)
+
+	trans, err := dbmap.BeginContext(ctx)
 	if err != nil {
-		t.Errorf("couldn't create string_pk_test: %v", err)
+		t.Fatal(err)
 	}
-	defer dbmap.Cleanup(ctx)
+	defer trans.Rollback()
 
-	row := &WithStringPk{"1", "foo"}
-	err = dbmap.InsertContext(ctx, row)
-	if err == nil {
-		t.Errorf("Expected error when inserting into table w/non Int PK and autoincr set true")
+	inv1 := &Invoice{0, 100, 200, "kept", 0, false}
+	inv2 := &Invoice{0, 100, 200, "rolled back", 0, false}
+	inv3 := &Invoice{0, 100, 200, "released", 0, false}
+
+	if err = trans.InsertContext(ctx, inv1); err != nil {
+		t.Fatal(err)
+	}
+	if err = trans.Savepoint(ctx, "sp1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = trans.InsertContext(ctx, inv2); err != nil {
+		t.Fatal(err)
+	}
+	if err = trans.RollbackTo(ctx, "sp1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = trans.InsertContext(ctx, inv3); err != nil {
+		t.Fatal(err)
+	}
+	if err = trans.Release(ctx, "sp1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = trans.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var memos []string
+	err = dbmap.Dbx.SelectContext(ctx, &memos, "select memo from invoice_test order by id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(memos, []string{"kept", "released"}) {
+		t.Errorf("Unexpected rows after savepoint rollback: %v", memos)
 	}
 }
 
-func BenchmarkNativeCrud(b *testing.B) {
+func TestInsertBatch(t *testing.T) {
 	ctx := context.Background()
-	var err error
-
-	b.StopTimer()
-	dbmap := initDbMapBench(ctx)
+	dbmap := initDbMap(ctx)
 	defer dbmap.Cleanup(ctx)
-	b.StartTimer()
 
-	insert := "insert into invoice_test (date_created, updated, memo, personid) values (?, ?, ?, ?)"
-	sel := "select id, date_created, updated, memo, personid from invoice_test where id=?"
-	update := "update invoice_test set date_created=?, updated=?, memo=?, personid=? where id=?"
-	delete := "delete from invoice_test where id=?"
+	var logBuffer bytes.Buffer
+	dbmap.TraceOn("", log.New(&logBuffer, "modltest:", 0))
+
+	// enough rows to need more than one statement on every dialect
+	perRow := len(dbmap.TableFor(Invoice{}).insertBatchPlan().argFields)
+	n := dbmap.Dialect.MaxBindVars()/perRow + 10
+	list := make([]interface{}, 0, n+2)
+	invoices := make([]*Invoice, 0, n)
+	for i := 0; i < n; i++ {
+		inv := &Invoice{0, int64(i), 0, fmt.Sprintf("batch %d", i), 0, false}
+		invoices = append(invoices, inv)
+		list = append(list, inv)
+	}
+	p1 := &Person{0, 0, 0, "Bob", "Smith", 0}
+	p2 := &Person{0, 0, 0, "Jane", "Smith", 0}
+	list = append(list, p1, p2)
 
-	suffix := dbmap.Dialect.AutoIncrInsertSuffix(&ColumnMap{ColumnName: "id"})
+	err := dbmap.InsertBatchContext(ctx, list...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbmap.TraceOff()
 
-	insert = ReBind(insert, dbmap.Dialect) + suffix
-	sel = ReBind(sel, dbmap.Dialect)
-	update = ReBind(update, dbmap.Dialect)
-	delete = ReBind(delete, dbmap.Dialect)
+	inserts := bytes.Count(logBuffer.Bytes(), []byte("insert into"))
+	if inserts != 3 {
+		t.Errorf("Expected 3 insert statements, got %d", inserts)
+	}
 
-	inv := &Invoice{0, 100, 200, "my memo", 0, false}
+	for _, inv := range invoices {
+		inv2 := &Invoice{}
+		MustGet(ctx, dbmap, inv2, inv.ID)
+		if !reflect.DeepEqual(inv, inv2) {
+			t.Fatalf("%v != %v", inv, inv2)
+		}
+	}
 
-	for i := 0; i < b.N; i++ {
-		if len(suffix) == 0 {
-			res, err := dbmap.Db.Exec(insert, inv.Created, inv.Updated, inv.Memo, inv.PersonID)
-			if err != nil {
-				panic(err)
-			}
+	for _, p := range []*Person{p1, p2} {
+		if p.ID == 0 || p.Version != 1 || p.Created == 0 || p.LName != "postinsert" {
+			t.Errorf("hooks, version or id not set on %v", p)
+		}
+		p3 := &Person{}
+		MustGet(ctx, dbmap, p3, p.ID)
+		if p3.FName != p.FName || p3.Version != 1 {
+			t.Errorf("%v != %v", p, p3)
+		}
+	}
+}
 
-			newid, err := res.LastInsertId()
-			if err != nil {
-				panic(err)
-			}
-			inv.ID = newid
-		} else {
-			rows, err := dbmap.Db.Query(insert, inv.Created, inv.Updated, inv.Memo, inv.PersonID)
-			if err != nil {
-				panic(err)
-			}
+func TestCopyFrom(t *testing.T) {
+	ctx := context.Background()
+	dbmap := initDbMap(ctx)
+	defer dbmap.Cleanup(ctx)
 
-			if rows.Next() {
-				err = rows.Scan(&inv.ID)
-				if err != nil {
-					panic(err)
-				}
-			}
-			rows.Close()
+	invoices := make([]Invoice, 1500)
+	for i := range invoices {
+		invoices[i] = Invoice{0, int64(i), 0, fmt.Sprintf("copy %d", i), 0, i%2 == 0}
+	}
+	n, err := dbmap.CopyFromContext(ctx, invoices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(invoices)) {
+		t.Errorf("Expected %d rows copied, got %d", len(invoices), n)
+	}
 
+	people := make(chan *Person)
+	go func() {
+		for i := 0; i < 10; i++ {
+			people <- &Person{0, 0, 0, fmt.Sprintf("person %d", i), "Smith", 0}
 		}
+		close(people)
+	}()
+	trans, err := dbmap.BeginContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = trans.CopyFromContext(ctx, people)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = trans.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 {
+		t.Errorf("Expected 10 rows copied, got %d", n)
+	}
 
-		row := dbmap.Db.QueryRow(sel, inv.ID)
-		err = row.Scan(&inv.ID, &inv.Created, &inv.Updated, &inv.Memo, &inv.PersonID)
-		if err != nil {
-			panic(err)
+	var got []Invoice
+	MustSelect(ctx, dbmap, &got, "select * from invoice_test order by date_created")
+	if len(got) != len(invoices) {
+		t.Fatalf("Expected %d invoices, got %d", len(invoices), len(got))
+	}
+	for i := range got {
+		if got[i].Memo != invoices[i].Memo || got[i].IsPaid != invoices[i].IsPaid {
+			t.Fatalf("%v != %v", got[i], invoices[i])
 		}
+	}
 
-		inv.Created = 1000
-		inv.Updated = 2000
-		inv.Memo = "my memo 2"
-		inv.PersonID = 3000
-
-		_, err = dbmap.Db.Exec(update, inv.Created, inv.Updated, inv.Memo,
-			inv.PersonID, inv.ID)
-		if err != nil {
-			panic(err)
+	var persons []*Person
+	MustSelect(ctx, dbmap, &persons, "select * from person_test")
+	if len(persons) != 10 {
+		t.Fatalf("Expected 10 persons, got %d", len(persons))
+	}
+	for _, p := range persons {
+		if p.Version != 1 || p.Created == 0 {
+			t.Errorf("PreInsert or version not applied to copied row: %v", p)
 		}
+	}
 
-		_, err = dbmap.Db.Exec(delete, inv.ID)
-		if err != nil {
-			panic(err)
+	_, err = dbmap.CopyFromContext(ctx, Invoice{})
+	if err == nil {
+		t.Errorf("Expected an error copying from a non-slice")
+	}
+}
+
+func TestCopyInClause(t *testing.T) {
+	got := PostgresDialect{}.CopyInClause("", "invoice_test", []string{"memo", "personid"})
+	expected := `copy "invoice_test" ("memo", "personid") from stdin`
+	if got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+	got = PostgresDialect{}.CopyInClause("billing", "invoice_test", []string{"memo"})
+	expected = `copy "billing"."invoice_test" ("memo") from stdin`
+	if got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+	if c := (SqliteDialect{}).CopyInClause("", "invoice_test", []string{"memo"}); c != "" {
+		t.Errorf("Expected no copy clause for sqlite, got %s", c)
+	}
+}
+
+type UpsertUser struct {
+	ID      int64
+	Email   string
+	Name    string
+	Version int64
+}
+
+func TestUpsert(t *testing.T) {
+	ctx := context.Background()
+	dbmap := initDbMap(ctx)
+	users := dbmap.AddTableWithName(UpsertUser{}, "upsert_user_test").SetKeys(true, "ID")
+	users.ColMap("Email").SetUnique(true)
+	err := dbmap.CreateTablesIfNotExists(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer dbmap.Cleanup(ctx)
+
+	// a new row with an auto-increment key is inserted
+	p1 := &Person{0, 0, 0, "Bob", "Smith", 0}
+	err = dbmap.UpsertContext(ctx, p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p1.ID == 0 || p1.Version != 1 {
+		t.Errorf("Expected id and version to be set on upsert insert: %v", p1)
+	}
+
+	// a row with an existing key is updated and its version incremented
+	p2 := &Person{p1.ID, 0, 0, "Robert", "Smith", 0}
+	err = dbmap.UpsertContext(ctx, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p2.Version != 2 {
+		t.Errorf("Expected version 2 after upsert update, got %d", p2.Version)
+	}
+	p3 := &Person{}
+	MustGet(ctx, dbmap, p3, p1.ID)
+	if p3.FName != "Robert" || p3.Version != 2 {
+		t.Errorf("Upsert did not update existing row: %v", p3)
+	}
+
+	// conflicts on a unique column return the existing auto-increment key
+	users.SetConflictKeys("Email")
+	u1 := &UpsertUser{Email: "bob@example.com", Name: "Bob"}
+	err = dbmap.UpsertContext(ctx, u1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2 := &UpsertUser{Email: "bob@example.com", Name: "Robert"}
+	err = dbmap.UpsertContext(ctx, u2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u1.ID == 0 || u2.ID != u1.ID {
+		t.Errorf("Expected upsert on email to keep id %d, got %d", u1.ID, u2.ID)
+	}
+	if u1.Version != 1 || u2.Version != 2 {
+		t.Errorf("Expected versions 1 and 2, got %d and %d", u1.Version, u2.Version)
+	}
+
+	var all []UpsertUser
+	MustSelect(ctx, dbmap, &all, "select * from upsert_user_test")
+	if len(all) != 1 || all[0].Name != "Robert" {
+		t.Errorf("Expected a single updated user, got %v", all)
+	}
+
+	// a conflict which updates nothing returns no row, so the key is read back
+	emails := dbmap.AddTableWithName(UpsertEmail{}, "upsert_email_test").SetKeys(true, "ID")
+	emails.ColMap("Email").SetUnique(true)
+	emails.SetConflictKeys("Email")
+	err = dbmap.CreateTablesIfNotExists(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e1 := &UpsertEmail{Email: "bob@example.com"}
+	e2 := &UpsertEmail{Email: "bob@example.com"}
+	err = dbmap.UpsertContext(ctx, e1, e2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e1.ID == 0 || e2.ID != e1.ID {
+		t.Errorf("Expected upsert doing nothing to keep id %d, got %d", e1.ID, e2.ID)
+	}
+}
+
+type UpsertEmail struct {
+	ID    int64
+	Email string
+}
+
+func TestUpsertReturning(t *testing.T) {
+	for _, d := range []Dialect{PostgresDialect{}, SqliteDialect{}, MySQLDialect{}} {
+		dbmap := NewDbMap(nil, d)
+		users := dbmap.AddTableWithName(UpsertUser{}, "users").SetKeys(true, "ID")
+		users.SetConflictKeys("Email")
+		bi := users.bindUpsert(reflect.ValueOf(&UpsertUser{}).Elem(), true)
+		returning := strings.Contains(bi.query, "returning")
+		if _, mysql := d.(MySQLDialect); returning == mysql {
+			t.Errorf("%T: unexpected returning clause in %s", d, bi.query)
+		}
+		if returning && (len(bi.returning) != 2 || !strings.HasSuffix(bi.query,
+			fmt.Sprintf(" returning %s,%s;", d.QuoteField("id"), d.QuoteField("version")))) {
+			t.Errorf("%T: expected the id and version to be returned by %s", d, bi.query)
+		}
+	}
+}
+
+func TestUpsertClause(t *testing.T) {
+	tests := []struct {
+		dialect  Dialect
+		expected string
+	}{
+		{PostgresDialect{}, ` on conflict ("email") do update set "name"=excluded."name", "version"="users"."version"+1`},
+		{SqliteDialect{}, ` on conflict ("email") do update set "name"=excluded."name", "version"="users"."version"+1`},
+		{MySQLDialect{}, " on duplicate key update `name`=values(`name`), `version`=`version`+1"},
+	}
+	for _, tt := range tests {
+		got := tt.dialect.UpsertClause("users", []string{"email"}, []string{"name"}, "version")
+		if got != tt.expected {
+			t.Errorf("%T: expected %s, got %s", tt.dialect, tt.expected, got)
+		}
+	}
+	if got := (PostgresDialect{}).UpsertClause("users", []string{"id"}, nil, ""); got != ` on conflict ("id") do nothing` {
+		t.Errorf("Unexpected clause without update columns: %s", got)
+	}
+}
+
+type SnapshotPerson struct {
+	Snapshot
+	ID    int64
+	FName string
+	LName string
+}
+
+func TestUpdateColumns(t *testing.T) {
+	ctx := context.Background()
+	dbmap := initDbMap(ctx)
+	defer dbmap.Cleanup(ctx)
+
+	inv := &Invoice{0, 100, 200, "first", 0, false}
+	_insert(ctx, dbmap, inv)
+
+	inv.Memo = "second"
+	inv.IsPaid = true
+	count, err := dbmap.UpdateColumnsContext(ctx, inv, "Memo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 row updated, got %d", count)
+	}
+	inv2 := &Invoice{}
+	MustGet(ctx, dbmap, inv2, inv.ID)
+	if inv2.Memo != "second" || inv2.IsPaid {
+		t.Errorf("Expected only memo to be updated: %v", inv2)
+	}
+
+	// the version column is still checked and incremented
+	p1 := &Person{0, 0, 0, "Bob", "Smith", 0}
+	_insert(ctx, dbmap, p1)
+	p1.LName = "Jones"
+	_, err = dbmap.UpdateColumnsContext(ctx, p1, "lname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p1.Version != 2 {
+		t.Errorf("Expected version 2, got %d", p1.Version)
+	}
+	p1.Version = 1
+	_, err = dbmap.UpdateColumnsContext(ctx, p1, "LName")
+	if _, ok := err.(OptimisticLockError); !ok {
+		t.Errorf("Expected OptimisticLockError, got: %v", err)
+	}
+
+	for _, field := range []string{"ID", "Nope"} {
+		_, err = dbmap.UpdateColumnsContext(ctx, inv, field)
+		if err == nil {
+			t.Errorf("Expected an error updating column %s", field)
+		}
+	}
+}
+
+func TestSnapshotUpdate(t *testing.T) {
+	ctx := context.Background()
+	dbmap := initDbMap(ctx)
+	dbmap.AddTableWithName(SnapshotPerson{}, "snapshot_person_test").SetKeys(true, "ID")
+	err := dbmap.CreateTablesIfNotExists(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer dbmap.Cleanup(ctx)
+
+	p := &SnapshotPerson{FName: "Bob", LName: "Smith"}
+	_insert(ctx, dbmap, p)
+
+	// two writers load the same row and change different fields
+	a := &SnapshotPerson{}
+	MustGet(ctx, dbmap, a, p.ID)
+	var list []*SnapshotPerson
+	MustSelect(ctx, dbmap, &list, "select * from snapshot_person_test")
+	b := list[0]
+
+	var logBuffer bytes.Buffer
+	dbmap.TraceOn("", log.New(&logBuffer, "modltest:", 0))
+
+	a.FName = "Robert"
+	_update(ctx, dbmap, a)
+	b.LName = "Jones"
+	_update(ctx, dbmap, b)
+
+	// nothing changed, so no statement is run
+	if count := _update(ctx, dbmap, b); count != 0 {
+		t.Errorf("Expected no rows updated without changes, got %d", count)
+	}
+	dbmap.TraceOff()
+
+	if updates := bytes.Count(logBuffer.Bytes(), []byte("update ")); updates != 2 {
+		t.Errorf("Expected 2 update statements, got %d:\n%s", updates, logBuffer.String())
+	}
+
+	p2 := &SnapshotPerson{}
+	MustGet(ctx, dbmap, p2, p.ID)
+	if p2.FName != "Robert" || p2.LName != "Jones" {
+		t.Errorf("Expected both writers' changes to be kept, got %v", p2)
+	}
+}
+
+type TaggedPerson struct {
+	ID      int64  `modl:"pk,autoincr"`
+	Email   string `modl:"size:64, unique"`
+	Balance string `modl:"type:numeric(10,2)"`
+	Rev     int64  `modl:"version"`
+}
+
+func TestColumnTags(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap()
+	t1 := dbmap.AddTableWithName(TaggedPerson{}, "tagged_person_test")
+
+	if len(t1.Keys) != 1 || t1.Keys[0] != t1.ColMap("ID") || !t1.Keys[0].isAutoIncr {
+		t.Errorf("Expected an auto-increment ID key, got %v", t1.Keys)
+	}
+	email := t1.ColMap("Email")
+	if email.MaxSize != 64 || !email.Unique {
+		t.Errorf("Expected size and unique to be set from tag: %+v", email)
+	}
+	if c := t1.ColMap("Balance"); c.sqltype != "numeric(10,2)" {
+		t.Errorf("Expected type to be set from tag, got %s", c.sqltype)
+	}
+	if t1.version != t1.ColMap("Rev") {
+		t.Errorf("Expected version column to be set from tag, got %v", t1.version)
+	}
+
+	err := dbmap.CreateTables(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup(ctx)
+
+	p := &TaggedPerson{Email: "bob@example.com", Balance: "10.50"}
+	_insert(ctx, dbmap, p)
+	if p.ID == 0 || p.Rev != 1 {
+		t.Errorf("Expected id and version to be set on insert: %v", p)
+	}
+	err = dbmap.InsertContext(ctx, &TaggedPerson{Email: "bob@example.com"})
+	if err == nil {
+		t.Errorf("Expected unique email from tag to be enforced")
+	}
+
+	// explicit setters override the tag
+	t1.SetKeys(false, "Email")
+	if len(t1.Keys) != 1 || t1.Keys[0] != email || t1.ColMap("ID").isPK || t1.ColMap("ID").isAutoIncr {
+		t.Errorf("Expected SetKeys to replace tagged keys, got %v", t1.Keys)
+	}
+	if email.SetMaxSize(32); email.MaxSize != 32 {
+		t.Errorf("Expected SetMaxSize to override tag, got %d", email.MaxSize)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected a panic for an unknown tag option")
+			}
+		}()
+		type BadTag struct {
+			ID int64 `modl:"primary"`
+		}
+		dbmap.AddTable(BadTag{})
+	}()
+}
+
+type Audit struct {
+	Created int64
+	Updated int64
+}
+
+type Address struct {
+	Street string
+	City   string
+}
+
+type EmbeddedPerson struct {
+	Audit
+	ID      int64 `modl:"pk,autoincr"`
+	Name    string
+	Updated int64   `db:"changed"`
+	Home    Address `modl:"prefix"`
+	Work    Address `modl:"prefix:office_"`
+	Version int64
+}
+
+func TestEmbeddedStruct(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap()
+	t1 := dbmap.AddTableWithName(EmbeddedPerson{}, "embedded_person_test")
+
+	var names []string
+	for _, col := range t1.Columns {
+		names = append(names, col.ColumnName)
+	}
+	expected := []string{"created", "updated", "id", "name", "changed",
+		"home_street", "home_city", "office_street", "office_city", "version"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected columns %v, got %v", expected, names)
+	}
+	if c := t1.ColMap("Home.City"); !reflect.DeepEqual(c.fieldIndex, []int{4, 1}) {
+		t.Errorf("Expected an index path for Home.City, got %v", c.fieldIndex)
+	}
+
+	err := dbmap.CreateTables(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup(ctx)
+
+	p := &EmbeddedPerson{
+		Audit: Audit{Created: 1, Updated: 2},
+		Name:  "bob",
+		Home:  Address{"Main St", "Springfield"},
+		Work:  Address{"Elm St", "Shelbyville"},
+	}
+	_insert(ctx, dbmap, p)
+	if p.ID == 0 || p.Version != 1 {
+		t.Errorf("Expected id and version to be set on insert: %v", p)
+	}
+
+	p.Audit.Updated = 3
+	p.Updated = 4
+	p.Work.City = "Capital City"
+	_update(ctx, dbmap, p)
+
+	p2 := &EmbeddedPerson{}
+	err = dbmap.GetContext(ctx, p2, p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, p2) {
+		t.Errorf("%v != %v", p, p2)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected a panic for prefix on a non-struct field")
+			}
+		}()
+		type BadPrefix struct {
+			ID int64 `modl:"prefix"`
+		}
+		dbmap.AddTable(BadPrefix{})
+	}()
+}
+
+type EmbeddedPtrPerson struct {
+	*Audit
+	ID   int64 `modl:"pk,autoincr"`
+	Name string
+}
+
+func TestEmbeddedStructPointer(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap()
+	t1 := dbmap.AddTableWithName(EmbeddedPtrPerson{}, "embedded_ptr_person_test")
+
+	var names []string
+	for _, col := range t1.Columns {
+		names = append(names, col.ColumnName)
+	}
+	expected := []string{"created", "updated", "id", "name"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected columns %v, got %v", expected, names)
+	}
+
+	err := dbmap.CreateTables(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup(ctx)
+
+	p := &EmbeddedPtrPerson{Audit: &Audit{Created: 1, Updated: 2}, Name: "bob"}
+	_insert(ctx, dbmap, p)
+	p.Updated = 3
+	_update(ctx, dbmap, p)
+
+	p2 := &EmbeddedPtrPerson{}
+	err = dbmap.GetContext(ctx, p2, p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p2.Audit == nil || *p2.Audit != *p.Audit || p2.Name != p.Name {
+		t.Errorf("%v != %v", p, p2)
+	}
+
+	// a nil embedded pointer is inserted as its zero value
+	p3 := &EmbeddedPtrPerson{Name: "alice"}
+	_insert(ctx, dbmap, p3)
+	if p3.Audit == nil || p3.Created != 0 {
+		t.Errorf("Expected the embedded struct to be allocated, got %v", p3.Audit)
+	}
+}
+
+type ShadowedBase struct {
+	ID      int64 `modl:"pk,autoincr"`
+	Version int64
+	Rev     int64 `modl:"version"`
+}
+
+type ShadowingRow struct {
+	ShadowedBase
+	ID       string `modl:"pk"`
+	Revision string `db:"version"`
+	Rev      int64
+}
+
+func TestShadowedKeys(t *testing.T) {
+	dbmap := newDbMap()
+	table := dbmap.AddTableWithName(ShadowingRow{}, "shadowing_test")
+	if len(table.Keys) != 1 || table.Keys[0] != table.ColMap("ID") || table.Keys[0].isAutoIncr ||
+		!reflect.DeepEqual(table.Keys[0].fieldIndex, []int{1}) {
+		t.Errorf("Expected only the outer ID as key, got %v", table.Keys)
+	}
+	if table.version != nil {
+		t.Errorf("Expected no version column, got %v", table.version)
+	}
+	if len(table.Columns) != 3 {
+		t.Errorf("Expected the embedded columns to be shadowed, got %d columns", len(table.Columns))
+	}
+}
+
+type FKParent struct {
+	ID   int64
+	Name string
+}
+
+type FKChild struct {
+	ID       int64
+	ParentID int64
+	OwnerID  int64
+}
+
+func TestForeignKey(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap()
+	parent := dbmap.AddTableWithName(FKParent{}, "fk_parent_test").SetKeys(true, "ID")
+	child := dbmap.AddTableWithName(FKChild{}, "fk_child_test").SetKeys(true, "ID")
+	child.ColMap("ParentID").SetForeignKey(parent, "ID").SetOnDelete(FKCascade)
+	child.ColMap("OwnerID").SetForeignKey(parent, "id").SetOnDelete(FKRestrict).SetOnUpdate(FKSetNull)
+
+	sqls, err := dbmap.CreateTablesSql(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := dbmap.Dialect
+	for _, expected := range []string{
+		fmt.Sprintf("foreign key (%s) references %s (%s) on delete cascade",
+			d.QuoteField("parentid"), d.QuoteField("fk_parent_test"), d.QuoteField("id")),
+		fmt.Sprintf("foreign key (%s) references %s (%s) on delete restrict on update set null",
+			d.QuoteField("ownerid"), d.QuoteField("fk_parent_test"), d.QuoteField("id")),
+	} {
+		if !strings.Contains(sqls["fk_child_test"], expected) {
+			t.Errorf("Expected %q in %q", expected, sqls["fk_child_test"])
+		}
+	}
+	if strings.Contains(sqls["fk_parent_test"], "foreign key") {
+		t.Errorf("Unexpected foreign key in %q", sqls["fk_parent_test"])
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected a panic for an action without a foreign key")
+			}
+		}()
+		parent.ColMap("Name").SetOnDelete(FKCascade)
+	}()
+}
+
+type FKGrandChild struct {
+	ID      int64
+	ChildID int64
+}
+
+func TestTableOrder(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap()
+	// registered in reverse dependency order
+	grandchild := dbmap.AddTableWithName(FKGrandChild{}, "fk_grandchild_test").SetKeys(true, "ID")
+	child := dbmap.AddTableWithName(FKChild{}, "fk_child_test").SetKeys(true, "ID")
+	parent := dbmap.AddTableWithName(FKParent{}, "fk_parent_test").SetKeys(true, "ID")
+	grandchild.ColMap("ChildID").SetForeignKey(child, "ID").SetOnDelete(FKCascade)
+	child.ColMap("ParentID").SetForeignKey(parent, "ID").SetOnDelete(FKCascade)
+	child.ColMap("OwnerID").SetForeignKey(parent, "ID")
+
+	tables, err := dbmap.sortedTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tables, []*TableMap{parent, child, grandchild}) {
+		t.Errorf("Expected parents before children, got %v", tables)
+	}
+
+	err = dbmap.CreateTables(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup(ctx)
+
+	p := &FKParent{Name: "p"}
+	_insert(ctx, dbmap, p)
+	c := &FKChild{ParentID: p.ID, OwnerID: p.ID}
+	_insert(ctx, dbmap, c)
+	_insert(ctx, dbmap, &FKGrandChild{ChildID: c.ID})
+
+	if err = dbmap.TruncateTables(ctx); err != nil {
+		t.Error(err)
+	}
+	if err = dbmap.TruncateTablesCascade(ctx, true); err != nil {
+		t.Error(err)
+	}
+	var count int
+	err = dbmap.Dbx.Get(&count, "select count(*) from fk_child_test")
+	if err != nil || count != 0 {
+		t.Errorf("Expected truncated table, got %d, %v", count, err)
+	}
+
+	// referenced tables are truncated without cascading
+	p = &FKParent{Name: "p"}
+	_insert(ctx, dbmap, p)
+	c = &FKChild{ParentID: p.ID, OwnerID: p.ID}
+	_insert(ctx, dbmap, c)
+	_insert(ctx, dbmap, &FKGrandChild{ChildID: c.ID})
+	if err = dbmap.TruncateTablesIdentityRestart(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"fk_parent_test", "fk_child_test", "fk_grandchild_test"} {
+		err = dbmap.Dbx.Get(&count, "select count(*) from "+table)
+		if err != nil || count != 0 {
+			t.Errorf("Expected truncated table %s, got %d, %v", table, count, err)
+		}
+	}
+	p = &FKParent{Name: "p"}
+	_insert(ctx, dbmap, p)
+	if p.ID != 1 {
+		t.Errorf("Expected the identity to restart at 1, got %d", p.ID)
+	}
+
+	// a self reference does not constrain the order
+	parent.ColMap("ID").SetForeignKey(parent, "ID")
+	if _, err = dbmap.sortedTables(); err != nil {
+		t.Error(err)
+	}
+	parent.ColMap("ID").ForeignKey = nil
+
+	cyclic := newDbMap()
+	a := cyclic.AddTableWithName(FKChild{}, "fk_a_test").SetKeys(true, "ID")
+	b := cyclic.AddTableWithName(FKGrandChild{}, "fk_b_test").SetKeys(true, "ID")
+	a.ColMap("ParentID").SetForeignKey(b, "ID")
+	b.ColMap("ChildID").SetForeignKey(a, "ID")
+	if err = cyclic.CreateTables(ctx); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("Expected a cycle error, got %v", err)
+	}
+	if err = cyclic.DropTables(ctx); err == nil {
+		t.Errorf("Expected a cycle error from DropTables")
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap()
+	t1 := dbmap.AddTableWithName(Person{}, "person_test").SetKeys(true, "ID")
+	t1.AddIndex("person_test_name_idx", true, "FName", "LName")
+	t1.AddIndex("person_test_created_idx", false, "Created")
+
+	sqls, err := dbmap.CreateTablesSql(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := dbmap.Dialect
+	expected := fmt.Sprintf("create unique index %s on %s (%s, %s);",
+		d.QuoteField("person_test_name_idx"), d.QuoteField("person_test"),
+		d.QuoteField("fname"), d.QuoteField("lname"))
+	if !strings.Contains(sqls["person_test"], "\n"+expected) {
+		t.Errorf("Expected %q in %q", expected, sqls["person_test"])
+	}
+
+	err = dbmap.CreateTables(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup(ctx)
+
+	_insert(ctx, dbmap, &Person{FName: "bob", LName: "smith"})
+	err = dbmap.InsertContext(ctx, &Person{FName: "bob", LName: "smith"})
+	if err == nil {
+		t.Errorf("Expected composite unique index to be enforced")
+	}
+	_insert(ctx, dbmap, &Person{FName: "bob", LName: "jones"})
+
+	// AddIndex replaces an index of the same name
+	t1.AddIndex("person_test_created_idx", false, "Updated")
+	if len(t1.Indexes) != 2 || t1.Indexes[1].Columns[0] != t1.ColMap("Updated") {
+		t.Errorf("Expected index to be replaced, got %v", t1.Indexes)
+	}
+}
+
+func TestCreateIndexSql(t *testing.T) {
+	table := &TableMap{TableName: "t"}
+	a := &ColumnMap{ColumnName: "a", table: table}
+	b := &ColumnMap{ColumnName: "b", table: table}
+	table.Columns = []*ColumnMap{a, b}
+
+	plain := &IndexMap{IndexName: "i", Columns: []*ColumnMap{a, b}, table: table}
+	partial := &IndexMap{IndexName: "i", Unique: true, Columns: []*ColumnMap{a}, Where: "b is null", table: table}
+	method := &IndexMap{IndexName: "i", Columns: []*ColumnMap{a}, Method: "hash", table: table}
+
+	tests := []struct {
+		dialect     Dialect
+		idx         *IndexMap
+		ifNotExists bool
+		expected    string
+	}{
+		{SqliteDialect{}, plain, true, `create index if not exists "i" on "t" ("a", "b");`},
+		{SqliteDialect{}, partial, false, `create unique index "i" on "t" ("a") where b is null;`},
+		{SqliteDialect{}, method, false, ``},
+		{PostgresDialect{}, partial, false, `create unique index "i" on "t" ("a") where b is null;`},
+		{PostgresDialect{}, method, false, `create index "i" on "t" using hash ("a");`},
+		{MySQLDialect{}, plain, true, "create index `i` on `t` (`a`, `b`);"},
+		{MySQLDialect{}, partial, false, ``},
+		{MySQLDialect{}, method, false, "create index `i` on `t` (`a`) using hash;"},
+	}
+	for _, test := range tests {
+		sql := test.dialect.CreateIndexSql(test.idx, test.ifNotExists)
+		if sql != test.expected {
+			t.Errorf("%T: expected %q, got %q", test.dialect, test.expected, sql)
+		}
+	}
+}
+
+type ConstrainedRow struct {
+	ID      int64
+	Name    string
+	Nick    *string
+	Note    sql.NullString
+	Data    []byte
+	Created time.Time
+	Age     int64
+	Status  string
+}
+
+func TestColumnConstraints(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap()
+	t1 := dbmap.AddTableWithName(ConstrainedRow{}, "constrained_test").SetKeys(true, "ID")
+
+	for field, notNull := range map[string]bool{
+		"Name": true, "Nick": false, "Note": false, "Data": false, "Created": true, "Age": true,
+	} {
+		if c := t1.ColMap(field); c.NotNull != notNull {
+			t.Errorf("Expected %s to have NotNull=%v", field, notNull)
+		}
+	}
+	t1.ColMap("Age").SetCheck("age >= 0")
+	t1.ColMap("Status").SetDefault("'new'")
+	t1.ColMap("Nick").SetNotNull(true)
+
+	sqls, err := dbmap.CreateTablesSql(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := dbmap.Dialect
+	for _, expected := range []string{
+		d.QuoteField("age") + " " + d.ToSqlType(t1.ColMap("Age")) + " not null check (age >= 0)",
+		d.QuoteField("status") + " " + d.ToSqlType(t1.ColMap("Status")) + " not null default 'new'",
+		d.QuoteField("nick") + " " + d.ToSqlType(t1.ColMap("Nick")) + " not null",
+		d.QuoteField("note") + " " + d.ToSqlType(t1.ColMap("Note")) + ",",
+	} {
+		if !strings.Contains(sqls["constrained_test"], expected) {
+			t.Errorf("Expected %q in %q", expected, sqls["constrained_test"])
+		}
+	}
+
+	t1.ColMap("Nick").SetNotNull(false)
+	err = dbmap.CreateTables(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup(ctx)
+
+	_insert(ctx, dbmap, &ConstrainedRow{Name: "bob", Created: time.Now(), Age: 30})
+	err = dbmap.InsertContext(ctx, &ConstrainedRow{Name: "bob", Created: time.Now(), Age: -1})
+	if err == nil && dbmap.Dialect.DriverName() != "mysql" {
+		t.Errorf("Expected the check constraint to be enforced")
+	}
+
+	var status string
+	_, err = dbmap.ExecContext(ctx, fmt.Sprintf("insert into %s (%s, %s, %s) values (%s, %s, %s)",
+		d.QuoteField("constrained_test"), d.QuoteField("name"), d.QuoteField("created"), d.QuoteField("age"),
+		d.BindVar(0), d.BindVar(1), d.BindVar(2)), "alice", time.Now(), 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dbmap.Dbx.Get(&status, "select status from constrained_test where name='alice'")
+	if err != nil || status != "new" {
+		t.Errorf("Expected the default to be used, got %q, %v", status, err)
+	}
+}
+
+func TestInspectSchema(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap()
+	parent := dbmap.AddTableWithName(FKParent{}, "fk_parent_test").SetKeys(true, "ID")
+	child := dbmap.AddTableWithName(FKChild{}, "fk_child_test").SetKeys(true, "ID")
+	child.ColMap("ParentID").SetForeignKey(parent, "ID")
+	child.AddIndex("fk_child_test_owner_idx", true, "OwnerID", "ParentID")
+	parent.ColMap("Name").SetDefault("'x'")
+	err := dbmap.CreateTables(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup(ctx)
+
+	schema, err := dbmap.InspectSchema(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := schema.Table("fk_child_test")
+	if ts == nil || schema.Table("fk_parent_test") == nil {
+		t.Fatalf("Expected both tables in schema, got %v", schema.Tables)
+	}
+	var names []string
+	for _, c := range ts.Columns {
+		names = append(names, c.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"id", "parentid", "ownerid"}) {
+		t.Errorf("Unexpected columns %v", names)
+	}
+	if c := ts.Column("ownerid"); !c.NotNull || c.Type == "" {
+		t.Errorf("Expected a typed not null column, got %+v", c)
+	}
+	if !reflect.DeepEqual(ts.PrimaryKey, []string{"id"}) {
+		t.Errorf("Expected primary key id, got %v", ts.PrimaryKey)
+	}
+	var idx *IndexSchema
+	for _, i := range ts.Indexes {
+		if i.Name == "fk_child_test_owner_idx" {
+			idx = i
+		}
+	}
+	if idx == nil || !idx.Unique || !reflect.DeepEqual(idx.Columns, []string{"ownerid", "parentid"}) {
+		t.Errorf("Expected the unique index, got %v", ts.Indexes)
+	}
+	expectedFK := []*ForeignKeySchema{{Column: "parentid", RefTable: "fk_parent_test", RefColumn: "id"}}
+	if !reflect.DeepEqual(ts.ForeignKeys, expectedFK) {
+		t.Errorf("Expected foreign key, got %v", ts.ForeignKeys)
+	}
+	if c := schema.Table("fk_parent_test").Column("name"); !strings.Contains(c.Default, "x") {
+		t.Errorf("Expected a default, got %+v", c)
+	}
+}
+
+type PersonDrift struct {
+	ID      int64
+	Created string
+	Updated int64
+	FName   string
+	LName   string
+	Email   string
+}
+
+func TestValidate(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap()
+	dbmap.AddTableWithName(Person{}, "person_test").SetKeys(true, "ID")
+	err := dbmap.CreateTables(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup(ctx)
+
+	report, err := dbmap.Validate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Err() != nil {
+		t.Errorf("Expected the created schema to match, got %v", report)
+	}
+
+	drift := NewDbMap(dbmap.Db, dbmap.Dialect)
+	drift.AddTableWithName(PersonDrift{}, "person_test").SetKeys(false, "FName")
+	drift.AddTableWithName(Invoice{}, "invoice_test").SetKeys(true, "ID")
+	report, err = drift.Validate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &SchemaReport{
+		MissingTables:  []string{"invoice_test"},
+		MissingColumns: []ColumnDiff{{Table: "person_test", Column: "email"}},
+		ExtraColumns:   []ColumnDiff{{Table: "person_test", Column: "version"}},
+		TypeMismatches: []ColumnDiff{{Table: "person_test", Column: "created",
+			Expected: drift.Dialect.NormalizeType(drift.Dialect.ToSqlType(drift.TableFor(PersonDrift{}).ColMap("Created"))),
+			Actual:   drift.Dialect.NormalizeType(dbmap.Dialect.ToSqlType(dbmap.TableFor(Person{}).ColMap("Created")))}},
+		KeyMismatches: []KeyDiff{{Table: "person_test", Expected: []string{"fname"}, Actual: []string{"id"}}},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Expected report %v, got %v", expected, report)
+	}
+	if err := report.Err(); err == nil || !strings.Contains(err.Error(), "missing column person_test.email") {
+		t.Errorf("Expected an error listing differences, got %v", err)
+	}
+}
+
+func TestNormalizeType(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		a, b    string
+	}{
+		{SqliteDialect{}, "INTEGER", "integer"},
+		{PostgresDialect{}, "varchar(255)", "character varying(255)"},
+		{PostgresDialect{}, "bigserial", "bigint"},
+		{PostgresDialect{}, "timestamptz", "timestamp with time zone"},
+		{MySQLDialect{}, "bigint(20)", "bigint"},
+		{MySQLDialect{}, "boolean", "tinyint(1)"},
+		{MySQLDialect{}, "int(10) unsigned", "int unsigned"},
+	}
+	for _, test := range tests {
+		a, b := test.dialect.NormalizeType(test.a), test.dialect.NormalizeType(test.b)
+		if a != b {
+			t.Errorf("%T: expected %q and %q to match, got %q and %q", test.dialect, test.a, test.b, a, b)
+		}
+	}
+	if d := (MySQLDialect{}); d.NormalizeType("varchar(64)") == d.NormalizeType("varchar(32)") {
+		t.Errorf("Expected varchar sizes to differ")
+	}
+}
+
+func TestAlterTablesSql(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap()
+	dbmap.AddTableWithName(Person{}, "person_test").SetKeys(true, "ID")
+	err := dbmap.CreateTables(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup(ctx)
+	_, err = dbmap.ExecContext(ctx, "create table extra_test (id integer)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// not null columns can only be added to tables with rows with a default
+	_insert(ctx, dbmap, &Person{0, 0, 0, "bob", "smith", 0})
+
+	drift := NewDbMap(dbmap.Db, dbmap.Dialect)
+	person := drift.AddTableWithName(PersonDrift{}, "person_test").SetKeys(true, "ID")
+	person.AddIndex("person_test_email_idx", false, "Email")
+	drift.AddTableWithName(Invoice{}, "invoice_test").SetKeys(true, "ID")
+
+	changes, err := drift.AlterTablesSql(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var descs []string
+	for _, c := range changes {
+		descs = append(descs, c.Description)
+	}
+	d := drift.Dialect
+	expected := []string{
+		"create table invoice_test",
+		"add column person_test.email",
+		fmt.Sprintf("change type of person_test.created from %s to %s",
+			d.NormalizeType(d.ToSqlType(dbmap.TableFor(Person{}).ColMap("Created"))),
+			d.NormalizeType(d.ToSqlType(person.ColMap("Created")))),
+		"create index person_test_email_idx on person_test",
+		"drop column person_test.version",
+	}
+	if !reflect.DeepEqual(descs, expected) {
+		t.Errorf("Expected changes %v, got %v", expected, descs)
+	}
+	if len(changes.Safe()) != 3 {
+		t.Errorf("Expected 3 safe changes, got %v", changes.Safe())
+	}
+	if !strings.Contains(changes[1].Sql, "not null default ''") {
+		t.Errorf("Expected the zero value as default of the added column, got %s", changes[1].Sql)
+	}
+	for _, c := range changes {
+		destructive := strings.HasPrefix(c.Description, "change") || strings.HasPrefix(c.Description, "drop")
+		if c.Destructive != destructive {
+			t.Errorf("Unexpected destructive flag on %+v", c)
+		}
+	}
+
+	for _, stmt := range append(changes.Safe(), changes.Destructive()...) {
+		if _, err := drift.ExecContext(ctx, stmt); err != nil {
+			t.Fatalf("%s: %s", stmt, err)
+		}
+	}
+	drops, err := drift.DropUnmappedTablesSql(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drops) != 1 || drops[0].Description != "drop table extra_test" || !drops[0].Destructive {
+		t.Errorf("Expected to drop extra_test, got %v", drops)
+	}
+	drops, err = drift.DropUnmappedTablesSql(ctx, "extra_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drops) != 0 {
+		t.Errorf("Expected to keep extra_test, got %v", drops)
+	}
+	_, err = drift.ExecContext(ctx, "drop table extra_test")
+	if err != nil {
+		t.Error(err)
+	}
+
+	report, err := drift.Validate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report.TypeMismatches = nil
+	if !report.OK() {
+		t.Errorf("Expected the altered schema to match, got %v", report)
+	}
+	changes, err = drift.AlterTablesSql(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range changes {
+		if !strings.HasPrefix(c.Description, "change type") {
+			t.Errorf("Unexpected change after altering %+v", c)
+		}
+	}
+	_, err = drift.ExecContext(ctx, "drop table invoice_test")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAddColumnChange(t *testing.T) {
+	dbmap := NewDbMap(nil, SqliteDialect{})
+	table := dbmap.AddTable(ConstrainedRow{}).SetKeys(true, "ID")
+
+	if c := addColumnChange(table, table.ColMap("Age")); c.Destructive || !strings.Contains(c.Sql, `"age" integer not null default 0`) {
+		t.Errorf("Expected a zero default for a not null integer, got %+v", c)
+	}
+	if c := addColumnChange(table, table.ColMap("Nick")); c.Destructive || strings.Contains(c.Sql, "default") {
+		t.Errorf("Expected a nullable column to be added as is, got %+v", c)
+	}
+	if c := addColumnChange(table, table.ColMap("Created")); !c.Destructive {
+		t.Errorf("Expected a not null time without a default to need review, got %+v", c)
+	}
+}
+
+func TestMultiple(t *testing.T) {
+	ctx := context.Background()
+	dbmap := initDbMap(ctx)
+	defer dbmap.Cleanup(ctx)
+
+	inv1 := &Invoice{0, 100, 200, "a", 0, false}
+	inv2 := &Invoice{0, 100, 200, "b", 0, true}
+	_insert(ctx, dbmap, inv1, inv2)
+
+	inv1.Memo = "c"
+	inv2.Memo = "d"
+	_update(ctx, dbmap, inv1, inv2)
+
+	count := _del(ctx, dbmap, inv1, inv2)
+	if count != 2 {
+		t.Errorf("%d != 2", count)
+	}
+}
+
+func TestCrud(t *testing.T) {
+	ctx := context.Background()
+	dbmap := initDbMap(ctx)
+	defer dbmap.Cleanup(ctx)
+
+	inv := &Invoice{0, 100, 200, "first order", 0, true}
+
+	// INSERT row
+	_insert(ctx, dbmap, inv)
+	if inv.ID == 0 {
+		t.Errorf("inv.ID was not set on INSERT")
+		return
+	}
+
+	// SELECT row
+	inv2 := &Invoice{}
+	MustGet(ctx, dbmap, inv2, inv.ID)
+	if !reflect.DeepEqual(inv, inv2) {
+		t.Errorf("%v != %v", inv, inv2)
+	}
+
+	// UPDATE row and SELECT
+	inv.Memo = "second order"
+	inv.Created = 999
+	inv.Updated = 11111
+	count := _update(ctx, dbmap, inv)
+	if count != 1 {
+		t.Errorf("update 1 != %d", count)
+	}
+
+	MustGet(ctx, dbmap, inv2, inv.ID)
+	if !reflect.DeepEqual(inv, inv2) {
+		t.Errorf("%v != %v", inv, inv2)
+	}
+
+	// DELETE row
+	deleted := _del(ctx, dbmap, inv)
+	if deleted != 1 {
+		t.Errorf("Did not delete row with ID: %d", inv.ID)
+		return
+	}
+
+	// VERIFY deleted
+	err := dbmap.GetContext(ctx, inv2, inv.ID)
+	if err != sql.ErrNoRows {
+		t.Errorf("Found invoice with id: %d after Delete()", inv.ID)
+	}
+}
+
+func TestWithIgnoredColumn(t *testing.T) {
+	ctx := context.Background()
+	dbmap := initDbMap(ctx)
+	defer dbmap.Cleanup(ctx)
+
+	ic := &WithIgnoredColumn{-1, 0, 1}
+	_insert(ctx, dbmap, ic)
+	expected := &WithIgnoredColumn{0, 1, 1}
+
+	ic2 := &WithIgnoredColumn{}
+	MustGet(ctx, dbmap, ic2, ic.ID)
+
+	if !reflect.DeepEqual(expected, ic2) {
+		t.Errorf("%v != %v", expected, ic2)
+	}
+
+	if _del(ctx, dbmap, ic) != 1 {
+		t.Errorf("Did not delete row with ID: %d", ic.ID)
+		return
+	}
+
+	err := dbmap.GetContext(ctx, ic2, ic.ID)
+	if err != sql.ErrNoRows {
+		t.Errorf("Found id: %d after Delete() (%#v)", ic.ID, ic2)
+	}
+}
+
+func TestVersionMultipleRows(t *testing.T) {
+	ctx := context.Background()
+	dbmap := initDbMap(ctx)
+	defer dbmap.Cleanup(ctx)
+
+	persons := []*Person{
+		&Person{0, 0, 0, "Bob", "Smith", 0},
+		&Person{0, 0, 0, "Jane", "Smith", 0},
+		&Person{0, 0, 0, "Mike", "Smith", 0},
+	}
+
+	_insert(ctx, dbmap, persons[0], persons[1], persons[2])
+
+	for x, p := range persons {
+		if p.Version != 1 {
+			t.Errorf("person[%d].Version != 1: %d", x, p.Version)
+		}
+	}
+}
+
+func TestWithStringPk(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap()
+	//dbmap.TraceOn("", log.New(os.Stdout, "modltest: ", log.Lmicroseconds))
+	dbmap.AddTableWithName(WithStringPk{}, "string_pk_test").SetKeys(true, "ID")
+	_, err := dbmap.ExecContext(ctx, "create table string_pk_test (ID varchar(255), Name varchar(255));")
+	if err != nil {
+		t.Errorf("couldn't create string_pk_test: %v", err)
+	}
+	defer dbmap.Cleanup(ctx)
+
+	row := &WithStringPk{"1", "foo"}
+	err = dbmap.InsertContext(ctx, row)
+	if err == nil {
+		t.Errorf("Expected error when inserting into table w/non Int PK and autoincr set true")
+	}
+}
+
+func BenchmarkNativeCrud(b *testing.B) {
+	ctx := context.Background()
+	var err error
+
+	b.StopTimer()
+	dbmap := initDbMapBench(ctx)
+	defer dbmap.Cleanup(ctx)
+	b.StartTimer()
+
+	insert := "insert into invoice_test (date_created, updated, memo, personid) values (?, ?, ?, ?)"
+	sel := "select id, date_created, updated, memo, personid from invoice_test where id=?"
+	update := "update invoice_test set date_created=?, updated=?, memo=?, personid=? where id=?"
+	delete := "delete from invoice_test where id=?"
+
+	suffix := dbmap.Dialect.AutoIncrInsertSuffix(&ColumnMap{ColumnName: "id"})
+
+	insert = ReBind(insert, dbmap.Dialect) + suffix
+	sel = ReBind(sel, dbmap.Dialect)
+	update = ReBind(update, dbmap.Dialect)
+	delete = ReBind(delete, dbmap.Dialect)
+
+	inv := &Invoice{0, 100, 200, "my memo", 0, false}
+
+	for i := 0; i < b.N; i++ {
+		if len(suffix) == 0 {
+			res, err := dbmap.Db.Exec(insert, inv.Created, inv.Updated, inv.Memo, inv.PersonID)
+			if err != nil {
+				panic(err)
+			}
+
+			newid, err := res.LastInsertId()
+			if err != nil {
+				panic(err)
+			}
+			inv.ID = newid
+		} else {
+			rows, err := dbmap.Db.Query(insert, inv.Created, inv.Updated, inv.Memo, inv.PersonID)
+			if err != nil {
+				panic(err)
+			}
+
+			if rows.Next() {
+				err = rows.Scan(&inv.ID)
+				if err != nil {
+					panic(err)
+				}
+			}
+			rows.Close()
+
+		}
+
+		row := dbmap.Db.QueryRow(sel, inv.ID)
+		err = row.Scan(&inv.ID, &inv.Created, &inv.Updated, &inv.Memo, &inv.PersonID)
+		if err != nil {
+			panic(err)
+		}
+
+		inv.Created = 1000
+		inv.Updated = 2000
+		inv.Memo = "my memo 2"
+		inv.PersonID = 3000
+
+		_, err = dbmap.Db.Exec(update, inv.Created, inv.Updated, inv.Memo,
+			inv.PersonID, inv.ID)
+		if err != nil {
+			panic(err)
+		}
+
+		_, err = dbmap.Db.Exec(delete, inv.ID)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+}
+
+func BenchmarkModlCrud(b *testing.B) {
+	ctx := context.Background()
+	b.StopTimer()
+	dbmap := initDbMapBench(ctx)
+	defer dbmap.Cleanup(ctx)
+	//dbmap.TraceOn("", log.New(os.Stdout, "modltest: ", log.Lmicroseconds))
+	b.StartTimer()
+
+	inv := &Invoice{0, 100, 200, "my memo", 0, true}
+	for i := 0; i < b.N; i++ {
+		err := dbmap.InsertContext(ctx, inv)
+		if err != nil {
+			panic(err)
+		}
+
+		inv2 := Invoice{}
+		err = dbmap.GetContext(ctx, &inv2, inv.ID)
+		if err != nil {
+			panic(err)
+		}
+
+		inv2.Created = 1000
+		inv2.Updated = 2000
+		inv2.Memo = "my memo 2"
+		inv2.PersonID = 3000
+		_, err = dbmap.UpdateContext(ctx, &inv2)
+		if err != nil {
+			panic(err)
+		}
+
+		_, err = dbmap.DeleteContext(ctx, &inv2)
+		if err != nil {
+			panic(err)
+		}
+
+	}
+}
+
+func initDbMapBench(ctx context.Context) *DbMap {
+	dbmap := newDbMap()
+	dbmap.Db.Exec("drop table if exists invoice_test")
+	dbmap.AddTableWithName(Invoice{}, "invoice_test").SetKeys(true, "id")
+	err := dbmap.CreateTables(ctx)
+	if err != nil {
+		panic(err)
+	}
+	return dbmap
+}
+
+func (d *DbMap) Cleanup(ctx context.Context) {
+	err := d.DropTables(ctx)
+	if err != nil {
+		panic(err)
+	}
+	err = d.Dbx.Close()
+	if err != nil {
+		panic(err)
+	}
+}
+
+func initDbMap(ctx context.Context) *DbMap {
+	dbmap := newDbMap()
+	//dbmap.TraceOn("", log.New(os.Stdout, "modltest: ", log.Lmicroseconds))
+	dbmap.AddTableWithName(Invoice{}, "invoice_test").SetKeys(true, "id")
+	dbmap.AddTableWithName(Person{}, "person_test").SetKeys(true, "id")
+	dbmap.AddTableWithName(WithIgnoredColumn{}, "ignored_column_test").SetKeys(true, "id")
+	dbmap.AddTableWithName(WithTime{}, "time_test").SetKeys(true, "ID")
+	err := dbmap.CreateTables(ctx)
+	if err != nil {
+		panic(err)
+	}
+
+	return dbmap
+}
+
+func TestTruncateTables(t *testing.T) {
+	ctx := context.Background()
+	dbmap := initDbMap(ctx)
+	defer dbmap.Cleanup(ctx)
+	err := dbmap.CreateTablesIfNotExists(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Insert some data
+	p1 := &Person{0, 0, 0, "Bob", "Smith", 0}
+	dbmap.InsertContext(ctx, p1)
+	inv := &Invoice{0, 0, 1, "my invoice", 0, true}
+	dbmap.InsertContext(ctx, inv)
+
+	err = dbmap.TruncateTables(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Make sure all rows are deleted
+	people := []Person{}
+	invoices := []Invoice{}
+	dbmap.SelectContext(ctx, &people, "SELECT * FROM person_test")
+	if len(people) != 0 {
+		t.Errorf("Expected 0 person rows, got %d", len(people))
+	}
+	dbmap.SelectContext(ctx, &invoices, "SELECT * FROM invoice_test")
+	if len(invoices) != 0 {
+		t.Errorf("Expected 0 invoice rows, got %d", len(invoices))
+	}
+}
+
+func TestTruncateTablesIdentityRestart(t *testing.T) {
+	ctx := context.Background()
+	dbmap := initDbMap(ctx)
+	defer dbmap.Cleanup(ctx)
+	err := dbmap.CreateTablesIfNotExists(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Insert some data
+	p1 := &Person{0, 0, 0, "Bob", "Smith", 0}
+	dbmap.InsertContext(ctx, p1)
+	inv := &Invoice{0, 0, 1, "my invoice", 0, true}
+	dbmap.InsertContext(ctx, inv)
+
+	err = dbmap.TruncateTablesIdentityRestart(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Make sure all rows are deleted
+	people := []Person{}
+	invoices := []Invoice{}
+	dbmap.SelectContext(ctx, &people, "SELECT * FROM person_test")
+	if len(people) != 0 {
+		t.Errorf("Expected 0 person rows, got %d", len(people))
+	}
+	dbmap.SelectContext(ctx, &invoices, "SELECT * FROM invoice_test")
+	if len(invoices) != 0 {
+		t.Errorf("Expected 0 invoice rows, got %d", len(invoices))
+	}
+
+	p2 := &Person{0, 0, 0, "Other", "Person", 0}
+	dbmap.InsertContext(ctx, p2)
+	if p2.ID != int64(1) {
+		t.Errorf("Expected new person ID to be equal to 1, was %d", p2.ID)
+	}
+}
+
+func TestSelectBehavior(t *testing.T) {
+	ctx := context.Background()
+	db := initDbMap(ctx)
+	defer db.Cleanup(ctx)
+
+	p := Person{}
+
+	// check that SelectOne with no rows returns ErrNoRows
+	err := db.SelectOneContext(ctx, &p, "select * from person_test")
+	if err == nil || err != sql.ErrNoRows {
+		t.Fatal(err)
+	}
+
+	// insert and ensure SelectOne works properly
+	bob := Person{0, 0, 0, "Bob", "Smith", 0}
+	db.InsertContext(ctx, &bob)
+
+	err = db.SelectOneContext(ctx, &p, "select * from person_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.FName != "Bob" {
+		t.Errorf("Wrong FName: %s", p.FName)
+	}
+	// there's a post hook on this that sets it to postget, ensure it ran
+	if p.LName != "postget" {
+		t.Errorf("Wrong LName: %s", p.LName)
+	}
+
+	// insert again and ensure SelectOne *does not* error in rows > 1
+	ben := Person{0, 0, 0, "Ben", "Smith", 0}
+	db.InsertContext(ctx, &ben)
+
+	err = db.SelectOneContext(ctx, &p, "select * from person_test ORDER BY fname ASC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.FName != "Ben" {
+		t.Errorf("Wrong FName: %s", p.FName)
+	}
+}
+
+func TestQuoteTableNames(t *testing.T) {
+	ctx := context.Background()
+	dbmap := initDbMap(ctx)
+	defer dbmap.Cleanup(ctx)
+
+	quotedTableName := dbmap.Dialect.QuoteField("person_test")
+
+	// Use a buffer to hold the log to check generated queries
+	var logBuffer bytes.Buffer
+	dbmap.TraceOn("", log.New(&logBuffer, "modltest:", log.Lmicroseconds))
+
+	// Create some rows
+	p1 := &Person{0, 0, 0, "bob", "smith", 0}
+	errorTemplate := "Expected quoted table name %v in query but didn't find it"
+
+	// Check if Insert quotes the table name
+	id := dbmap.InsertContext(ctx, p1)
+	if !bytes.Contains(logBuffer.Bytes(), []byte(quotedTableName)) {
+		t.Log("log:", logBuffer.String())
+		t.Errorf(errorTemplate, quotedTableName)
+	}
+	logBuffer.Reset()
+
+	// Check if Get quotes the table name
+	dbmap.GetContext(ctx, Person{}, id)
+	if !bytes.Contains(logBuffer.Bytes(), []byte(quotedTableName)) {
+		t.Errorf(errorTemplate, quotedTableName)
+	}
+	logBuffer.Reset()
+}
+
+func TestSchemaName(t *testing.T) {
+	ctx := context.Background()
+	dbmap := newDbMap()
+	// use the default schema under its explicit name, so that qualified
+	// statements run without creating a schema
+	switch dbmap.Dialect.(type) {
+	case SqliteDialect:
+		dbmap.SchemaName = "main"
+	case PostgresDialect:
+		dbmap.SchemaName = "public"
+	case MySQLDialect:
+		if err := dbmap.Dbx.Get(&dbmap.SchemaName, "select database()"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dbmap.TablePrefix = "app_"
+	table := dbmap.AddTableWithName(Invoice{}, "invoice_test").SetKeys(true, "id")
+	table.AddIndex("invoice_memo_idx", false, "Memo")
+	if table.TableName != "app_invoice_test" || table.SchemaName != dbmap.SchemaName {
+		t.Fatalf("Expected the prefix and schema to be applied, got %s.%s", table.SchemaName, table.TableName)
+	}
+	if err := dbmap.CreateTables(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer dbmap.Cleanup(ctx)
+
+	var logBuffer bytes.Buffer
+	dbmap.TraceOn("", log.New(&logBuffer, "modltest:", log.Lmicroseconds))
+	quoted := dbmap.Dialect.QuotedTableForQuery(dbmap.SchemaName, "app_invoice_test")
+
+	inv := &Invoice{0, 100, 200, "first order", 0, false}
+	_insert(ctx, dbmap, inv)
+	obj := &Invoice{}
+	if err := dbmap.GetContext(ctx, obj, inv.ID); err != nil || obj.Memo != inv.Memo {
+		t.Errorf("Expected to get %v, got %v, %v", inv, obj, err)
+	}
+	inv.Memo = "second order"
+	if count := _update(ctx, dbmap, inv); count != 1 {
+		t.Errorf("Expected 1 row updated, got %d", count)
+	}
+	if count := _del(ctx, dbmap, inv); count != 1 {
+		t.Errorf("Expected 1 row deleted, got %d", count)
+	}
+	if err := dbmap.TruncateTablesIdentityRestart(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{"insert into", "from", "update", "delete from"} {
+		if !strings.Contains(logBuffer.String(), stmt+" "+quoted) {
+			t.Errorf("Expected %q in queries:\n%s", stmt+" "+quoted, logBuffer.String())
+		}
+	}
+	// schema inspection looks the table up in its schema
+	report, err := dbmap.Validate(ctx)
+	if err != nil || report.Err() != nil {
+		t.Errorf("Expected a schema-qualified table to validate, got %v, %v", report, err)
+	}
+	changes, err := dbmap.AlterTablesSql(ctx)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("Expected no changes to a schema-qualified table, got %v, %v", changes, err)
+	}
+	missing := NewDbMap(dbmap.Db, dbmap.Dialect)
+	missing.SchemaName = dbmap.SchemaName
+	missing.AddTableWithName(Person{}, "missing_test").SetKeys(true, "id")
+	if report, err = missing.Validate(ctx); err != nil || !reflect.DeepEqual(report.MissingTables, []string{"missing_test"}) {
+		t.Errorf("Expected a missing schema-qualified table reported, got %v, %v", report, err)
+	}
+
+	other := NewDbMap(nil, PostgresDialect{})
+	other.AddTableWithNameAndSchema(Invoice{}, "billing", "invoice").SetKeys(true, "id").
+		AddIndex("invoice_memo_idx", false, "Memo")
+	ddl, err := other.CreateTablesSql(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`create table "billing"."invoice" (`,
+		`create index "invoice_memo_idx" on "billing"."invoice" ("memo");`,
+	} {
+		if !strings.Contains(ddl["invoice"], expected) {
+			t.Errorf("Expected %q in:\n%s", expected, ddl["invoice"])
+		}
+	}
+	idx := &IndexMap{IndexName: "i", Columns: table.Keys, table: table}
+	table.SchemaName = "aux"
+	if sql := (SqliteDialect{}).CreateIndexSql(idx, false); sql != `create index "aux"."i" on "app_invoice_test" ("id");` {
+		t.Errorf("Expected sqlite to qualify the index name, got %s", sql)
+	}
+	table.SchemaName = dbmap.SchemaName
+}
+
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	dbmap := initDbMap(ctx)
+	defer dbmap.Cleanup(ctx)
+
+	alice := &Person{0, 0, 0, "alice", "a", 0}
+	bob := &Person{0, 0, 0, "bob", "b", 0}
+	carol := &Person{0, 0, 0, "carol", "c", 0}
+	_insert(ctx, dbmap, alice, bob, carol)
+	_insert(ctx, dbmap,
+		&Invoice{0, 100, 0, "first", bob.ID, false},
+		&Invoice{0, 200, 0, "second", bob.ID, true},
+		&Invoice{0, 300, 0, "third", carol.ID, false})
+
+	persons := dbmap.TableFor(Person{})
+	invoices := dbmap.TableFor(Invoice{})
+
+	var people []*Person
+	err := persons.Query().OrderBy("FName desc").Limit(2).Offset(1).Select(ctx, dbmap, &people)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(people) != 2 || people[0].FName != "bob" || people[1].FName != "alice" {
+		t.Errorf("Expected bob and alice, got %v", people)
+	} else if people[0].LName != "postget" {
+		t.Errorf("Expected PostGet to run, got %v", people[0])
+	}
+
+	var invs []Invoice
+	err = invoices.Query().
+		Join(persons, "personid", "id").
+		Where("person_test.fname", "=", "bob").
+		Where("IsPaid", "=", false).
+		Select(ctx, dbmap, &invs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invs) != 1 || invs[0].Memo != "first" {
+		t.Errorf("Expected bob's unpaid invoice, got %v", invs)
+	}
+
+	people = nil
+	err = persons.Query().
+		Join(invoices, "id", "PersonID").
+		Where("date_created", ">", 50).
+		GroupBy("id").
+		OrderBy("fname").
+		Select(ctx, dbmap, &people)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(people) != 2 || people[0].FName != "bob" || people[1].FName != "carol" {
+		t.Errorf("Expected bob and carol once each, got %v", people)
+	}
+
+	people = nil
+	err = persons.Query().Where("id", "in", []int64{alice.ID, carol.ID}).WhereSql("fname <> ?", "carol").Select(ctx, dbmap, &people)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(people) != 1 || people[0].ID != alice.ID {
+		t.Errorf("Expected alice, got %v", people)
+	}
+
+	p := &Person{}
+	if err = persons.Query().Where("lname", "is not null").OrderBy("id desc").SelectOne(ctx, dbmap, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != carol.ID || p.LName != "postget" {
+		t.Errorf("Expected carol, got %v", p)
+	}
+}
+
+func TestUpdateDeleteWhere(t *testing.T) {
+	ctx := context.Background()
+	dbmap := initDbMap(ctx)
+	defer dbmap.Cleanup(ctx)
+
+	bob := &Person{0, 0, 0, "bob", "b", 0}
+	carol := &Person{0, 0, 0, "carol", "c", 0}
+	_insert(ctx, dbmap, bob, carol)
+	_insert(ctx, dbmap,
+		&Invoice{0, 100, 0, "first", bob.ID, false},
+		&Invoice{0, 200, 0, "second", bob.ID, false},
+		&Invoice{0, 300, 0, "third", carol.ID, false})
+
+	count, err := dbmap.UpdateWhere(ctx, &Invoice{}, map[string]interface{}{"IsPaid": true, "updated": 400},
+		"personid = ?", bob.ID)
+	if err != nil || count != 2 {
+		t.Fatalf("Expected 2 invoices updated, got %d, %v", count, err)
+	}
+	var paid int
+	if err := dbmap.Dbx.Get(&paid, "select count(*) from invoice_test where ispaid = "+dbmap.Dialect.BindVar(0)+" and updated = 400", true); err != nil || paid != 2 {
+		t.Errorf("Expected 2 paid invoices, got %d, %v", paid, err)
+	}
+
+	// the version is left alone by default
+	count, err = dbmap.UpdateWhere(ctx, Person{}, map[string]interface{}{"lname": "unversioned"}, "fname = ?", "bob")
+	if err != nil || count != 1 {
+		t.Fatalf("Expected 1 person updated, got %d, %v", count, err)
+	}
+	var lname string
+	if err := dbmap.Dbx.Get(&lname, "select lname from person_test where id = "+dbmap.Dialect.BindVar(0), bob.ID); err != nil || lname != "unversioned" {
+		t.Errorf("Expected the name changed, got %q, %v", lname, err)
+	}
+	p := &Person{}
+	MustGet(ctx, dbmap, p, bob.ID)
+	if p.Version != bob.Version {
+		t.Errorf("Expected version %d, got %d", bob.Version, p.Version)
+	}
+	if _, err := dbmap.UpdateWhere(ctx, &Person{}, nil, ""); err == nil {
+		t.Errorf("Expected an error updating no columns without bumping the version")
+	}
+
+	// UpdateWhereVersioned bumps it, so a copy loaded before fails its lock
+	// check
+	tx, err := dbmap.BeginContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err = tx.UpdateWhereVersioned(ctx, Person{}, map[string]interface{}{"lname": "renamed"}, "fname in (?, ?)", "bob", "carol")
+	if err != nil || count != 2 {
+		t.Fatalf("Expected 2 persons updated, got %d, %v", count, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	MustGet(ctx, dbmap, p, bob.ID)
+	if p.Version != bob.Version+1 {
+		t.Errorf("Expected version %d, got %d", bob.Version+1, p.Version)
+	}
+	if _, err := dbmap.UpdateContext(ctx, bob); err == nil {
+		t.Errorf("Expected an OptimisticLockError for a stale copy")
+	} else if _, ok := err.(OptimisticLockError); !ok {
+		t.Errorf("Expected an OptimisticLockError, got %v", err)
+	}
+
+	for _, set := range []map[string]interface{}{
+		{"nope": 1},
+		{"id": 1},
+		{"version": 2},
+	} {
+		if _, err := dbmap.UpdateWhere(ctx, &Person{}, set, ""); err == nil {
+			t.Errorf("Expected an error updating %v", set)
+		}
+	}
+	if _, err := dbmap.UpdateWhere(ctx, &Invoice{}, nil, ""); err == nil {
+		t.Errorf("Expected an error updating no columns")
+	}
+	count, err = dbmap.UpdateWhereVersioned(ctx, &Person{}, nil, "id = ?", carol.ID)
+	if err != nil || count != 1 {
+		t.Errorf("Expected only the version of 1 person bumped, got %d, %v", count, err)
+	}
+
+	count, err = dbmap.DeleteWhere(ctx, &Invoice{}, "ispaid = ?", true)
+	if err != nil || count != 2 {
+		t.Errorf("Expected 2 invoices deleted, got %d, %v", count, err)
+	}
+	count, err = dbmap.DeleteWhere(ctx, &Invoice{}, "")
+	if err != nil || count != 1 {
+		t.Errorf("Expected the last invoice deleted, got %d, %v", count, err)
+	}
+}
+
+func TestUpdateWhereSql(t *testing.T) {
+	dbmap := NewDbMap(nil, PostgresDialect{})
+	table := dbmap.AddTableWithName(Person{}, "person_test").SetKeys(true, "id")
+	table.SetVersionCol("Version")
+
+	for bump, expected := range map[bool]string{
+		false: `update "person_test" set "lname"=$1, "fname"=$2 where id > $3 and lname <> '?';`,
+		true:  `update "person_test" set "lname"=$1, "fname"=$2, "version"="version"+1 where id > $3 and lname <> '?';`,
+	} {
+		query, args, err := table.updateWhereSql(map[string]interface{}{"LName": "x", "fname": "y"}, "id > ? and lname <> '?'", bump)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query != expected {
+			t.Errorf("Expected %s, got %s", expected, query)
+		}
+		if !reflect.DeepEqual(args, []interface{}{"x", "y"}) {
+			t.Errorf("Unexpected args %v", args)
 		}
 	}
+	query, _, err := table.updateWhereSql(nil, "", true)
+	if expected := `update "person_test" set "version"="version"+1;`; err != nil || query != expected {
+		t.Errorf("Expected %s, got %s, %v", expected, query, err)
+	}
+	if query := table.deleteWhereSql("id = ?"); query != `delete from "person_test" where id = $1;` {
+		t.Errorf("Unexpected delete %s", query)
+	}
+}
 
+func TestReBind(t *testing.T) {
+	query := `select * from t where a = ? and b = '?' and "c?" = ? and d = 'it''s?'`
+	expected := `select * from t where a = $1 and b = '?' and "c?" = $2 and d = 'it''s?'`
+	if got := ReBind(query, PostgresDialect{}); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+	if got := ReBind(query, SqliteDialect{}); got != query {
+		t.Errorf("Expected %s unchanged, got %s", query, got)
+	}
 }
 
-func BenchmarkModlCrud(b *testing.B) {
+func TestGetMany(t *testing.T) {
 	ctx := context.Background()
-	b.StopTimer()
-	dbmap := initDbMapBench(ctx)
+	dbmap := initDbMap(ctx)
+	dbmap.AddTable(InvoicePersonView{}).SetKeys(false, "invoiceid", "personid")
+	if err := dbmap.CreateTablesIfNotExists(ctx); err != nil {
+		t.Fatal(err)
+	}
 	defer dbmap.Cleanup(ctx)
-	//dbmap.TraceOn("", log.New(os.Stdout, "modltest: ", log.Lmicroseconds))
-	b.StartTimer()
-
-	inv := &Invoice{0, 100, 200, "my memo", 0, true}
-	for i := 0; i < b.N; i++ {
-		err := dbmap.InsertContext(ctx, inv)
-		if err != nil {
-			panic(err)
-		}
 
-		inv2 := Invoice{}
-		err = dbmap.GetContext(ctx, &inv2, inv.ID)
-		if err != nil {
-			panic(err)
-		}
+	var ids []int64
+	for _, name := range []string{"alice", "bob", "carol"} {
+		p := &Person{0, 0, 0, name, "", 0}
+		_insert(ctx, dbmap, p)
+		ids = append(ids, p.ID)
+	}
 
-		inv2.Created = 1000
-		inv2.Updated = 2000
-		inv2.Memo = "my memo 2"
-		inv2.PersonID = 3000
-		_, err = dbmap.UpdateContext(ctx, &inv2)
-		if err != nil {
-			panic(err)
+	var persons []*Person
+	missing, err := dbmap.GetManyContext(ctx, &persons, []int64{ids[2], ids[0], 999999})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(persons) != 2 {
+		t.Fatalf("Expected 2 persons, got %v", persons)
+	}
+	for _, p := range persons {
+		if p.ID != ids[0] && p.ID != ids[2] || p.LName != "postget" {
+			t.Errorf("Unexpected person or PostGet didn't run: %v", p)
 		}
+	}
+	if !reflect.DeepEqual(missing, []interface{}{int64(999999)}) {
+		t.Errorf("Expected key 999999 to be missing, got %v", missing)
+	}
 
-		_, err = dbmap.DeleteContext(ctx, &inv2)
-		if err != nil {
-			panic(err)
+	// enough keys to need two statements on every dialect
+	var logBuffer bytes.Buffer
+	dbmap.TraceOn("", log.New(&logBuffer, "modltest:", 0))
+	keys := make([]int, dbmap.Dialect.MaxBindVars()+10)
+	for i := range keys {
+		keys[i] = int(ids[0]) + i
+	}
+	var many []Person
+	missing, err = dbmap.GetManyContext(ctx, &many, keys)
+	dbmap.TraceOff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selects := strings.Count(logBuffer.String(), "select "); selects != 2 {
+		t.Errorf("Expected 2 select statements, got %d", selects)
+	}
+	if len(many) != 3 || len(missing) != len(keys)-3 {
+		t.Errorf("Expected 3 persons found and the rest missing, got %d and %d", len(many), len(missing))
+	}
+	for _, p := range many {
+		if p.LName != "postget" {
+			t.Errorf("PostGet didn't run on a slice of values: %v", p)
 		}
-
 	}
-}
 
-func initDbMapBench(ctx context.Context) *DbMap {
-	dbmap := newDbMap()
-	dbmap.Db.Exec("drop table if exists invoice_test")
-	dbmap.AddTableWithName(Invoice{}, "invoice_test").SetKeys(true, "id")
-	err := dbmap.CreateTables(ctx)
+	ipvs := []*InvoicePersonView{{1, 2, "a", "x", 0}, {1, 3, "b", "y", 0}, {2, 2, "c", "z", 0}}
+	for _, ipv := range ipvs {
+		_insert(ctx, dbmap, ipv)
+	}
+	var views []InvoicePersonView
+	missing, err = dbmap.GetManyContext(ctx, &views, [][]interface{}{{1, 3}, {2, 2}, {2, 3}})
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
+	}
+	if len(views) != 2 || views[0].Memo == "a" || views[1].Memo == "a" {
+		t.Errorf("Expected views b and c, got %v", views)
+	}
+	if !reflect.DeepEqual(missing, []interface{}{[]interface{}{2, 3}}) {
+		t.Errorf("Expected key (2, 3) to be missing, got %v", missing)
 	}
-	return dbmap
-}
 
-func (d *DbMap) Cleanup(ctx context.Context) {
-	err := d.DropTables(ctx)
-	if err != nil {
-		panic(err)
+	if _, err := dbmap.GetManyContext(ctx, &views, [][]interface{}{{1}}); err == nil {
+		t.Errorf("Expected an error for a partial composite key")
 	}
-	err = d.Dbx.Close()
-	if err != nil {
-		panic(err)
+	if _, err := dbmap.GetManyContext(ctx, &views, 1); err == nil {
+		t.Errorf("Expected an error for keys which are not a slice")
 	}
-}
 
-func initDbMap(ctx context.Context) *DbMap {
-	dbmap := newDbMap()
-	//dbmap.TraceOn("", log.New(os.Stdout, "modltest: ", log.Lmicroseconds))
-	dbmap.AddTableWithName(Invoice{}, "invoice_test").SetKeys(true, "id")
-	dbmap.AddTableWithName(Person{}, "person_test").SetKeys(true, "id")
-	dbmap.AddTableWithName(WithIgnoredColumn{}, "ignored_column_test").SetKeys(true, "id")
-	dbmap.AddTableWithName(WithTime{}, "time_test").SetKeys(true, "ID")
-	err := dbmap.CreateTables(ctx)
+	// keys of other types than a pointer key field are found by value
+	dbmap.AddTableWithName(PtrKeyRow{}, "ptr_key_test").SetKeys(false, "ID")
+	if err := dbmap.CreateTablesIfNotExists(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{1, 2} {
+		id := id
+		_insert(ctx, dbmap, &PtrKeyRow{ID: &id, Name: fmt.Sprint(id)})
+	}
+	var rows []PtrKeyRow
+	two := int64(2)
+	missing, err = dbmap.GetManyContext(ctx, &rows, []interface{}{1, &two, int32(3)})
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
+	if len(rows) != 2 || !reflect.DeepEqual(missing, []interface{}{int32(3)}) {
+		t.Errorf("Expected rows 1 and 2 and key 3 missing, got %v and %v", rows, missing)
+	}
+}
 
-	return dbmap
+type PtrKeyRow struct {
+	ID   *int64
+	Name string
 }
 
-func TestTruncateTables(t *testing.T) {
+func TestBatchUpdateDelete(t *testing.T) {
 	ctx := context.Background()
 	dbmap := initDbMap(ctx)
 	defer dbmap.Cleanup(ctx)
-	err := dbmap.CreateTablesIfNotExists(ctx)
-	if err != nil {
-		t.Error(err)
+
+	var persons []*Person
+	var invoices []*Invoice
+	for i := 0; i < 3; i++ {
+		p := &Person{0, 0, 0, fmt.Sprintf("p%d", i), "", 0}
+		inv := &Invoice{0, int64(i), 0, fmt.Sprintf("memo %d", i), 0, false}
+		_insert(ctx, dbmap, p, inv)
+		persons = append(persons, p)
+		invoices = append(invoices, inv)
 	}
 
-	// Insert some data
-	p1 := &Person{0, 0, 0, "Bob", "Smith", 0}
-	dbmap.InsertContext(ctx, p1)
-	inv := &Invoice{0, 0, 1, "my invoice", 0, true}
-	dbmap.InsertContext(ctx, inv)
+	var logBuffer bytes.Buffer
+	dbmap.TraceOn("", log.New(&logBuffer, "modltest:", 0))
+	for i, inv := range invoices {
+		inv.Memo = fmt.Sprintf("updated %d", i)
+		inv.IsPaid = i%2 == 0
+	}
+	count, err := dbmap.UpdateBatchContext(ctx, invoices[0], invoices[1], invoices[2])
+	dbmap.TraceOff()
+	if err != nil || count != 3 {
+		t.Fatalf("Expected 3 invoices updated, got %d, %v", count, err)
+	}
+	if updates := strings.Count(logBuffer.String(), "update "); updates != 1 {
+		t.Errorf("Expected a single update statement, got %d:\n%s", updates, logBuffer.String())
+	}
+	for _, inv := range invoices {
+		inv2 := &Invoice{}
+		MustGet(ctx, dbmap, inv2, inv.ID)
+		if !reflect.DeepEqual(inv, inv2) {
+			t.Errorf("%v != %v", inv, inv2)
+		}
+	}
 
-	err = dbmap.TruncateTables(ctx)
-	if err != nil {
-		t.Error(err)
+	count, err = dbmap.UpdateBatchContext(ctx, persons[0], persons[1], persons[2])
+	if err != nil || count != 3 {
+		t.Fatalf("Expected 3 persons updated, got %d, %v", count, err)
+	}
+	for _, p := range persons {
+		p2 := &Person{}
+		MustGet(ctx, dbmap, p2, p.ID)
+		if p.LName != "postupdate" || p.Version != 2 || p2.FName != "preupdate" || p2.Version != 2 {
+			t.Errorf("Expected hooks to run and the version to be bumped, got %v and %v", p, p2)
+		}
 	}
 
-	// Make sure all rows are deleted
-	people := []Person{}
-	invoices := []Invoice{}
-	dbmap.SelectContext(ctx, &people, "SELECT * FROM person_test")
-	if len(people) != 0 {
-		t.Errorf("Expected 0 person rows, got %d", len(people))
+	// a stale copy fails the whole batch, with an error for its row
+	stale := *persons[1]
+	_update(ctx, dbmap, persons[1])
+	_, err = dbmap.UpdateBatchContext(ctx, persons[0], &stale)
+	lockErrs, ok := err.(OptimisticLockErrors)
+	if !ok || len(lockErrs) != 1 || !lockErrs[0].RowExists || lockErrs[0].Keys[0] != stale.ID {
+		t.Errorf("Expected an OptimisticLockErrors for the stale row, got %v", err)
 	}
-	dbmap.SelectContext(ctx, &invoices, "SELECT * FROM invoice_test")
-	if len(invoices) != 0 {
-		t.Errorf("Expected 0 invoice rows, got %d", len(invoices))
+	p2 := &Person{}
+	MustGet(ctx, dbmap, p2, persons[0].ID)
+	if p2.Version != persons[0].Version {
+		t.Errorf("Expected the batch to be left untouched, got version %d", p2.Version)
+	}
+	if _, err = dbmap.DeleteBatchContext(ctx, &stale); err == nil {
+		t.Errorf("Expected a lock error deleting a stale row")
+	}
+
+	// a row listed twice is refused before any hook runs
+	dup := *persons[0]
+	dup.FName = "dup"
+	_, err = dbmap.UpdateBatchContext(ctx, persons[0], &dup)
+	if err == nil || !strings.Contains(err.Error(), "more than once") || dup.FName != "dup" {
+		t.Errorf("Expected an error for a duplicate row, got %v", err)
+	}
+	if _, err = dbmap.DeleteBatchContext(ctx, persons[0], &dup); err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Errorf("Expected an error for a duplicate row, got %v", err)
+	}
+
+	list := []interface{}{persons[0], persons[1], persons[2], invoices[0], invoices[1]}
+	count, err = dbmap.DeleteBatchContext(ctx, list...)
+	if err != nil || count != 5 {
+		t.Fatalf("Expected 5 rows deleted, got %d, %v", count, err)
+	}
+	for _, p := range persons {
+		if p.FName != "predelete" || p.LName != "postdelete" {
+			t.Errorf("Expected delete hooks to run, got %v", p)
+		}
+	}
+	var left int
+	if err := dbmap.Dbx.Get(&left, "select count(*) from invoice_test"); err != nil || left != 1 {
+		t.Errorf("Expected one invoice left, got %d, %v", left, err)
+	}
+	_, err = dbmap.DeleteBatchContext(ctx, persons[0])
+	if lockErrs, ok := err.(OptimisticLockErrors); !ok || lockErrs[0].RowExists {
+		t.Errorf("Expected a lock error for a deleted row, got %v", err)
+	}
+
+	// a table of only keys has nothing to update
+	dbmap.AddTableWithName(KeyOnlyRow{}, "key_only_test").SetKeys(false, "PersonID", "InvoiceID")
+	if err = dbmap.CreateTablesIfNotExists(ctx); err != nil {
+		t.Fatal(err)
+	}
+	row := &KeyOnlyRow{PersonID: 1, InvoiceID: 2}
+	_insert(ctx, dbmap, row)
+	count, err = dbmap.UpdateBatchContext(ctx, row)
+	if err != nil || count != 0 {
+		t.Errorf("Expected nothing updated in a table of only keys, got %d, %v", count, err)
+	}
+	if !reflect.DeepEqual(row.Hooks, []string{"preupdate", "postupdate"}) {
+		t.Errorf("Expected the update hooks to run on a table of only keys, got %v", row.Hooks)
+	}
+
+	// pointer keys are compared by value in version checks
+	dbmap.AddTableWithName(PtrKeyVersionRow{}, "ptr_key_version_test").SetKeys(false, "ID")
+	if err = dbmap.CreateTablesIfNotExists(ctx); err != nil {
+		t.Fatal(err)
+	}
+	id := int64(1)
+	pk := &PtrKeyVersionRow{ID: &id, Name: "a"}
+	_insert(ctx, dbmap, pk)
+	pk.Name = "b"
+	count, err = dbmap.UpdateBatchContext(ctx, pk)
+	if err != nil || count != 1 {
+		t.Errorf("Expected a row with a pointer key updated, got %d, %v", count, err)
+	}
+	same := int64(1)
+	if _, err = dbmap.UpdateBatchContext(ctx, pk, &PtrKeyVersionRow{ID: &same, Version: pk.Version}); err == nil {
+		t.Errorf("Expected an error for a duplicate pointer key")
 	}
 }
 
-func TestTruncateTablesIdentityRestart(t *testing.T) {
+func TestBatchConcurrentChange(t *testing.T) {
 	ctx := context.Background()
 	dbmap := initDbMap(ctx)
 	defer dbmap.Cleanup(ctx)
-	err := dbmap.CreateTablesIfNotExists(ctx)
-	if err != nil {
-		t.Error(err)
-	}
 
-	// Insert some data
-	p1 := &Person{0, 0, 0, "Bob", "Smith", 0}
-	dbmap.InsertContext(ctx, p1)
-	inv := &Invoice{0, 0, 1, "my invoice", 0, true}
-	dbmap.InsertContext(ctx, inv)
+	var persons []*Person
+	for i := 0; i < 3; i++ {
+		p := &Person{0, 0, 0, fmt.Sprintf("p%d", i), "", 0}
+		_insert(ctx, dbmap, p)
+		persons = append(persons, p)
+	}
 
-	err = dbmap.TruncateTablesIdentityRestart(ctx)
-	if err != nil {
-		t.Error(err)
+	// a row changed between the version check and the statement is
+	// reported by a lock error of its own
+	racer := &racingExecutor{dbmap, func() {
+		dbmap.Dbx.MustExec(dbmap.Dbx.Rebind("delete from person_test where id = ?"), persons[0].ID)
+	}}
+	_, err := updateBatch(ctx, dbmap, racer, persons[0], persons[2])
+	lockErrs, ok := err.(OptimisticLockErrors)
+	if !ok || len(lockErrs) != 1 || lockErrs[0].RowExists || lockErrs[0].Keys[0] != persons[0].ID {
+		t.Errorf("Expected an OptimisticLockErrors for the row deleted concurrently, got %v", err)
 	}
 
-	// Make sure all rows are deleted
-	people := []Person{}
-	invoices := []Invoice{}
-	dbmap.SelectContext(ctx, &people, "SELECT * FROM person_test")
-	if len(people) != 0 {
-		t.Errorf("Expected 0 person rows, got %d", len(people))
+	MustGet(ctx, dbmap, persons[2], persons[2].ID)
+	racer.race = func() {
+		dbmap.Dbx.MustExec(dbmap.Dbx.Rebind("update person_test set version = version + 1 where id = ?"), persons[1].ID)
 	}
-	dbmap.SelectContext(ctx, &invoices, "SELECT * FROM invoice_test")
-	if len(invoices) != 0 {
-		t.Errorf("Expected 0 invoice rows, got %d", len(invoices))
+	_, err = deleteBatch(ctx, dbmap, racer, persons[1], persons[2])
+	lockErrs, ok = err.(OptimisticLockErrors)
+	if !ok || len(lockErrs) != 1 || !lockErrs[0].RowExists || lockErrs[0].Keys[0] != persons[1].ID {
+		t.Errorf("Expected an OptimisticLockErrors for the row changed concurrently, got %v", err)
+	}
+	var left int
+	if err := dbmap.Dbx.Get(&left, "select count(*) from person_test"); err != nil || left != 1 {
+		t.Errorf("Expected the row not changed concurrently to be deleted, got %d left, %v", left, err)
 	}
+}
 
-	p2 := &Person{0, 0, 0, "Other", "Person", 0}
-	dbmap.InsertContext(ctx, p2)
-	if p2.ID != int64(1) {
-		t.Errorf("Expected new person ID to be equal to 1, was %d", p2.ID)
+// racingExecutor runs race before each statement it executes, as a
+// concurrent writer might.
+type racingExecutor struct {
+	*DbMap
+	race func()
+}
+
+func (r *racingExecutor) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	r.race()
+	return r.DbMap.ExecContext(ctx, query, args...)
+}
+
+type PtrKeyVersionRow struct {
+	ID      *int64
+	Name    string
+	Version int64
+}
+
+type KeyOnlyRow struct {
+	PersonID  int64
+	InvoiceID int64
+	Hooks     []string `db:"-"`
+}
+
+func (r *KeyOnlyRow) PreUpdate(ctx context.Context, s SqlExecutor) error {
+	r.Hooks = append(r.Hooks, "preupdate")
+	return nil
+}
+
+func (r *KeyOnlyRow) PostUpdate(ctx context.Context, s SqlExecutor) error {
+	r.Hooks = append(r.Hooks, "postupdate")
+	return nil
+}
+
+func TestUpdateBatchSql(t *testing.T) {
+	dbmap := NewDbMap(nil, PostgresDialect{})
+	table := dbmap.AddTable(InvoicePersonView{}).SetKeys(false, "invoiceid", "personid")
+	table.SetVersionCol("LegacyVersion")
+	people := dbmap.AddTableWithName(Person{}, "person_test").SetKeys(true, "id")
+
+	tests := []struct {
+		dialect  Dialect
+		table    *TableMap
+		expected string
+		order    []int
+	}{
+		{PostgresDialect{}, table,
+			`update "invoicepersonview" set "memo"=v."memo", "fname"=v."fname", "legacyversion"=v."legacyversion"+1 ` +
+				`from (values ($1::bigint,$2::bigint,$3::varchar,$4::varchar,$5::bigint), ($6::bigint,$7::bigint,$8::varchar,$9::varchar,$10::bigint)) ` +
+				`as v("invoiceid","personid","memo","fname","legacyversion") where "invoicepersonview"."invoiceid"=v."invoiceid" ` +
+				`and "invoicepersonview"."personid"=v."personid" and "invoicepersonview"."legacyversion"=v."legacyversion";`,
+			[]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{SqliteDialect{}, table,
+			`update "invoicepersonview" set "memo"=case when "invoiceid"=? and "personid"=? then ? when "invoiceid"=? and "personid"=? then ? else "memo" end, ` +
+				`"fname"=case when "invoiceid"=? and "personid"=? then ? when "invoiceid"=? and "personid"=? then ? else "fname" end, ` +
+				`"legacyversion"="legacyversion"+1 where ("invoiceid"=? and "personid"=? and "legacyversion"=?) or ("invoiceid"=? and "personid"=? and "legacyversion"=?);`,
+			[]int{0, 1, 2, 5, 6, 7, 0, 1, 3, 5, 6, 8, 0, 1, 4, 5, 6, 9}},
+		{MySQLDialect{}, people,
+			"update `person_test` set `created`=case `id` when ? then ? when ? then ? else `created` end, " +
+				"`updated`=case `id` when ? then ? when ? then ? else `updated` end, " +
+				"`fname`=case `id` when ? then ? when ? then ? else `fname` end, " +
+				"`lname`=case `id` when ? then ? when ? then ? else `lname` end, " +
+				"`version`=`version`+1 where (`id`=? and `version`=?) or (`id`=? and `version`=?);",
+			[]int{0, 1, 6, 7, 0, 2, 6, 8, 0, 3, 6, 9, 0, 4, 6, 10, 0, 5, 6, 11}},
+	}
+	for _, test := range tests {
+		dbmap.Dialect = test.dialect
+		sql, order := test.dialect.UpdateBatchSql(test.table, 2)
+		if sql != test.expected {
+			t.Errorf("%T: expected\n%s\ngot\n%s", test.dialect, test.expected, sql)
+		}
+		if !reflect.DeepEqual(order, test.order) {
+			t.Errorf("%T: expected order %v, got %v", test.dialect, test.order, order)
+		}
 	}
 }
 
-func TestSelectBehavior(t *testing.T) {
+func TestSelectVal(t *testing.T) {
 	ctx := context.Background()
-	db := initDbMap(ctx)
-	defer db.Cleanup(ctx)
+	dbmap := initDbMap(ctx)
+	defer dbmap.Cleanup(ctx)
 
-	p := Person{}
+	_insert(ctx, dbmap,
+		&Invoice{0, 100, 0, "first", 1, false},
+		&Invoice{0, 200, 0, "second", 1, false})
+	bindVar := dbmap.Dialect.BindVar(0)
 
-	// check that SelectOne with no rows returns ErrNoRows
-	err := db.SelectOneContext(ctx, &p, "select * from person_test")
-	if err == nil || err != sql.ErrNoRows {
-		t.Fatal(err)
+	if count, err := dbmap.SelectIntContext(ctx, "select count(*) from invoice_test"); err != nil || count != 2 {
+		t.Errorf("Expected a count of 2, got %d, %v", count, err)
+	}
+	if avg, err := dbmap.SelectFloatContext(ctx, "select avg(date_created) from invoice_test"); err != nil || avg != 150 {
+		t.Errorf("Expected an average of 150, got %v, %v", avg, err)
+	}
+	memo, err := dbmap.SelectStrContext(ctx, "select memo from invoice_test where date_created = "+bindVar, 200)
+	if err != nil || memo != "second" {
+		t.Errorf("Expected memo second, got %q, %v", memo, err)
+	}
+	if memo, err := dbmap.SelectStrContext(ctx, "select memo from invoice_test where date_created = "+bindVar, 300); err != nil || memo != "" {
+		t.Errorf("Expected no memo without rows, got %q, %v", memo, err)
 	}
 
-	// insert and ensure SelectOne works properly
-	bob := Person{0, 0, 0, "Bob", "Smith", 0}
-	db.InsertContext(ctx, &bob)
-
-	err = db.SelectOneContext(ctx, &p, "select * from person_test")
-	if err != nil {
-		t.Fatal(err)
+	// NULLs need the Null variants
+	if _, err := dbmap.SelectIntContext(ctx, "select max(updated) from invoice_test where date_created > 1000"); err == nil {
+		t.Errorf("Expected an error selecting NULL with SelectIntContext")
 	}
-	if p.FName != "Bob" {
-		t.Errorf("Wrong FName: %s", p.FName)
+	if v, err := dbmap.SelectNullIntContext(ctx, "select max(updated) from invoice_test where date_created > 1000"); err != nil || v.Valid {
+		t.Errorf("Expected an invalid NullInt64, got %v, %v", v, err)
 	}
-	// there's a post hook on this that sets it to postget, ensure it ran
-	if p.LName != "postget" {
-		t.Errorf("Wrong LName: %s", p.LName)
+	if v, err := dbmap.SelectNullFloatContext(ctx, "select avg(date_created) from invoice_test"); err != nil || !v.Valid || v.Float64 != 150 {
+		t.Errorf("Expected a valid NullFloat64 of 150, got %v, %v", v, err)
+	}
+	if v, err := dbmap.SelectNullStrContext(ctx, "select memo from invoice_test where date_created = "+bindVar, 300); err != nil || v.Valid {
+		t.Errorf("Expected an invalid NullString without rows, got %v, %v", v, err)
 	}
 
-	// insert again and ensure SelectOne *does not* error in rows > 1
-	ben := Person{0, 0, 0, "Ben", "Smith", 0}
-	db.InsertContext(ctx, &ben)
+	_, err = dbmap.SelectIntContext(ctx, "select id, memo from invoice_test")
+	if err == nil || !strings.Contains(err.Error(), "single column") {
+		t.Errorf("Expected an error for two columns, got %v", err)
+	}
 
-	err = db.SelectOneContext(ctx, &p, "select * from person_test ORDER BY fname ASC")
+	tx, err := dbmap.BeginContext(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if p.FName != "Ben" {
-		t.Errorf("Wrong FName: %s", p.FName)
+	defer tx.Rollback()
+	if err := tx.InsertContext(ctx, &Invoice{0, 300, 0, "third", 1, false}); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := tx.SelectIntContext(ctx, "select count(*) from invoice_test"); err != nil || count != 3 {
+		t.Errorf("Expected a count of 3 in the transaction, got %d, %v", count, err)
 	}
 }
 
-func TestQuoteTableNames(t *testing.T) {
-	ctx := context.Background()
-	dbmap := initDbMap(ctx)
-	defer dbmap.Cleanup(ctx)
-
-	quotedTableName := dbmap.Dialect.QuoteField("person_test")
-
-	// Use a buffer to hold the log to check generated queries
-	var logBuffer bytes.Buffer
-	dbmap.TraceOn("", log.New(&logBuffer, "modltest:", log.Lmicroseconds))
-
-	// Create some rows
-	p1 := &Person{0, 0, 0, "bob", "smith", 0}
-	errorTemplate := "Expected quoted table name %v in query but didn't find it"
+func TestQuerySql(t *testing.T) {
+	dbmap := NewDbMap(nil, PostgresDialect{})
+	invoices := dbmap.AddTableWithName(Invoice{}, "invoice_test").SetKeys(true, "id")
+	persons := dbmap.AddTableWithName(Person{}, "person_test").SetKeys(true, "id")
+
+	query, args, err := invoices.Query().
+		LeftJoin(persons, "PersonID", "ID").
+		Where("Memo", "like", "a%").
+		Where("person_test.lname", "in", "x", "y").
+		WhereSql("date_created > ? or updated > ?", 1, 2).
+		OrderBy("person_test.fname", "id DESC").
+		Offset(20).
+		Sql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `select "invoice_test"."id","invoice_test"."date_created","invoice_test"."updated","invoice_test"."memo",` +
+		`"invoice_test"."personid","invoice_test"."ispaid" from "invoice_test" ` +
+		`left join "person_test" on "invoice_test"."personid" = "person_test"."id" ` +
+		`where "invoice_test"."memo" like $1 and "person_test"."lname" in ($2,$3) and (date_created > $4 or updated > $5) ` +
+		`order by "person_test"."fname", "invoice_test"."id" desc offset 20`
+	if query != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, query)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"a%", "x", "y", 1, 2}) {
+		t.Errorf("Unexpected args %v", args)
+	}
+
+	for _, q := range []*Query{
+		invoices.Query().Where("nope", "=", 1),
+		invoices.Query().Where("memo", "~", 1),
+		invoices.Query().Where("memo", "=", 1, 2),
+		invoices.Query().Where("fname", "=", "bob"),
+		invoices.Query().Join(persons, "personid", "nope"),
+		invoices.Query().OrderBy("memo sideways"),
+		invoices.Query().GroupBy("other_test.id"),
+		invoices.Query().Limit(-1),
+	} {
+		if _, _, err := q.Sql(); err == nil {
+			t.Errorf("Expected an error for %v", q)
+		}
+	}
 
-	// Check if Insert quotes the table name
-	id := dbmap.InsertContext(ctx, p1)
-	if !bytes.Contains(logBuffer.Bytes(), []byte(quotedTableName)) {
-		t.Log("log:", logBuffer.String())
-		t.Errorf(errorTemplate, quotedTableName)
+	// columns of schema-qualified tables may be qualified by the schema
+	billing := NewDbMap(nil, PostgresDialect{})
+	bills := billing.AddTableWithNameAndSchema(Invoice{}, "billing", "invoice").SetKeys(true, "id")
+	people := billing.AddTableWithNameAndSchema(Person{}, "crm", "person").SetKeys(true, "id")
+	query, _, err = bills.Query().
+		Join(people, "billing.invoice.personid", "crm.person.id").
+		Where("crm.person.fname", "=", "bob").
+		OrderBy("invoice.memo").
+		Sql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(query, `from "billing"."invoice" join "crm"."person" on "billing"."invoice"."personid" = "crm"."person"."id" `+
+		`where "crm"."person"."fname" = $1 order by "billing"."invoice"."memo"`) {
+		t.Errorf("Unexpected query on schema-qualified tables %s", query)
+	}
+	if _, _, err = bills.Query().Where("crm.invoice.memo", "=", "x").Sql(); err == nil {
+		t.Errorf("Expected an error for a column qualified by another schema")
 	}
-	logBuffer.Reset()
 
-	// Check if Get quotes the table name
-	dbmap.GetContext(ctx, Person{}, id)
-	if !bytes.Contains(logBuffer.Bytes(), []byte(quotedTableName)) {
-		t.Errorf(errorTemplate, quotedTableName)
+	if query, _, _ := invoices.Query().Where("id", "in").Limit(5).Sql(); !strings.HasSuffix(query, " where 1=0 limit 5") {
+		t.Errorf("Expected an empty in list to match nothing, got %s", query)
+	}
+	for dialect, expected := range map[Dialect]string{
+		SqliteDialect{}:   "limit -1 offset 5",
+		PostgresDialect{}: "offset 5",
+		MySQLDialect{}:    "limit 18446744073709551615 offset 5",
+	} {
+		if got := dialect.LimitClause(-1, 5); got != expected {
+			t.Errorf("%T: expected %q, got %q", dialect, expected, got)
+		}
 	}
-	logBuffer.Reset()
 }
 
 type WithTime struct {
@@ -0,0 +1,356 @@
+package modl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Query builds a select statement for the rows of a mapped table, rendered
+// through the dialect of its DbMap.  Start one with TableMap.Query, and run
+// it with Select or SelectOne, which run the PostGet hooks of the rows just
+// as SelectContext does:
+//
+//     var invoices []Invoice
+//     err := dbmap.TableFor(Invoice{}).Query().
+//         Where("PersonID", "=", personID).
+//         OrderBy("date_created desc").
+//         Limit(10).
+//         Select(ctx, dbmap, &invoices)
+//
+// Columns are referred to by column or field name, and are checked against
+// the mapped tables as the query is built.  The name of a column of a joined
+// table is qualified by its table name, as in "person_test.fname", or by its
+// schema and table name if it has a SchemaName, as in "billing.invoice.memo";
+// an unqualified name refers to the queried table first.  The first invalid
+// reference is returned as an error by Sql, Select and SelectOne.
+//
+// A Query is not safe for concurrent use, and each method modifies and
+// returns the same Query.
+type Query struct {
+	table   *TableMap
+	joins   []queryJoin
+	where   []string
+	args    []interface{}
+	groupBy []string
+	orderBy []string
+	limit   int
+	offset  int
+	err     error
+}
+
+type queryJoin struct {
+	kind  string
+	table *TableMap
+	on    string
+}
+
+// whereOps are the operators accepted by Where, with the number of values
+// each takes, or -1 for a list of values.
+var whereOps = map[string]int{
+	"=": 1, "<>": 1, "!=": 1, "<": 1, "<=": 1, ">": 1, ">=": 1,
+	"like": 1, "not like": 1,
+	"in": -1, "not in": -1,
+	"is null": 0, "is not null": 0,
+}
+
+// Query returns a new Query selecting all rows of the table.
+func (t *TableMap) Query() *Query {
+	return &Query{table: t, limit: -1}
+}
+
+// Where adds the condition "column op values" to the query, and'ed with
+// any other conditions.  op is one of =, <>, !=, <, <=, >, >=, like and
+// not like, which take one value, in and not in, which take a list of
+// values or a single slice, and is null and is not null, which take none.
+func (q *Query) Where(column, op string, values ...interface{}) *Query {
+	col, err := q.column(column)
+	if err != nil {
+		return q.fail(err)
+	}
+	op = strings.ToLower(strings.TrimSpace(op))
+	n, ok := whereOps[op]
+	if !ok {
+		return q.fail(fmt.Errorf("modl: unsupported operator %q in query on %s", op, q.table.TableName))
+	}
+	if n < 0 {
+		values = expandSlice(values)
+		if len(values) == 0 {
+			// nothing is in an empty list
+			if op == "in" {
+				q.where = append(q.where, "1=0")
+			}
+			return q
+		}
+		q.where = append(q.where, fmt.Sprintf("%s %s (%s)", col, op, placeholders(len(values))))
+		q.args = append(q.args, values...)
+		return q
+	}
+	if len(values) != n {
+		return q.fail(fmt.Errorf("modl: operator %q takes %d values, got %d", op, n, len(values)))
+	}
+	if n == 0 {
+		q.where = append(q.where, col+" "+op)
+	} else {
+		q.where = append(q.where, col+" "+op+" ?")
+		q.args = append(q.args, values[0])
+	}
+	return q
+}
+
+// WhereSql adds a condition written in sql to the query, and'ed with any
+// other conditions.  Its values are bound to "?" placeholders, which are
+// replaced with the dialect's bindvars.  The condition is not checked, so
+// it can express what Where cannot, such as "or" and subqueries.
+func (q *Query) WhereSql(cond string, values ...interface{}) *Query {
+	q.where = append(q.where, "("+cond+")")
+	q.args = append(q.args, values...)
+	return q
+}
+
+// Join adds an inner join of table on the condition that column of the
+// query equals joinColumn of table, which may be qualified as other columns
+// are.
+func (q *Query) Join(table *TableMap, column, joinColumn string) *Query {
+	return q.join("join", table, column, joinColumn)
+}
+
+// LeftJoin adds a left outer join of table on the condition that column of
+// the query equals joinColumn of table.
+func (q *Query) LeftJoin(table *TableMap, column, joinColumn string) *Query {
+	return q.join("left join", table, column, joinColumn)
+}
+
+func (q *Query) join(kind string, table *TableMap, column, joinColumn string) *Query {
+	if table.dbmap != q.table.dbmap {
+		return q.fail(fmt.Errorf("modl: cannot join table %s of another DbMap", table.TableName))
+	}
+	if table == q.table || q.joined(table.TableName) != nil {
+		return q.fail(fmt.Errorf("modl: table %s is already in the query", table.TableName))
+	}
+	col, err := q.column(column)
+	if err != nil {
+		return q.fail(err)
+	}
+	if i := strings.LastIndex(joinColumn, "."); i >= 0 {
+		if !isNamed(table, joinColumn[:i]) {
+			return q.fail(fmt.Errorf("modl: column %s is not in the joined table %s", joinColumn, table.TableName))
+		}
+		joinColumn = joinColumn[i+1:]
+	}
+	joinCol, err := qualifiedColumn(table, joinColumn)
+	if err != nil {
+		return q.fail(err)
+	}
+	q.joins = append(q.joins, queryJoin{kind: kind, table: table, on: col + " = " + joinCol})
+	return q
+}
+
+// GroupBy groups the rows by the given columns.  The whole rows of the
+// table are still selected, so grouping by its primary key, to collapse
+// the rows multiplied by a join, is what all databases accept.
+func (q *Query) GroupBy(columns ...string) *Query {
+	for _, column := range columns {
+		col, err := q.column(column)
+		if err != nil {
+			return q.fail(err)
+		}
+		q.groupBy = append(q.groupBy, col)
+	}
+	return q
+}
+
+// OrderBy orders the rows by the given columns, each of which may be
+// followed by "asc" or "desc", as in "date_created desc".
+func (q *Query) OrderBy(columns ...string) *Query {
+	for _, column := range columns {
+		fields := strings.Fields(column)
+		dir := ""
+		if len(fields) == 2 {
+			switch d := strings.ToLower(fields[1]); d {
+			case "asc", "desc":
+				dir = " " + d
+			default:
+				return q.fail(fmt.Errorf("modl: invalid order %q in query on %s", column, q.table.TableName))
+			}
+		} else if len(fields) != 1 {
+			return q.fail(fmt.Errorf("modl: invalid order %q in query on %s", column, q.table.TableName))
+		}
+		col, err := q.column(fields[0])
+		if err != nil {
+			return q.fail(err)
+		}
+		q.orderBy = append(q.orderBy, col+dir)
+	}
+	return q
+}
+
+// Limit limits the query to n rows.
+func (q *Query) Limit(n int) *Query {
+	if n < 0 {
+		return q.fail(fmt.Errorf("modl: negative limit %d", n))
+	}
+	q.limit = n
+	return q
+}
+
+// Offset skips the first n rows of the query.
+func (q *Query) Offset(n int) *Query {
+	if n < 0 {
+		return q.fail(fmt.Errorf("modl: negative offset %d", n))
+	}
+	q.offset = n
+	return q
+}
+
+// Sql returns the select statement and its arguments, or the first error
+// found while building the query.
+func (q *Query) Sql() (string, []interface{}, error) {
+	if q.err != nil {
+		return "", nil, q.err
+	}
+	t := q.table
+	d := t.dbmap.Dialect
+	s := bytes.Buffer{}
+	s.WriteString("select ")
+	x := 0
+	for _, col := range t.Columns {
+		if col.Transient {
+			continue
+		}
+		if x > 0 {
+			s.WriteString(",")
+		}
+		s.WriteString(t.quotedTableName())
+		s.WriteString(".")
+		s.WriteString(d.QuoteField(col.ColumnName))
+		if col.scanName != "" {
+			s.WriteString(" as ")
+			s.WriteString(d.QuoteField(col.scanName))
+		}
+		x++
+	}
+	s.WriteString(" from ")
+	s.WriteString(t.quotedTableName())
+	for _, j := range q.joins {
+		fmt.Fprintf(&s, " %s %s on %s", j.kind, j.table.quotedTableName(), j.on)
+	}
+	if len(q.where) > 0 {
+		s.WriteString(" where ")
+		s.WriteString(ReBind(strings.Join(q.where, " and "), d))
+	}
+	if len(q.groupBy) > 0 {
+		s.WriteString(" group by ")
+		s.WriteString(strings.Join(q.groupBy, ", "))
+	}
+	if len(q.orderBy) > 0 {
+		s.WriteString(" order by ")
+		s.WriteString(strings.Join(q.orderBy, ", "))
+	}
+	if limit := d.LimitClause(q.limit, q.offset); limit != "" {
+		s.WriteString(" ")
+		s.WriteString(limit)
+	}
+	return s.String(), q.args, nil
+}
+
+// Select runs the query with e, filling dest, a pointer to a slice of the
+// table's struct or pointers to it.
+func (q *Query) Select(ctx context.Context, e SqlExecutor, dest interface{}) error {
+	query, args, err := q.Sql()
+	if err != nil {
+		return err
+	}
+	return e.SelectContext(ctx, dest, query, args...)
+}
+
+// SelectOne runs the query with e, filling dest, a pointer to the table's
+// struct, with the first row.  It returns sql.ErrNoRows if there is none.
+func (q *Query) SelectOne(ctx context.Context, e SqlExecutor, dest interface{}) error {
+	query, args, err := q.Sql()
+	if err != nil {
+		return err
+	}
+	return e.SelectOneContext(ctx, dest, query, args...)
+}
+
+func (q *Query) fail(err error) *Query {
+	if q.err == nil {
+		q.err = err
+	}
+	return q
+}
+
+// column returns the quoted and qualified name of a column of the query,
+// which may be qualified by its table name, with or without its schema.
+func (q *Query) column(name string) (string, error) {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		tableName, colName := name[:i], name[i+1:]
+		if isNamed(q.table, tableName) {
+			return qualifiedColumn(q.table, colName)
+		}
+		if table := q.joined(tableName); table != nil {
+			return qualifiedColumn(table, colName)
+		}
+		return "", fmt.Errorf("modl: table %s is not in the query on %s", tableName, q.table.TableName)
+	}
+	if col, err := qualifiedColumn(q.table, name); err == nil {
+		return col, nil
+	}
+	for _, j := range q.joins {
+		if col, err := qualifiedColumn(j.table, name); err == nil {
+			return col, nil
+		}
+	}
+	return "", fmt.Errorf("modl: no column %s in the query on %s", name, q.table.TableName)
+}
+
+func (q *Query) joined(tableName string) *TableMap {
+	for _, j := range q.joins {
+		if isNamed(j.table, tableName) {
+			return j.table
+		}
+	}
+	return nil
+}
+
+// isNamed reports whether name is the name of table, or its name qualified
+// by its schema.
+func isNamed(table *TableMap, name string) bool {
+	return name == table.TableName ||
+		table.SchemaName != "" && name == table.SchemaName+"."+table.TableName
+}
+
+// qualifiedColumn returns the quoted name of a column of table, qualified
+// by the table's name.
+func qualifiedColumn(table *TableMap, name string) (string, error) {
+	col := table.findColumn(name)
+	if col == nil || col.Transient {
+		return "", fmt.Errorf("modl: no column %s in table %s", name, table.TableName)
+	}
+	return table.quotedTableName() + "." + table.dbmap.Dialect.QuoteField(col.ColumnName), nil
+}
+
+// placeholders returns n comma separated "?" placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// expandSlice returns the elements of values if it holds a single slice
+// other than a []byte, and values otherwise.
+func expandSlice(values []interface{}) []interface{} {
+	if len(values) != 1 {
+		return values
+	}
+	v := reflect.ValueOf(values[0])
+	if v.Kind() != reflect.Slice || v.Type().Elem().Kind() == reflect.Uint8 {
+		return values
+	}
+	expanded := make([]interface{}, v.Len())
+	for i := range expanded {
+		expanded[i] = v.Index(i).Interface()
+	}
+	return expanded
+}
@@ -0,0 +1,835 @@
+package modl
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Schema is the structure of a live database, as read by InspectSchema.
+type Schema struct {
+	Tables []*TableSchema
+}
+
+// Table returns the table with the given name, or nil if there is none.
+func (s *Schema) Table(name string) *TableSchema {
+	for _, t := range s.Tables {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// TableSchema is the structure of a table in a live database.
+type TableSchema struct {
+	Name        string
+	Columns     []*ColumnSchema
+	PrimaryKey  []string
+	Indexes     []*IndexSchema
+	ForeignKeys []*ForeignKeySchema
+}
+
+// Column returns the column with the given name, or nil if there is none.
+func (t *TableSchema) Column(name string) *ColumnSchema {
+	for _, c := range t.Columns {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// ColumnSchema is the structure of a column in a live database.  Type is the
+// type as reported by the database, such as "varchar(255)", and Default is
+// the default expression, or "" if the column has none.  AutoIncr is set for
+// columns whose values are generated by the database, such as serials.
+type ColumnSchema struct {
+	Name     string
+	Type     string
+	NotNull  bool
+	Default  string
+	AutoIncr bool
+}
+
+// IndexSchema is an index in a live database, other than the primary key.
+// Indexes on expressions rather than columns are not included.
+type IndexSchema struct {
+	Name    string
+	Unique  bool
+	Columns []string
+}
+
+// ForeignKeySchema is a single column foreign key in a live database.
+type ForeignKeySchema struct {
+	Column    string
+	RefTable  string
+	RefColumn string
+}
+
+// InspectSchema reads the tables of the connection's default schema, with
+// their columns, keys and indexes, from the database's catalog.  All tables
+// are read, including ones not mapped on this DbMap.
+func (m *DbMap) InspectSchema(ctx context.Context) (*Schema, error) {
+	names, err := m.Dialect.InspectTables(ctx, m, "")
+	if err != nil {
+		return nil, err
+	}
+	schema := &Schema{}
+	for _, name := range names {
+		table, err := m.Dialect.InspectTable(ctx, m, "", name)
+		if err != nil {
+			return nil, err
+		}
+		schema.Tables = append(schema.Tables, table)
+	}
+	return schema, nil
+}
+
+// inspectMapped reads the tables mapped on m which exist, each from its own
+// schema.
+func (m *DbMap) inspectMapped(ctx context.Context) (map[*TableMap]*TableSchema, error) {
+	names := map[string]map[string]bool{}
+	live := map[*TableMap]*TableSchema{}
+	for _, table := range m.tables {
+		if names[table.SchemaName] == nil {
+			list, err := m.Dialect.InspectTables(ctx, m, table.SchemaName)
+			if err != nil {
+				return nil, err
+			}
+			names[table.SchemaName] = map[string]bool{}
+			for _, name := range list {
+				names[table.SchemaName][name] = true
+			}
+		}
+		if !names[table.SchemaName][table.TableName] {
+			continue
+		}
+		t, err := m.Dialect.InspectTable(ctx, m, table.SchemaName, table.TableName)
+		if err != nil {
+			return nil, err
+		}
+		live[table] = t
+	}
+	return live, nil
+}
+
+// SchemaReport describes how the tables mapped on a DbMap differ from the
+// live database, as returned by Validate.
+type SchemaReport struct {
+	// Mapped tables which do not exist.
+	MissingTables []string
+	// Mapped columns which do not exist.
+	MissingColumns []ColumnDiff
+	// Columns of mapped tables which are not mapped.
+	ExtraColumns []ColumnDiff
+	// Columns whose type differs from the mapped type, in Expected and Actual.
+	TypeMismatches []ColumnDiff
+	// Tables whose primary key columns differ from the mapped keys.
+	KeyMismatches []KeyDiff
+}
+
+// ColumnDiff identifies a column which differs from its mapping.  Expected
+// and Actual are the mapped and live types of type mismatches.
+type ColumnDiff struct {
+	Table    string
+	Column   string
+	Expected string
+	Actual   string
+}
+
+// KeyDiff holds the mapped and live primary key columns of a table.
+type KeyDiff struct {
+	Table    string
+	Expected []string
+	Actual   []string
+}
+
+// OK reports whether the live database matches the mapped tables.
+func (r *SchemaReport) OK() bool {
+	return len(r.MissingTables) == 0 && len(r.MissingColumns) == 0 && len(r.ExtraColumns) == 0 &&
+		len(r.TypeMismatches) == 0 && len(r.KeyMismatches) == 0
+}
+
+// Err returns nil if the live database matches the mapped tables, and
+// otherwise an error listing every difference.
+func (r *SchemaReport) Err() error {
+	if r.OK() {
+		return nil
+	}
+	return fmt.Errorf("modl: schema does not match mapped tables: %s", r)
+}
+
+func (r *SchemaReport) String() string {
+	var diffs []string
+	for _, t := range r.MissingTables {
+		diffs = append(diffs, fmt.Sprintf("missing table %s", t))
+	}
+	for _, c := range r.MissingColumns {
+		diffs = append(diffs, fmt.Sprintf("missing column %s.%s", c.Table, c.Column))
+	}
+	for _, c := range r.ExtraColumns {
+		diffs = append(diffs, fmt.Sprintf("unmapped column %s.%s", c.Table, c.Column))
+	}
+	for _, c := range r.TypeMismatches {
+		diffs = append(diffs, fmt.Sprintf("column %s.%s is %s, expected %s", c.Table, c.Column, c.Actual, c.Expected))
+	}
+	for _, k := range r.KeyMismatches {
+		diffs = append(diffs, fmt.Sprintf("primary key of %s is (%s), expected (%s)",
+			k.Table, strings.Join(k.Actual, ", "), strings.Join(k.Expected, ", ")))
+	}
+	return strings.Join(diffs, "; ")
+}
+
+// Validate compares the tables and columns mapped on the DbMap with the live
+// database, and returns a report of the differences.  Services can call it
+// on startup and fail on report.Err(), rather than finding missing columns
+// through scan errors later.  The error is only set if the database could
+// not be inspected.
+//
+// Types are compared after Dialect.NormalizeType, and are not compared for
+// columns created with SetSqlCreate.  Tables with a SchemaName are looked up
+// in that schema, others in the connection's default schema.
+func (m *DbMap) Validate(ctx context.Context) (*SchemaReport, error) {
+	lives, err := m.inspectMapped(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &SchemaReport{}
+	for _, table := range m.tables {
+		live := lives[table]
+		if live == nil {
+			report.MissingTables = append(report.MissingTables, table.TableName)
+			continue
+		}
+		mapped := map[string]bool{}
+		for _, col := range table.Columns {
+			if col.Transient {
+				continue
+			}
+			mapped[col.ColumnName] = true
+			lc := live.Column(col.ColumnName)
+			if lc == nil {
+				report.MissingColumns = append(report.MissingColumns, ColumnDiff{Table: table.TableName, Column: col.ColumnName})
+				continue
+			}
+			if col.createSql != "" {
+				continue
+			}
+			expected := m.Dialect.NormalizeType(col.sqlType())
+			actual := m.Dialect.NormalizeType(lc.Type)
+			if expected != actual {
+				report.TypeMismatches = append(report.TypeMismatches, ColumnDiff{
+					Table: table.TableName, Column: col.ColumnName, Expected: expected, Actual: actual,
+				})
+			}
+		}
+		for _, lc := range live.Columns {
+			if !mapped[lc.Name] {
+				report.ExtraColumns = append(report.ExtraColumns, ColumnDiff{Table: table.TableName, Column: lc.Name})
+			}
+		}
+
+		var keys []string
+		for _, k := range table.Keys {
+			keys = append(keys, k.ColumnName)
+		}
+		if !sameColumns(keys, live.PrimaryKey) {
+			report.KeyMismatches = append(report.KeyMismatches, KeyDiff{
+				Table: table.TableName, Expected: keys, Actual: live.PrimaryKey,
+			})
+		}
+	}
+	return report, nil
+}
+
+// SchemaChange is a statement which brings the live database closer to the
+// mapped tables, as returned by AlterTablesSql.
+type SchemaChange struct {
+	// The table changed.
+	Table string
+	// The statement.  It is empty for changes the dialect cannot make, which
+	// must be migrated by hand.
+	Sql string
+	// A description of the change, such as "add column person.email".
+	Description string
+	// Destructive changes drop tables or columns, or change column types,
+	// and may lose data.
+	Destructive bool
+}
+
+// SchemaChanges is an ordered list of changes.
+type SchemaChanges []SchemaChange
+
+// Safe returns the statements of the changes which are not destructive.
+func (c SchemaChanges) Safe() []string {
+	return c.statements(false)
+}
+
+// Destructive returns the statements of the destructive changes.
+func (c SchemaChanges) Destructive() []string {
+	return c.statements(true)
+}
+
+func (c SchemaChanges) statements(destructive bool) []string {
+	var stmts []string
+	for _, change := range c {
+		if change.Destructive == destructive && change.Sql != "" {
+			stmts = append(stmts, change.Sql)
+		}
+	}
+	return stmts
+}
+
+// AlterTablesSql compares the tables mapped on the DbMap with the live
+// database, and returns the statements which would make the database match,
+// in the order they should be run:
+//
+//     create mapped tables which do not exist, with their indexes
+//     add mapped columns which do not exist
+//     change the types of columns which differ (destructive)
+//     create mapped indexes which do not exist
+//     drop columns which are not mapped (destructive)
+//
+// As with CreateTablesSql, the statements are meant to be reviewed, for
+// example before committing them into a migration; nothing is executed.
+// Indexes not mapped are never dropped, since databases create their own
+// indexes for unique and foreign key constraints, and neither are the
+// foreign keys of added columns or changes of primary keys generated.  Not
+// null columns without a default are added with the zero value of their Go
+// type as default, so that tables with rows accept them.  Tables which
+// are not mapped are left alone; see DropUnmappedTablesSql.  As with
+// Validate, tables are looked up in their SchemaName.
+func (m *DbMap) AlterTablesSql(ctx context.Context) (SchemaChanges, error) {
+	lives, err := m.inspectMapped(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := m.sortedTables()
+	if err != nil {
+		return nil, err
+	}
+	d := m.Dialect
+
+	var creates, adds, alters, indexes, drops SchemaChanges
+	mapped := map[string]bool{}
+	for _, table := range tables {
+		mapped[table.TableName] = true
+		live := lives[table]
+		if live == nil {
+			stmts, err := m.createTableSql(table, false, true)
+			if err != nil {
+				return nil, err
+			}
+			for i, stmt := range stmts {
+				desc := "create table " + table.TableName
+				if i > 0 {
+					desc = fmt.Sprintf("create index %s on %s", table.Indexes[i-1].IndexName, table.TableName)
+				}
+				creates = append(creates, SchemaChange{Table: table.TableName, Sql: stmt, Description: desc})
+			}
+			continue
+		}
+
+		cols := map[string]bool{}
+		for _, col := range table.Columns {
+			if col.Transient {
+				continue
+			}
+			cols[col.ColumnName] = true
+			lc := live.Column(col.ColumnName)
+			if lc == nil {
+				adds = append(adds, addColumnChange(table, col))
+				continue
+			}
+			if col.createSql != "" {
+				continue
+			}
+			expected, actual := d.NormalizeType(col.sqlType()), d.NormalizeType(lc.Type)
+			if expected != actual {
+				alters = append(alters, SchemaChange{
+					Table:       table.TableName,
+					Sql:         d.AlterColumnTypeSql(col),
+					Description: fmt.Sprintf("change type of %s.%s from %s to %s", table.TableName, col.ColumnName, actual, expected),
+					Destructive: true,
+				})
+			}
+		}
+
+		for _, idx := range table.Indexes {
+			found := false
+			for _, li := range live.Indexes {
+				found = found || li.Name == idx.IndexName
+			}
+			if found {
+				continue
+			}
+			stmt, err := m.createIndexSql(idx, false)
+			if err != nil {
+				return nil, err
+			}
+			indexes = append(indexes, SchemaChange{
+				Table:       table.TableName,
+				Sql:         stmt,
+				Description: fmt.Sprintf("create index %s on %s", idx.IndexName, table.TableName),
+			})
+		}
+
+		for _, lc := range live.Columns {
+			if !cols[lc.Name] {
+				drops = append(drops, SchemaChange{
+					Table: table.TableName,
+					Sql: fmt.Sprintf("alter table %s drop column %s;",
+						table.quotedTableName(), d.QuoteField(lc.Name)),
+					Description: fmt.Sprintf("drop column %s.%s", table.TableName, lc.Name),
+					Destructive: true,
+				})
+			}
+		}
+	}
+
+	var changes SchemaChanges
+	for _, c := range []SchemaChanges{creates, adds, alters, indexes, drops} {
+		changes = append(changes, c...)
+	}
+	return changes, nil
+}
+
+// KeptTables are never dropped by DropUnmappedTablesSql.  They hold the
+// bookkeeping tables of the migrate package under their default names;
+// add the names of other tables kept outside of any DbMap.
+var KeptTables = []string{"schema_migrations", "schema_migrations_lock"}
+
+// DropUnmappedTablesSql returns statements dropping the tables in the
+// database which are not mapped on the DbMap, nor named in KeptTables or
+// keep, in an order which drops tables before the tables their foreign keys
+// reference.  Every change is destructive, and as with AlterTablesSql,
+// nothing is executed.  Only the connection's default schema is searched
+// for tables to drop, and a table is kept if its name is mapped in any
+// schema.
+func (m *DbMap) DropUnmappedTablesSql(ctx context.Context, keep ...string) (SchemaChanges, error) {
+	schema, err := m.InspectSchema(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mapped := map[string]bool{}
+	for _, table := range m.tables {
+		mapped[table.TableName] = true
+	}
+	for _, name := range append(KeptTables[:len(KeptTables):len(KeptTables)], keep...) {
+		mapped[name] = true
+	}
+
+	var drops SchemaChanges
+	for _, live := range dropOrder(schema, mapped) {
+		drops = append(drops, SchemaChange{
+			Table:       live.Name,
+			Sql:         fmt.Sprintf("drop table %s;", m.Dialect.QuoteField(live.Name)),
+			Description: "drop table " + live.Name,
+			Destructive: true,
+		})
+	}
+	return drops, nil
+}
+
+// addColumnChange returns the change adding col to its existing table.  A
+// not null column cannot be added to a table with rows without a default,
+// so one without a default is given the zero value of its Go type as its
+// default, or the change is marked destructive to flag it for review if
+// there is no such value.
+func addColumnChange(table *TableMap, col *ColumnMap) SchemaChange {
+	change := SchemaChange{
+		Table:       table.TableName,
+		Description: fmt.Sprintf("add column %s.%s", table.TableName, col.ColumnName),
+	}
+	if col.NotNull && col.Default == "" && col.createSql == "" {
+		zero := zeroDefault(col)
+		if zero == "" {
+			change.Description += " (not null without a default)"
+			change.Destructive = true
+		} else {
+			withDefault := *col
+			withDefault.Default = zero
+			col = &withDefault
+		}
+	}
+	s := bytes.Buffer{}
+	s.WriteString("alter table ")
+	s.WriteString(table.quotedTableName())
+	s.WriteString(" add column ")
+	writeColumnSql(&s, col)
+	s.WriteString(";")
+	change.Sql = s.String()
+	return change
+}
+
+// zeroDefault returns a default clause value for the zero value of col's Go
+// type, or "" for types without a portable literal.
+func zeroDefault(col *ColumnMap) string {
+	switch col.gotype.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "0"
+	case reflect.Bool:
+		return "false"
+	case reflect.String:
+		return "''"
+	}
+	return ""
+}
+
+// dropOrder returns the tables of schema which are not mapped, ordered so
+// that tables are dropped before the tables their foreign keys reference.
+// Tables in a cycle are returned last, in name order.
+func dropOrder(schema *Schema, mapped map[string]bool) []*TableSchema {
+	var left, ordered []*TableSchema
+	for _, t := range schema.Tables {
+		if !mapped[t.Name] {
+			left = append(left, t)
+		}
+	}
+	for len(left) > 0 {
+		var next []*TableSchema
+		for _, t := range left {
+			referenced := false
+			for _, other := range left {
+				for _, fk := range other.ForeignKeys {
+					referenced = referenced || (other != t && fk.RefTable == t.Name)
+				}
+			}
+			if referenced {
+				next = append(next, t)
+			} else {
+				ordered = append(ordered, t)
+			}
+		}
+		if len(next) == len(left) {
+			return append(ordered, left...)
+		}
+		left = next
+	}
+	return ordered
+}
+
+// sameColumns reports whether a and b hold the same column names, in any
+// order.
+func sameColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]bool, len(a))
+	for _, c := range a {
+		seen[c] = true
+	}
+	for _, c := range b {
+		if !seen[c] {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeType lowercases t and collapses its whitespace, and returns it
+// split into its base type and any parenthesized arguments.
+func normalizeType(t string) (base, args string) {
+	t = strings.Join(strings.Fields(strings.ToLower(t)), " ")
+	if i := strings.Index(t, "("); i >= 0 {
+		return strings.TrimSpace(t[:i]), strings.Replace(t[i:], " ", "", -1)
+	}
+	return t, ""
+}
+
+// schemaColumn is a row of the column queries of the dialects.
+type schemaColumn struct {
+	Name     string         `db:"name"`
+	Type     string         `db:"type"`
+	NotNull  bool           `db:"notnull"`
+	Default  sql.NullString `db:"dflt"`
+	PK       int            `db:"pk"`
+	AutoIncr bool           `db:"autoincr"`
+}
+
+// schemaIndex is a row of the index queries of the dialects, with one row
+// per indexed column.
+type schemaIndex struct {
+	Name    string `db:"name"`
+	Unique  bool   `db:"isunique"`
+	Primary bool   `db:"isprimary"`
+	Column  string `db:"col"`
+}
+
+// buildTableSchema assembles a TableSchema from the rows of the dialects'
+// queries.  Columns are in table order, primary key columns are ordered by
+// their pk position and index rows must be ordered by index and position.
+func buildTableSchema(name string, cols []schemaColumn, idxs []schemaIndex, fks []*ForeignKeySchema) *TableSchema {
+	t := &TableSchema{Name: name, ForeignKeys: fks}
+	var pks []schemaColumn
+	for _, c := range cols {
+		t.Columns = append(t.Columns, &ColumnSchema{
+			Name:     c.Name,
+			Type:     c.Type,
+			NotNull:  c.NotNull,
+			Default:  c.Default.String,
+			AutoIncr: c.AutoIncr,
+		})
+		if c.PK > 0 {
+			pks = append(pks, c)
+		}
+	}
+	sort.SliceStable(pks, func(i, j int) bool { return pks[i].PK < pks[j].PK })
+	for _, c := range pks {
+		t.PrimaryKey = append(t.PrimaryKey, c.Name)
+	}
+
+	var idx *IndexSchema
+	for _, row := range idxs {
+		if row.Primary {
+			if len(pks) == 0 {
+				t.PrimaryKey = append(t.PrimaryKey, row.Column)
+			}
+			continue
+		}
+		if idx == nil || idx.Name != row.Name {
+			idx = &IndexSchema{Name: row.Name, Unique: row.Unique}
+			t.Indexes = append(t.Indexes, idx)
+		}
+		idx.Columns = append(idx.Columns, row.Column)
+	}
+	return t
+}
+
+// InspectTables returns the tables in the sqlite_master of schema, which
+// is the name of an attached database, other than sqlite's own.
+func (d SqliteDialect) InspectTables(ctx context.Context, e SqlExecutor, schema string) ([]string, error) {
+	master := "sqlite_master"
+	if schema != "" {
+		master = d.QuoteField(schema) + "." + master
+	}
+	var names []string
+	err := e.handle().SelectContext(ctx, &names, `select name from `+master+`
+		where type = 'table' and name not like 'sqlite_%' order by name`)
+	return names, err
+}
+
+// InspectTable reads the table with the table_info, index_list, index_info
+// and foreign_key_list pragmas.
+func (d SqliteDialect) InspectTable(ctx context.Context, e SqlExecutor, schema, table string) (*TableSchema, error) {
+	// the pragma functions take the schema as an optional last argument
+	arg, args := "", []interface{}{table}
+	if schema != "" {
+		arg, args = ", ?", append(args, schema)
+	}
+	var cols []schemaColumn
+	// an "integer primary key" is an alias of the rowid, and generated
+	err := e.handle().SelectContext(ctx, &cols, `select name, type, "notnull" as "notnull",
+		dflt_value as dflt, pk,
+		pk = 1 and lower(type) = 'integer' and
+			(select count(*) from pragma_table_info(?`+arg+`) where pk > 0) = 1 as autoincr
+		from pragma_table_info(?`+arg+`) order by cid`, append(args, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	var idxs []schemaIndex
+	err = e.handle().SelectContext(ctx, &idxs, `select l.name as name, l."unique" as isunique,
+		l.origin = 'pk' as isprimary, i.name as col
+		from pragma_index_list(?`+arg+`) l, pragma_index_info(l.name`+arg+`) i
+		where i.name is not null order by l.name, i.seqno`, append(args, args[1:]...)...)
+	if err != nil {
+		return nil, err
+	}
+	var fks []*ForeignKeySchema
+	err = e.handle().SelectContext(ctx, &fks, `select "from" as "column", "table" as reftable,
+		"to" as refcolumn from pragma_foreign_key_list(?`+arg+`) order by id, seq`, args...)
+	if err != nil {
+		return nil, err
+	}
+	return buildTableSchema(table, cols, idxs, fks), nil
+}
+
+// NormalizeType lowercases t.  Sqlite keeps column types as declared.
+func (d SqliteDialect) NormalizeType(t string) string {
+	base, args := normalizeType(t)
+	return base + args
+}
+
+// postgresTypeAliases maps the aliases of Postgres types to the names that
+// format_type reports.
+var postgresTypeAliases = map[string]string{
+	"int":         "integer",
+	"int4":        "integer",
+	"serial":      "integer",
+	"serial4":     "integer",
+	"int8":        "bigint",
+	"bigserial":   "bigint",
+	"serial8":     "bigint",
+	"int2":        "smallint",
+	"smallserial": "smallint",
+	"serial2":     "smallint",
+	"bool":        "boolean",
+	"float4":      "real",
+	"float8":      "double precision",
+	"double":      "double precision",
+	"decimal":     "numeric",
+	"varchar":     "character varying",
+	"char":        "character",
+	"timestamptz": "timestamp with time zone",
+	"timestamp":   "timestamp without time zone",
+}
+
+// NormalizeType maps aliases such as "int8", "serial" and "varchar" to the
+// names reported by format_type.
+func (d PostgresDialect) NormalizeType(t string) string {
+	base, args := normalizeType(t)
+	if alias, ok := postgresTypeAliases[base]; ok {
+		base = alias
+	}
+	return base + args
+}
+
+// AlterColumnTypeSql returns "", as sqlite cannot change column types; the
+// table must be rebuilt instead.
+func (d SqliteDialect) AlterColumnTypeSql(col *ColumnMap) string {
+	return ""
+}
+
+// AlterColumnTypeSql returns an "alter column type" statement.  Conversions
+// which Postgres cannot make implicitly need a "using" clause added by hand.
+func (d PostgresDialect) AlterColumnTypeSql(col *ColumnMap) string {
+	return fmt.Sprintf("alter table %s alter column %s type %s;",
+		d.QuotedTableForQuery(col.table.SchemaName, col.table.TableName), d.QuoteField(col.ColumnName), col.sqlType())
+}
+
+// InspectTables returns the tables of schema, or of the current schema if
+// it is empty.
+func (d PostgresDialect) InspectTables(ctx context.Context, e SqlExecutor, schema string) ([]string, error) {
+	var names []string
+	err := e.handle().SelectContext(ctx, &names, `select table_name from information_schema.tables
+		where table_schema = coalesce(nullif($1, ''), current_schema()) and table_type = 'BASE TABLE'
+		order by table_name`, schema)
+	return names, err
+}
+
+// InspectTable reads the table from pg_catalog.  Types are reported by
+// format_type, eg. "character varying(255)".
+func (d PostgresDialect) InspectTable(ctx context.Context, e SqlExecutor, schema, table string) (*TableSchema, error) {
+	qualified := d.QuotedTableForQuery(schema, table)
+	var cols []schemaColumn
+	err := e.handle().SelectContext(ctx, &cols, `select a.attname as name,
+		format_type(a.atttypid, a.atttypmod) as type, a.attnotnull as "notnull",
+		pg_get_expr(d.adbin, d.adrelid) as dflt, 0 as pk,
+		a.attidentity <> '' or coalesce(pg_get_expr(d.adbin, d.adrelid), '') like 'nextval(%' as autoincr
+		from pg_attribute a left join pg_attrdef d on d.adrelid = a.attrelid and d.adnum = a.attnum
+		where a.attrelid = $1::regclass and a.attnum > 0 and not a.attisdropped
+		order by a.attnum`, qualified)
+	if err != nil {
+		return nil, err
+	}
+	var idxs []schemaIndex
+	err = e.handle().SelectContext(ctx, &idxs, `select i.relname as name, x.indisunique as isunique,
+		x.indisprimary as isprimary, a.attname as col
+		from pg_index x join pg_class i on i.oid = x.indexrelid
+		join pg_attribute a on a.attrelid = x.indrelid and a.attnum = any(x.indkey)
+		where x.indrelid = $1::regclass
+		order by i.relname, array_position(x.indkey::smallint[], a.attnum)`, qualified)
+	if err != nil {
+		return nil, err
+	}
+	var fks []*ForeignKeySchema
+	err = e.handle().SelectContext(ctx, &fks, `select a.attname as "column", r.relname as reftable,
+		ra.attname as refcolumn
+		from pg_constraint c join pg_class r on r.oid = c.confrelid
+		join pg_attribute a on a.attrelid = c.conrelid and a.attnum = c.conkey[1]
+		join pg_attribute ra on ra.attrelid = c.confrelid and ra.attnum = c.confkey[1]
+		where c.contype = 'f' and c.conrelid = $1::regclass and array_length(c.conkey, 1) = 1
+		order by c.conname`, qualified)
+	if err != nil {
+		return nil, err
+	}
+	return buildTableSchema(table, cols, idxs, fks), nil
+}
+
+// NormalizeType drops the display width of integer types, which MySQL
+// before 8.0 reports, and spells booleans as "tinyint(1)".
+func (d MySQLDialect) NormalizeType(t string) string {
+	base, args := normalizeType(t)
+	unsigned := ""
+	if strings.HasSuffix(args, "unsigned") {
+		args, unsigned = strings.TrimSuffix(args, "unsigned"), " unsigned"
+	}
+	switch base {
+	case "bool", "boolean":
+		return "tinyint(1)"
+	case "integer":
+		base = "int"
+	}
+	switch base {
+	case "tinyint":
+		if args != "(1)" {
+			args = ""
+		}
+	case "smallint", "mediumint", "int", "bigint":
+		args = ""
+	}
+	return base + args + unsigned
+}
+
+// AlterColumnTypeSql returns a "modify column" statement, which restates the
+// whole column definition.
+func (d MySQLDialect) AlterColumnTypeSql(col *ColumnMap) string {
+	s := bytes.Buffer{}
+	s.WriteString("alter table ")
+	s.WriteString(d.QuotedTableForQuery(col.table.SchemaName, col.table.TableName))
+	s.WriteString(" modify column ")
+	writeColumnSql(&s, col)
+	s.WriteString(";")
+	return s.String()
+}
+
+// InspectTables returns the tables of the database schema, or of the
+// current database if it is empty.
+func (d MySQLDialect) InspectTables(ctx context.Context, e SqlExecutor, schema string) ([]string, error) {
+	var names []string
+	err := e.handle().SelectContext(ctx, &names, `select table_name as name from information_schema.tables
+		where table_schema = coalesce(nullif(?, ''), database()) and table_type = 'BASE TABLE'
+		order by table_name`, schema)
+	return names, err
+}
+
+// InspectTable reads the table from information_schema.  Types are reported
+// as column_type, eg. "varchar(255)".  Note that MySQL creates an index for
+// every foreign key which is not covered by another index.
+func (d MySQLDialect) InspectTable(ctx context.Context, e SqlExecutor, schema, table string) (*TableSchema, error) {
+	var cols []schemaColumn
+	err := e.handle().SelectContext(ctx, &cols, `select column_name as name, column_type as type,
+		is_nullable = 'NO' as notnull, column_default as dflt, 0 as pk,
+		extra like '%auto_increment%' as autoincr
+		from information_schema.columns
+		where table_schema = coalesce(nullif(?, ''), database()) and table_name = ? order by ordinal_position`, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	var idxs []schemaIndex
+	err = e.handle().SelectContext(ctx, &idxs, `select index_name as name, non_unique = 0 as isunique,
+		index_name = 'PRIMARY' as isprimary, column_name as col
+		from information_schema.statistics
+		where table_schema = coalesce(nullif(?, ''), database()) and table_name = ? and column_name is not null
+		order by index_name, seq_in_index`, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	var fks []*ForeignKeySchema
+	err = e.handle().SelectContext(ctx, &fks, `select column_name as `+"`column`"+`,
+		referenced_table_name as reftable, referenced_column_name as refcolumn
+		from information_schema.key_column_usage
+		where table_schema = coalesce(nullif(?, ''), database()) and table_name = ? and referenced_table_name is not null
+		order by constraint_name, ordinal_position`, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	return buildTableSchema(table, cols, idxs, fks), nil
+}
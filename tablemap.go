@@ -2,8 +2,14 @@ package modl
 
 import (
 	"bytes"
+	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"mindoktor.io/sqlx"
 	"mindoktor.io/sqlx/reflectx"
@@ -13,17 +19,28 @@ import (
 // Use dbmap.AddTable() or dbmap.AddTableWithName() to create these
 type TableMap struct {
 	// Name of database table.
-	TableName  string
-	Keys       []*ColumnMap
-	Columns    []*ColumnMap
-	gotype     reflect.Type
-	version    *ColumnMap
-	insertPlan bindPlan
-	updatePlan bindPlan
-	deletePlan bindPlan
-	getPlan    bindPlan
-	dbmap      *DbMap
-	mapper     *reflectx.Mapper
+	TableName string
+	// Name of the schema the table is in, or "" for the connection's
+	// default schema.
+	SchemaName     string
+	Keys           []*ColumnMap
+	Columns        []*ColumnMap
+	Indexes        []*IndexMap
+	gotype         reflect.Type
+	version        *ColumnMap
+	conflictKeys   []*ColumnMap
+	snapshot       *ColumnMap
+	insertPlan     bindPlan
+	batchPlan      bindPlan
+	upsertPlan     bindPlan
+	upsertIncrPlan bindPlan
+	upsertGetPlan  bindPlan
+	updatePlan     bindPlan
+	deletePlan     bindPlan
+	getPlan        bindPlan
+	partialPlans   map[string]bindPlan
+	dbmap          *DbMap
+	mapper         *reflectx.Mapper
 	// Cached capabilities for the struct mapped to this table
 	CanPreInsert  bool
 	CanPostInsert bool
@@ -34,14 +51,25 @@ type TableMap struct {
 	CanPostDelete bool
 }
 
+// quotedTableName returns the table name, qualified by its schema if any,
+// quoted for use in generated statements.
+func (t *TableMap) quotedTableName() string {
+	return t.dbmap.Dialect.QuotedTableForQuery(t.SchemaName, t.TableName)
+}
+
 // ResetSql removes cached insert/update/select/delete SQL strings
 // associated with this TableMap.  Call this if you've modified
 // any column names or the table name itself.
 func (t *TableMap) ResetSql() {
 	t.insertPlan = bindPlan{}
+	t.batchPlan = bindPlan{}
+	t.upsertPlan = bindPlan{}
+	t.upsertIncrPlan = bindPlan{}
+	t.upsertGetPlan = bindPlan{}
 	t.updatePlan = bindPlan{}
 	t.deletePlan = bindPlan{}
 	t.getPlan = bindPlan{}
+	t.partialPlans = nil
 }
 
 // SetKeys lets you specify the fields on a struct that map to primary
@@ -50,6 +78,10 @@ func (t *TableMap) ResetSql() {
 //
 // Automatically calls ResetSql() to ensure SQL statements are regenerated.
 func (t *TableMap) SetKeys(isAutoIncr bool, fieldNames ...string) *TableMap {
+	for _, colmap := range t.Keys {
+		colmap.isPK = false
+		colmap.isAutoIncr = false
+	}
 	t.Keys = make([]*ColumnMap, 0)
 	for _, name := range fieldNames {
 		// FIXME: sqlx.NameMapper is a deprecated API.  modl should have its
@@ -64,6 +96,28 @@ func (t *TableMap) SetKeys(isAutoIncr bool, fieldNames ...string) *TableMap {
 	return t
 }
 
+// SetConflictKeys lets you specify the fields whose values identify an
+// existing row for Upsert, such as a set of unique columns.  By default the
+// primary keys are used.
+//
+// Automatically calls ResetSql() to ensure SQL statements are regenerated.
+func (t *TableMap) SetConflictKeys(fieldNames ...string) *TableMap {
+	t.conflictKeys = make([]*ColumnMap, 0, len(fieldNames))
+	for _, name := range fieldNames {
+		t.conflictKeys = append(t.conflictKeys, t.ColMap(sqlx.NameMapper(name)))
+	}
+	t.ResetSql()
+
+	return t
+}
+
+func (t *TableMap) conflictColumns() []*ColumnMap {
+	if len(t.conflictKeys) > 0 {
+		return t.conflictKeys
+	}
+	return t.Keys
+}
+
 // ColMap returns the ColumnMap pointer matching the given struct field
 // name.  It panics if the struct does not contain a field matching this
 // name.
@@ -77,6 +131,172 @@ func (t *TableMap) ColMap(field string) *ColumnMap {
 		t.TableName, t.gotype.Name(), field))
 }
 
+// AddIndex adds an index on the columns of the given struct fields, which
+// CreateTables creates along with the table.  If unique is true, it is a
+// unique index, which can be used for composite unique constraints.  An index
+// already added under name is replaced.  It panics if the struct does not
+// contain a field matching one of the fields, as ColMap does.
+func (t *TableMap) AddIndex(name string, unique bool, fields ...string) *IndexMap {
+	idx := &IndexMap{IndexName: name, Unique: unique, table: t}
+	for _, field := range fields {
+		idx.Columns = append(idx.Columns, t.ColMap(field))
+	}
+	for i, other := range t.Indexes {
+		if other.IndexName == name {
+			t.Indexes[i] = idx
+			return idx
+		}
+	}
+	t.Indexes = append(t.Indexes, idx)
+	return idx
+}
+
+// addColumns appends a column for each field of the struct type st, which is
+// found at the index path index of the mapped type.  Embedded structs and
+// struct pointers, and struct fields tagged with "prefix", are flattened
+// recursively; prefix is prepended to column names, scanPrefix to the names
+// sqlx scans into and fieldPrefix to field names.
+func (t *TableMap) addColumns(st reflect.Type, index []int, prefix, scanPrefix, fieldPrefix string) {
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		columnName := f.Tag.Get("db")
+		if columnName == "" {
+			columnName = sqlx.NameMapper(f.Name)
+		}
+		path := append(append([]int{}, index...), i)
+		tag := f.Tag.Get("modl")
+
+		if columnName != "-" && f.Anonymous && f.Type.Kind() == reflect.Ptr &&
+			f.Type.Elem().Kind() == reflect.Struct && !isValueType(f.Type.Elem()) {
+			t.addColumns(f.Type.Elem(), path, prefix, scanPrefix, fieldPrefix)
+			continue
+		}
+		if columnName != "-" && f.Type.Kind() == reflect.Struct && f.Type != snapshotType && !isValueType(f.Type) {
+			if f.Anonymous {
+				t.addColumns(f.Type, path, prefix, scanPrefix, fieldPrefix)
+				continue
+			}
+			if p, ok := tagPrefix(tag); ok {
+				if p == "" {
+					p = columnName + "_"
+				}
+				t.addColumns(f.Type, path, prefix+p, scanPrefix+columnName+".", fieldPrefix+f.Name+".")
+				continue
+			}
+		}
+
+		cm := &ColumnMap{
+			ColumnName: prefix + columnName,
+			Transient:  columnName == "-",
+			NotNull:    !isNullable(f.Type),
+			fieldName:  fieldPrefix + f.Name,
+			fieldIndex: path,
+			gotype:     f.Type,
+			table:      t,
+		}
+		if scanPrefix != "" {
+			cm.scanName = scanPrefix + columnName
+		}
+		t.Columns = append(t.Columns, cm)
+		if f.Type == snapshotType && f.PkgPath == "" {
+			cm.Transient = true
+			t.snapshot = cm
+		}
+	}
+}
+
+// parseTags finds the keys and version column among the columns left by
+// shadowColumns, from the field names and "modl" tags, so that shadowed
+// fields are never keys or versions.
+func (t *TableMap) parseTags() {
+	for _, cm := range t.Columns {
+		if cm.fieldName == "Version" {
+			t.version = cm
+		}
+	}
+	for _, cm := range t.Columns {
+		cm.parseTag(t.gotype.FieldByIndex(cm.fieldIndex).Tag.Get("modl"))
+	}
+}
+
+// shadowColumns drops columns shadowed by a column of the same name at a
+// shallower depth, following Go's rules for promoted fields.  Of columns at
+// the same depth the first one wins, as it does in sqlx.
+func shadowColumns(cols []*ColumnMap) []*ColumnMap {
+	kept := cols[:0]
+	for _, col := range cols {
+		shadowed := false
+		for _, other := range cols {
+			if other.ColumnName == col.ColumnName && len(other.fieldIndex) < len(col.fieldIndex) {
+				shadowed = true
+				break
+			}
+		}
+		for _, other := range kept {
+			if other.ColumnName == col.ColumnName {
+				shadowed = true
+				break
+			}
+		}
+		if !shadowed {
+			kept = append(kept, col)
+		}
+	}
+	return kept
+}
+
+// fieldByIndex returns the field of the struct v at the index path index,
+// as reflect.Value.FieldByIndex does, but allocates nil embedded struct
+// pointers on the way rather than panicking.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+var (
+	scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+	valuerType  = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+)
+
+// isValueType reports whether the struct type t is stored in a single column
+// rather than flattened, because it can scan or value itself.
+func isValueType(t reflect.Type) bool {
+	return t.Implements(valuerType) || reflect.PtrTo(t).Implements(scannerType) ||
+		t == reflect.TypeOf(time.Time{})
+}
+
+// isNullable reports whether values of type t can be stored as NULL: pointers,
+// slices, maps and interfaces, which can be nil, and types which scan or value
+// themselves, such as sql.NullString.
+func isNullable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+		return true
+	}
+	return t.Implements(valuerType) || reflect.PtrTo(t).Implements(scannerType)
+}
+
+// tagPrefix returns the argument of the prefix option in a modl tag.
+func tagPrefix(tag string) (string, bool) {
+	for _, opt := range splitTag(tag) {
+		if opt == "prefix" {
+			return "", true
+		}
+		if strings.HasPrefix(opt, "prefix:") {
+			return opt[len("prefix:"):], true
+		}
+	}
+	return "", false
+}
+
 // SetVersionCol sets the column to use as the Version field.  By default
 // the "Version" field is used.  Returns the column found, or panics
 // if the struct does not contain a field matching this name.
@@ -89,26 +309,41 @@ func (t *TableMap) SetVersionCol(field string) *ColumnMap {
 	return c
 }
 
+// selectSql returns "select <columns> from <table>" for the columns of the
+// table, aliased as sqlx expects where needed.
+func (t *TableMap) selectSql() string {
+	s := bytes.Buffer{}
+	s.WriteString("select ")
+	x := 0
+	for _, col := range t.Columns {
+		if !col.Transient {
+			if x > 0 {
+				s.WriteString(",")
+			}
+			s.WriteString(t.dbmap.Dialect.QuoteField(col.ColumnName))
+			if col.scanName != "" {
+				s.WriteString(" as ")
+				s.WriteString(t.dbmap.Dialect.QuoteField(col.scanName))
+			}
+			x++
+		}
+	}
+	s.WriteString(" from ")
+	s.WriteString(t.quotedTableName())
+	return s.String()
+}
+
 func (t *TableMap) bindGet() bindPlan {
 	plan := t.getPlan
 	if plan.query == "" {
 
 		s := bytes.Buffer{}
-		s.WriteString("select ")
-
-		x := 0
+		s.WriteString(t.selectSql())
 		for _, col := range t.Columns {
 			if !col.Transient {
-				if x > 0 {
-					s.WriteString(",")
-				}
-				s.WriteString(t.dbmap.Dialect.QuoteField(col.ColumnName))
-				plan.argFields = append(plan.argFields, col.fieldName)
-				x++
+				plan.argFields = append(plan.argFields, col)
 			}
 		}
-		s.WriteString(" from ")
-		s.WriteString(t.dbmap.Dialect.QuoteField(t.TableName))
 		s.WriteString(" where ")
 		for x := range t.Keys {
 			col := t.Keys[x]
@@ -119,7 +354,7 @@ func (t *TableMap) bindGet() bindPlan {
 			s.WriteString("=")
 			s.WriteString(t.dbmap.Dialect.BindVar(x))
 
-			plan.keyFields = append(plan.keyFields, col.fieldName)
+			plan.keyFields = append(plan.keyFields, col)
 		}
 		s.WriteString(";")
 
@@ -130,18 +365,43 @@ func (t *TableMap) bindGet() bindPlan {
 	return plan
 }
 
+// getManySql returns a select statement for n rows by their primary keys,
+// which are bound in order, row by row.
+func (t *TableMap) getManySql(n int) string {
+	return t.selectSql() + " where " + keysMatchSql(t.dbmap.Dialect, t, n, 0, false) + ";"
+}
+
+// deleteBatchSql returns a delete statement for n rows by their primary keys
+// and versions, which are bound in order, row by row.
+func (t *TableMap) deleteBatchSql(n int) string {
+	return fmt.Sprintf("delete from %s where %s;", t.quotedTableName(),
+		keysMatchSql(t.dbmap.Dialect, t, n, 0, t.version != nil))
+}
+
+// batchUpdateColumns returns the columns set by a batch update: all but the
+// keys, transient columns and the version column.
+func (t *TableMap) batchUpdateColumns() []*ColumnMap {
+	var cols []*ColumnMap
+	for _, col := range t.Columns {
+		if !col.isPK && !col.Transient && col != t.version {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
+
 func (t *TableMap) bindDelete(elem reflect.Value) bindInstance {
 	plan := t.deletePlan
 	if plan.query == "" {
 
 		s := bytes.Buffer{}
-		s.WriteString(fmt.Sprintf("delete from %s", t.dbmap.Dialect.QuoteField(t.TableName)))
+		s.WriteString(fmt.Sprintf("delete from %s", t.quotedTableName()))
 
 		for y := range t.Columns {
 			col := t.Columns[y]
 			if !col.Transient {
 				if col == t.version {
-					plan.versField = col.fieldName
+					plan.versField = col
 				}
 			}
 		}
@@ -156,10 +416,10 @@ func (t *TableMap) bindDelete(elem reflect.Value) bindInstance {
 			s.WriteString("=")
 			s.WriteString(t.dbmap.Dialect.BindVar(x))
 
-			plan.keyFields = append(plan.keyFields, k.fieldName)
-			plan.argFields = append(plan.argFields, k.fieldName)
+			plan.keyFields = append(plan.keyFields, k)
+			plan.argFields = append(plan.argFields, k)
 		}
-		if plan.versField != "" {
+		if plan.versField != nil {
 			s.WriteString(" and ")
 			s.WriteString(t.dbmap.Dialect.QuoteField(t.version.ColumnName))
 			s.WriteString("=")
@@ -178,71 +438,422 @@ func (t *TableMap) bindDelete(elem reflect.Value) bindInstance {
 
 func (t *TableMap) bindUpdate(elem reflect.Value) bindInstance {
 	plan := t.updatePlan
+	if plan.query == "" {
+		plan = t.updatePlanFor(nil)
+		t.updatePlan = plan
+	}
+
+	return plan.createBindInstance(elem)
+}
+
+// bindUpdateColumns returns an update statement which only sets the given
+// columns, along with the version column if the table has one.  Plans are
+// cached per set of columns.
+func (t *TableMap) bindUpdateColumns(elem reflect.Value, cols []*ColumnMap) bindInstance {
+	names := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = col.ColumnName
+	}
+	key := strings.Join(names, ",")
+
+	plan, ok := t.partialPlans[key]
+	if !ok {
+		plan = t.updatePlanFor(cols)
+		if t.partialPlans == nil {
+			t.partialPlans = map[string]bindPlan{}
+		}
+		t.partialPlans[key] = plan
+	}
+
+	return plan.createBindInstance(elem)
+}
+
+// updatePlanFor builds an update plan setting cols, or every non-key column
+// if cols is nil.
+func (t *TableMap) updatePlanFor(cols []*ColumnMap) bindPlan {
+	plan := bindPlan{}
+
+	s := bytes.Buffer{}
+	s.WriteString(fmt.Sprintf("update %s set ", t.quotedTableName()))
+	x := 0
+
+	for y := range t.Columns {
+		col := t.Columns[y]
+		if col.isPK || col.Transient {
+			continue
+		}
+		if cols != nil && col != t.version && !containsColumn(cols, col) {
+			continue
+		}
+		if x > 0 {
+			s.WriteString(", ")
+		}
+		s.WriteString(t.dbmap.Dialect.QuoteField(col.ColumnName))
+		s.WriteString("=")
+		s.WriteString(t.dbmap.Dialect.BindVar(x))
+
+		if col == t.version {
+			plan.versField = col
+			plan.argFields = append(plan.argFields, versFieldConst)
+		} else {
+			plan.argFields = append(plan.argFields, col)
+		}
+		x++
+	}
+
+	s.WriteString(" where ")
+	for y := range t.Keys {
+		col := t.Keys[y]
+		if y > 0 {
+			s.WriteString(" and ")
+		}
+		s.WriteString(t.dbmap.Dialect.QuoteField(col.ColumnName))
+		s.WriteString("=")
+		s.WriteString(t.dbmap.Dialect.BindVar(x))
+
+		plan.argFields = append(plan.argFields, col)
+		plan.keyFields = append(plan.keyFields, col)
+		x++
+	}
+	if plan.versField != nil {
+		s.WriteString(" and ")
+		s.WriteString(t.dbmap.Dialect.QuoteField(t.version.ColumnName))
+		s.WriteString("=")
+		s.WriteString(t.dbmap.Dialect.BindVar(x))
+		plan.argFields = append(plan.argFields, plan.versField)
+	}
+	s.WriteString(";")
+
+	plan.query = s.String()
+	return plan
+}
+
+// updateColumns returns the columns for the given field or column names, to
+// be set by a partial update.  The version column is skipped, as it is
+// always updated.
+func (t *TableMap) updateColumns(names []string) ([]*ColumnMap, error) {
+	cols := make([]*ColumnMap, 0, len(names))
+	for _, name := range names {
+		found := t.findColumn(name)
+		switch {
+		case found == nil:
+			return nil, fmt.Errorf("modl: no column %s in table %s", name, t.TableName)
+		case found.isPK:
+			return nil, fmt.Errorf("modl: cannot update key column %s in table %s", name, t.TableName)
+		case found.Transient:
+			return nil, fmt.Errorf("modl: cannot update transient column %s in table %s", name, t.TableName)
+		case found == t.version:
+			continue
+		}
+		cols = append(cols, found)
+	}
+	return cols, nil
+}
+
+// updateWhereSql returns an update statement setting the columns of set to
+// their values on the rows matching where, and the values in the order of
+// their bindvars, which come before those of where.  If bump is set, the
+// version column, if any, is incremented on every row.
+func (t *TableMap) updateWhereSql(set map[string]interface{}, where string, bump bool) (string, []interface{}, error) {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	d := t.dbmap.Dialect
+	s := bytes.Buffer{}
+	s.WriteString(fmt.Sprintf("update %s set ", t.quotedTableName()))
+	args := make([]interface{}, 0, len(set))
+	for _, name := range names {
+		col := t.findColumn(name)
+		switch {
+		case col == nil:
+			return "", nil, fmt.Errorf("modl: no column %s in table %s", name, t.TableName)
+		case col.isPK:
+			return "", nil, fmt.Errorf("modl: cannot update key column %s in table %s", name, t.TableName)
+		case col.Transient:
+			return "", nil, fmt.Errorf("modl: cannot update transient column %s in table %s", name, t.TableName)
+		case col == t.version:
+			return "", nil, fmt.Errorf("modl: cannot set version column %s in table %s", name, t.TableName)
+		}
+		if len(args) > 0 {
+			s.WriteString(", ")
+		}
+		s.WriteString(d.QuoteField(col.ColumnName))
+		s.WriteString("=?")
+		args = append(args, set[name])
+	}
+	if bump && t.version != nil {
+		if len(args) > 0 {
+			s.WriteString(", ")
+		}
+		v := d.QuoteField(t.version.ColumnName)
+		s.WriteString(v + "=" + v + "+1")
+	} else if len(args) == 0 {
+		return "", nil, fmt.Errorf("modl: no columns to update in table %s", t.TableName)
+	}
+	if where != "" {
+		s.WriteString(" where ")
+		s.WriteString(where)
+	}
+	s.WriteString(";")
+	return ReBind(s.String(), d), args, nil
+}
+
+// deleteWhereSql returns a delete statement for the rows matching where.
+func (t *TableMap) deleteWhereSql(where string) string {
+	query := fmt.Sprintf("delete from %s", t.quotedTableName())
+	if where != "" {
+		query += " where " + where
+	}
+	return ReBind(query+";", t.dbmap.Dialect)
+}
+
+// findColumn returns the column named name, or mapped from the field name,
+// or nil if there is none.
+func (t *TableMap) findColumn(name string) *ColumnMap {
+	for _, col := range t.Columns {
+		if col.fieldName == name || col.ColumnName == name || col.ColumnName == sqlx.NameMapper(name) {
+			return col
+		}
+	}
+	return nil
+}
+
+// Snapshot can be embedded in a mapped struct to opt in to partial updates.
+// When such a struct is loaded by Get or Select, or written by Insert, Upsert
+// or Update, the values of its columns are remembered in the Snapshot.
+// Update then only sets the columns whose values have changed since, so that
+// concurrent writers do not overwrite each other's fields.  A struct which
+// has not been loaded or written is updated in full.
+//
+// Example:
+//
+//     type Person struct {
+//         modl.Snapshot
+//         ID    int64
+//         FName string
+//     }
+type Snapshot struct {
+	values map[string]interface{}
+}
+
+var snapshotType = reflect.TypeOf(Snapshot{})
+
+// takeSnapshot records the current column values of elem, if its table
+// embeds a Snapshot.
+func (t *TableMap) takeSnapshot(elem reflect.Value) {
+	if t.snapshot == nil {
+		return
+	}
+	snap := fieldByIndex(elem, t.snapshot.fieldIndex).Addr().Interface().(*Snapshot)
+	snap.values = make(map[string]interface{}, len(t.Columns))
+	for _, col := range t.Columns {
+		if !col.Transient {
+			snap.values[col.ColumnName] = snapshotValue(fieldByIndex(elem, col.fieldIndex))
+		}
+	}
+}
+
+// dirtyColumns returns the non-key columns of elem whose values differ from
+// its snapshot.  ok is false if the table does not use snapshots or elem has
+// not been snapshotted.
+func (t *TableMap) dirtyColumns(elem reflect.Value) (cols []*ColumnMap, ok bool) {
+	if t.snapshot == nil {
+		return nil, false
+	}
+	snap := fieldByIndex(elem, t.snapshot.fieldIndex).Addr().Interface().(*Snapshot)
+	if snap.values == nil {
+		return nil, false
+	}
+	cols = []*ColumnMap{}
+	for _, col := range t.Columns {
+		if col.isPK || col.Transient || col == t.version {
+			continue
+		}
+		old, found := snap.values[col.ColumnName]
+		if !found || !reflect.DeepEqual(old, snapshotValue(fieldByIndex(elem, col.fieldIndex))) {
+			cols = append(cols, col)
+		}
+	}
+	return cols, true
+}
+
+// snapshotValue copies v so that later changes made through shared memory,
+// such as the contents of a []byte or the target of a pointer, are detected.
+func snapshotValue(v reflect.Value) interface{} {
+	switch {
+	case v.Kind() == reflect.Slice && !v.IsNil():
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(c, v)
+		return c.Interface()
+	case v.Kind() == reflect.Ptr && !v.IsNil():
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(v.Elem())
+		return c.Interface()
+	}
+	return v.Interface()
+}
+
+func (t *TableMap) bindInsert(elem reflect.Value) bindInstance {
+	plan := t.insertPlan
 	if plan.query == "" {
 
 		s := bytes.Buffer{}
-		s.WriteString(fmt.Sprintf("update %s set ", t.dbmap.Dialect.QuoteField(t.TableName)))
+		s2 := bytes.Buffer{}
+		s.WriteString(fmt.Sprintf("insert into %s (", t.quotedTableName()))
+
 		x := 0
+		first := true
+		for y := range t.Columns {
+			col := t.Columns[y]
 
+			if !col.Transient {
+				if !first {
+					s.WriteString(",")
+					s2.WriteString(",")
+				}
+				s.WriteString(t.dbmap.Dialect.QuoteField(col.ColumnName))
+
+				if col.isAutoIncr {
+					s2.WriteString(t.dbmap.Dialect.AutoIncrBindValue())
+					plan.autoIncrCol = col
+				} else {
+					s2.WriteString(t.dbmap.Dialect.BindVar(x))
+					if col == t.version {
+						plan.versField = col
+						plan.argFields = append(plan.argFields, versFieldConst)
+					} else {
+						plan.argFields = append(plan.argFields, col)
+					}
+
+					x++
+				}
+
+				first = false
+			}
+		}
+		s.WriteString(") values (")
+		s.WriteString(s2.String())
+		s.WriteString(")")
+		if plan.autoIncrCol != nil {
+			s.WriteString(t.dbmap.Dialect.AutoIncrInsertSuffix(plan.autoIncrCol))
+		}
+		s.WriteString(";")
+
+		plan.query = s.String()
+		t.insertPlan = plan
+	}
+
+	return plan.createBindInstance(elem)
+}
+
+// insertBatchPlan returns the plan used by bindInsertBatch.  Its query is
+// only the "insert into t (...) values " prefix, as the values tuples
+// depend on the number of rows in the batch.
+func (t *TableMap) insertBatchPlan() bindPlan {
+	plan := t.batchPlan
+	if plan.query == "" {
+
+		s := bytes.Buffer{}
+		s.WriteString(fmt.Sprintf("insert into %s (", t.quotedTableName()))
+
+		first := true
 		for y := range t.Columns {
 			col := t.Columns[y]
-			if !col.isPK && !col.Transient {
-				if x > 0 {
-					s.WriteString(", ")
+
+			if !col.Transient {
+				if !first {
+					s.WriteString(",")
 				}
 				s.WriteString(t.dbmap.Dialect.QuoteField(col.ColumnName))
-				s.WriteString("=")
-				s.WriteString(t.dbmap.Dialect.BindVar(x))
 
-				if col == t.version {
-					plan.versField = col.fieldName
+				if col.isAutoIncr {
+					plan.autoIncrCol = col
+				} else if col == t.version {
+					plan.versField = col
 					plan.argFields = append(plan.argFields, versFieldConst)
 				} else {
-					plan.argFields = append(plan.argFields, col.fieldName)
+					plan.argFields = append(plan.argFields, col)
 				}
-				x++
+
+				first = false
 			}
 		}
+		s.WriteString(") values ")
 
-		s.WriteString(" where ")
-		for y := range t.Keys {
-			col := t.Keys[y]
-			if y > 0 {
-				s.WriteString(" and ")
-			}
-			s.WriteString(t.dbmap.Dialect.QuoteField(col.ColumnName))
-			s.WriteString("=")
-			s.WriteString(t.dbmap.Dialect.BindVar(x))
+		plan.query = s.String()
+		t.batchPlan = plan
+	}
 
-			plan.argFields = append(plan.argFields, col.fieldName)
-			plan.keyFields = append(plan.keyFields, col.fieldName)
-			x++
+	return plan
+}
+
+// bindInsertBatch returns a single multi-row insert statement for elems,
+// appending a values tuple for each element and numbering bindvars across
+// the whole batch.
+func (t *TableMap) bindInsertBatch(elems []reflect.Value) bindInstance {
+	plan := t.insertBatchPlan()
+	bi := bindInstance{autoIncrCol: plan.autoIncrCol, versField: plan.versField}
+	s := bytes.Buffer{}
+	s.WriteString(plan.query)
+
+	x := 0
+	for i, elem := range elems {
+		if i > 0 {
+			s.WriteString(",")
 		}
-		if plan.versField != "" {
-			s.WriteString(" and ")
-			s.WriteString(t.dbmap.Dialect.QuoteField(t.version.ColumnName))
-			s.WriteString("=")
-			s.WriteString(t.dbmap.Dialect.BindVar(x))
-			plan.argFields = append(plan.argFields, plan.versField)
+		s.WriteString("(")
+		first := true
+		for _, col := range t.Columns {
+			if !col.Transient {
+				if !first {
+					s.WriteString(",")
+				}
+				if col.isAutoIncr {
+					s.WriteString(t.dbmap.Dialect.AutoIncrBindValue())
+				} else {
+					s.WriteString(t.dbmap.Dialect.BindVar(x))
+					x++
+				}
+				first = false
+			}
 		}
-		s.WriteString(";")
+		s.WriteString(")")
 
-		plan.query = s.String()
-		t.updatePlan = plan
+		bi.args = append(bi.args, plan.createBindInstance(elem).args...)
+	}
+	if plan.autoIncrCol != nil {
+		s.WriteString(t.dbmap.Dialect.AutoIncrInsertSuffix(plan.autoIncrCol))
 	}
+	s.WriteString(";")
 
-	return plan.createBindInstance(elem)
+	bi.query = s.String()
+	return bi
 }
 
-func (t *TableMap) bindInsert(elem reflect.Value) bindInstance {
-	plan := t.insertPlan
+// bindUpsert returns an insert statement which updates the existing row if
+// it conflicts on the table's conflict columns.  If genAutoIncr is set, the
+// auto-increment column is left for the database to generate; otherwise its
+// value is bound from the struct like any other column.  The keys of the
+// instance are the values of the conflict columns.  On dialects with a
+// ReturningClause, the statement returns the columns of upsertReadColumns if
+// the database may set them.
+func (t *TableMap) bindUpsert(elem reflect.Value, genAutoIncr bool) bindInstance {
+	plan := t.upsertPlan
+	if genAutoIncr {
+		plan = t.upsertIncrPlan
+	}
 	if plan.query == "" {
-		plan.autoIncrIdx = -1
+		conflict := t.conflictColumns()
 
 		s := bytes.Buffer{}
 		s2 := bytes.Buffer{}
-		s.WriteString(fmt.Sprintf("insert into %s (", t.dbmap.Dialect.QuoteField(t.TableName)))
+		s.WriteString(fmt.Sprintf("insert into %s (", t.quotedTableName()))
 
+		var update, conflictNames []string
+		version := ""
 		x := 0
 		first := true
 		for y := range t.Columns {
@@ -255,39 +866,123 @@ func (t *TableMap) bindInsert(elem reflect.Value) bindInstance {
 				}
 				s.WriteString(t.dbmap.Dialect.QuoteField(col.ColumnName))
 
-				if col.isAutoIncr {
+				if col.isAutoIncr && genAutoIncr {
 					s2.WriteString(t.dbmap.Dialect.AutoIncrBindValue())
-					plan.autoIncrIdx = y
+					plan.autoIncrCol = col
 				} else {
 					s2.WriteString(t.dbmap.Dialect.BindVar(x))
 					if col == t.version {
-						plan.versField = col.fieldName
+						plan.versField = col
 						plan.argFields = append(plan.argFields, versFieldConst)
 					} else {
-						plan.argFields = append(plan.argFields, col.fieldName)
+						plan.argFields = append(plan.argFields, col)
 					}
-
 					x++
 				}
 
+				if col == t.version {
+					version = col.ColumnName
+				} else if !col.isPK && !containsColumn(conflict, col) {
+					update = append(update, col.ColumnName)
+				}
+
 				first = false
 			}
 		}
+		for _, col := range conflict {
+			conflictNames = append(conflictNames, col.ColumnName)
+			plan.keyFields = append(plan.keyFields, col)
+		}
+
 		s.WriteString(") values (")
 		s.WriteString(s2.String())
 		s.WriteString(")")
-		if plan.autoIncrIdx > -1 {
-			s.WriteString(t.dbmap.Dialect.AutoIncrInsertSuffix(t.Columns[plan.autoIncrIdx]))
+		s.WriteString(t.dbmap.Dialect.UpsertClause(t.TableName, conflictNames, update, version))
+		if genAutoIncr || t.version != nil {
+			cols := t.upsertReadColumns()
+			names := make([]string, len(cols))
+			for i, col := range cols {
+				names[i] = col.ColumnName
+			}
+			if clause := t.dbmap.Dialect.ReturningClause(names); clause != "" {
+				s.WriteString(clause)
+				plan.returning = cols
+			}
 		}
 		s.WriteString(";")
 
 		plan.query = s.String()
-		t.insertPlan = plan
+		if genAutoIncr {
+			t.upsertIncrPlan = plan
+		} else {
+			t.upsertPlan = plan
+		}
 	}
 
 	return plan.createBindInstance(elem)
 }
 
+// upsertReadColumns returns the auto-increment and version columns, which
+// the database may set during an upsert.
+func (t *TableMap) upsertReadColumns() []*ColumnMap {
+	var cols []*ColumnMap
+	for _, col := range t.Columns {
+		if !col.Transient && (col.isAutoIncr || col == t.version) {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
+
+// bindUpsertGet returns a query which reads back the columns of
+// upsertReadColumns by the conflict columns, for dialects which cannot
+// return them from the upsert, and for conflicts which do nothing.  The
+// plan's argFields are the fields to scan into.
+func (t *TableMap) bindUpsertGet() bindPlan {
+	plan := t.upsertGetPlan
+	if plan.query == "" {
+
+		s := bytes.Buffer{}
+		s.WriteString("select ")
+
+		for x, col := range t.upsertReadColumns() {
+			if x > 0 {
+				s.WriteString(",")
+			}
+			s.WriteString(t.dbmap.Dialect.QuoteField(col.ColumnName))
+			plan.argFields = append(plan.argFields, col)
+		}
+		s.WriteString(" from ")
+		s.WriteString(t.quotedTableName())
+		s.WriteString(" where ")
+		for x, col := range t.conflictColumns() {
+			if x > 0 {
+				s.WriteString(" and ")
+			}
+			s.WriteString(t.dbmap.Dialect.QuoteField(col.ColumnName))
+			s.WriteString("=")
+			s.WriteString(t.dbmap.Dialect.BindVar(x))
+
+			plan.keyFields = append(plan.keyFields, col)
+		}
+		s.WriteString(";")
+
+		plan.query = s.String()
+		t.upsertGetPlan = plan
+	}
+
+	return plan
+}
+
+func containsColumn(cols []*ColumnMap, col *ColumnMap) bool {
+	for _, c := range cols {
+		if c == col {
+			return true
+		}
+	}
+	return false
+}
+
 // ColumnMap represents a mapping between a Go struct field and a single
 // column in a table.
 // Unique and MaxSize only inform the CreateTables() function and are not
@@ -302,14 +997,31 @@ type ColumnMap struct {
 	// If true, " unique" is added to create table statements.
 	Unique bool
 
+	// If true, " not null" is added to create table statements.  AddTable
+	// sets this for fields which cannot hold nil, see SetNotNull.
+	NotNull bool
+
+	// If set, a default clause with this expression is added to create
+	// table statements.
+	Default string
+
+	// If set, a check constraint with this expression is added to create
+	// table statements.
+	Check string
+
 	// Passed to Dialect.ToSqlType() to assist in informing the
 	// correct column type to map to in CreateTables()
 	MaxSize int
 
+	// If set, a foreign key constraint is added to create table statements.
+	ForeignKey *ForeignKey
+
 	// the table this column belongs to
 	table *TableMap
 
 	fieldName  string
+	fieldIndex []int
+	scanName   string
 	gotype     reflect.Type
 	sqltype    string
 	createSql  string
@@ -331,6 +1043,31 @@ func (c *ColumnMap) SetUnique(b bool) *ColumnMap {
 	return c
 }
 
+// SetNotNull sets the not null clause for this column.  By default, columns
+// of fields which cannot be nil are not null, while pointers, slices, maps,
+// interfaces and types implementing sql.Scanner or driver.Valuer (such as
+// sql.NullString) are nullable.  Primary keys are always not null.
+func (c *ColumnMap) SetNotNull(b bool) *ColumnMap {
+	c.NotNull = b
+	return c
+}
+
+// SetDefault sets the default value of this column in create table
+// statements to the given sql expression, such as "0" or "'new'", which is
+// passed to the database as is.  To unset, call with the empty string.
+func (c *ColumnMap) SetDefault(expr string) *ColumnMap {
+	c.Default = expr
+	return c
+}
+
+// SetCheck adds a check constraint on this column to create table statements,
+// with the given sql expression, such as "age >= 0".  To unset, call with the
+// empty string.  MySQL enforces checks since 8.0.16.
+func (c *ColumnMap) SetCheck(expr string) *ColumnMap {
+	c.Check = expr
+	return c
+}
+
 // SetSqlCreate overrides the default create statement used when this column
 // is created by CreateTable.  This will override all other options (like
 // SetMaxSize, SetSqlType, etc).  To unset, call with the empty string.
@@ -348,6 +1085,15 @@ func (c *ColumnMap) SetSqlType(t string) *ColumnMap {
 	return c
 }
 
+// sqlType returns the column's sql type: its override if set, or else the
+// dialect's type for the field.
+func (c *ColumnMap) sqlType() string {
+	if c.sqltype != "" {
+		return c.sqltype
+	}
+	return c.table.dbmap.Dialect.ToSqlType(c)
+}
+
 // SetMaxSize specifies the max length of values of this column. This is
 // passed to the dialect.ToSqlType() function, which can use the value
 // to alter the generated type for "create table" statements
@@ -356,6 +1102,156 @@ func (c *ColumnMap) SetMaxSize(size int) *ColumnMap {
 	return c
 }
 
+// SetForeignKey declares the column as a reference to the given column of
+// another table, which can be a struct field name or a column name.  It panics
+// if the table does not contain that column, as ColMap does.  A foreign key
+// constraint is added to the statements produced by CreateTables.  Note that
+// sqlite only enforces foreign keys when "PRAGMA foreign_keys" is on.
+func (c *ColumnMap) SetForeignKey(table *TableMap, column string) *ColumnMap {
+	c.ForeignKey = &ForeignKey{Table: table, Column: table.ColMap(column)}
+	return c
+}
+
+// SetOnDelete sets the action taken when the row referenced by this column's
+// foreign key is deleted.  It panics if no foreign key has been set.
+func (c *ColumnMap) SetOnDelete(action FKAction) *ColumnMap {
+	c.foreignKey().OnDelete = action
+	return c
+}
+
+// SetOnUpdate sets the action taken when the key referenced by this column's
+// foreign key is updated.  It panics if no foreign key has been set.
+func (c *ColumnMap) SetOnUpdate(action FKAction) *ColumnMap {
+	c.foreignKey().OnUpdate = action
+	return c
+}
+
+func (c *ColumnMap) foreignKey() *ForeignKey {
+	if c.ForeignKey == nil {
+		panic(fmt.Sprintf("No foreign key on column %s in table %s", c.ColumnName, c.table.TableName))
+	}
+	return c.ForeignKey
+}
+
+// FKAction is a referential action of a foreign key.
+type FKAction string
+
+// Referential actions for SetOnDelete and SetOnUpdate.  The empty action
+// leaves the database's default, which is usually "no action".
+const (
+	FKNoAction   FKAction = "no action"
+	FKRestrict   FKAction = "restrict"
+	FKCascade    FKAction = "cascade"
+	FKSetNull    FKAction = "set null"
+	FKSetDefault FKAction = "set default"
+)
+
+// ForeignKey describes a reference from a column to a column of another
+// table.  Use ColumnMap.SetForeignKey to create these.
+type ForeignKey struct {
+	Table    *TableMap
+	Column   *ColumnMap
+	OnDelete FKAction
+	OnUpdate FKAction
+}
+
+// IndexMap represents an index on one or more columns of a table.  Use
+// TableMap.AddIndex to create these.
+type IndexMap struct {
+	// Name of the index in the database.
+	IndexName string
+
+	// If true, the index is a unique index.
+	Unique bool
+
+	// The indexed columns, in order.
+	Columns []*ColumnMap
+
+	// If set, the index is a partial index on the rows matching this
+	// condition.  Not supported by MySQL.
+	Where string
+
+	// If set, the index method, such as "btree", "hash" or "gin".  Not
+	// supported by sqlite.
+	Method string
+
+	table *TableMap
+}
+
+// SetWhere makes the index a partial index over the rows matching the given
+// sql condition, such as "deleted_at is null".
+func (idx *IndexMap) SetWhere(cond string) *IndexMap {
+	idx.Where = cond
+	return idx
+}
+
+// SetMethod sets the index method, such as "btree" or "gin".  The method is
+// passed to the database as is.
+func (idx *IndexMap) SetMethod(method string) *IndexMap {
+	idx.Method = method
+	return idx
+}
+
+// parseTag applies the options of a "modl" struct tag to the column, as
+// documented on DbMap.AddTable.  It panics on unknown options, as ColMap does
+// for unknown fields, so that typos are caught when the table is mapped.
+func (c *ColumnMap) parseTag(tag string) {
+	if tag == "" {
+		return
+	}
+	t := c.table
+	for _, opt := range splitTag(tag) {
+		name, arg := opt, ""
+		if i := strings.Index(opt, ":"); i >= 0 {
+			name, arg = opt[:i], opt[i+1:]
+		}
+		switch name {
+		case "pk":
+			c.isPK = true
+			t.Keys = append(t.Keys, c)
+		case "autoincr":
+			c.isAutoIncr = true
+		case "size":
+			size, err := strconv.Atoi(arg)
+			if err != nil {
+				panic(fmt.Sprintf("Invalid size %q in modl tag of field %s in table %s", arg, c.fieldName, t.TableName))
+			}
+			c.MaxSize = size
+		case "unique":
+			c.Unique = true
+		case "type":
+			c.sqltype = arg
+		case "version":
+			t.version = c
+		case "prefix":
+			panic(fmt.Sprintf("The prefix option of field %s in table %s requires a struct field", c.fieldName, t.TableName))
+		default:
+			panic(fmt.Sprintf("Unknown option %q in modl tag of field %s in table %s", opt, c.fieldName, t.TableName))
+		}
+	}
+}
+
+// splitTag splits a tag on commas which are not inside parentheses, so that
+// types such as "numeric(10,2)" are kept whole.
+func splitTag(tag string) []string {
+	var opts []string
+	depth, start := 0, 0
+	for i, r := range tag {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				opts = append(opts, strings.TrimSpace(tag[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(opts, strings.TrimSpace(tag[start:]))
+}
+
 // Return a table for a pointer;  error if i is not a pointer or if the
 // table is not found
 func tableForPointer(m *DbMap, i interface{}, checkPk bool) (*TableMap, reflect.Value, error) {
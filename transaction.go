@@ -1,10 +1,12 @@
 package modl
 
 import (
+	"context"
 	"database/sql"
+	"math/rand"
+	"time"
 
 	"mindoktor.io/sqlx"
-	"context"
 )
 
 // Transaction represents a database transaction.
@@ -14,6 +16,7 @@ import (
 type Transaction struct {
 	dbmap *DbMap
 	Tx    *sqlx.Tx
+	opts  sql.TxOptions
 }
 
 // Insert has the same behavior as DbMap.Insert(), but runs in a transaction.
@@ -21,21 +24,75 @@ func (t *Transaction) InsertContext(ctx context.Context, list ...interface{}) er
 	return insert(ctx, t.dbmap, t, list...)
 }
 
+// InsertBatchContext has the same behavior as DbMap.InsertBatchContext(), but
+// runs in a transaction.
+func (t *Transaction) InsertBatchContext(ctx context.Context, list ...interface{}) error {
+	return insertBatch(ctx, t.dbmap, t, list...)
+}
+
+// UpsertContext has the same behavior as DbMap.UpsertContext(), but runs in a
+// transaction.
+func (t *Transaction) UpsertContext(ctx context.Context, list ...interface{}) error {
+	return upsert(ctx, t.dbmap, t, list...)
+}
+
 // Update has the same behavior as DbMap.Update(), but runs in a transaction.
 func (t *Transaction) UpdateContext(ctx context.Context, list ...interface{}) (int64, error) {
 	return update(ctx, t.dbmap, t, list...)
 }
 
+// UpdateColumnsContext has the same behavior as DbMap.UpdateColumnsContext(),
+// but runs in a transaction.
+func (t *Transaction) UpdateColumnsContext(ctx context.Context, ptr interface{}, fields ...string) (int64, error) {
+	return updateColumns(ctx, t.dbmap, t, ptr, fields...)
+}
+
 // Delete has the same behavior as DbMap.Delete(), but runs in a transaction.
 func (t *Transaction) DeleteContext(ctx context.Context, list ...interface{}) (int64, error) {
 	return deletes(ctx, t.dbmap, t, list...)
 }
 
+// UpdateBatchContext has the same behavior as DbMap.UpdateBatchContext(), but
+// runs in a transaction.
+func (t *Transaction) UpdateBatchContext(ctx context.Context, list ...interface{}) (int64, error) {
+	return updateBatch(ctx, t.dbmap, t, list...)
+}
+
+// DeleteBatchContext has the same behavior as DbMap.DeleteBatchContext(), but
+// runs in a transaction.
+func (t *Transaction) DeleteBatchContext(ctx context.Context, list ...interface{}) (int64, error) {
+	return deleteBatch(ctx, t.dbmap, t, list...)
+}
+
+// UpdateWhere has the same behavior as DbMap.UpdateWhere(), but runs in a
+// transaction.
+func (t *Transaction) UpdateWhere(ctx context.Context, i interface{}, set map[string]interface{}, where string, args ...interface{}) (int64, error) {
+	return updateWhere(ctx, t.dbmap, t, i, false, set, where, args...)
+}
+
+// UpdateWhereVersioned has the same behavior as
+// DbMap.UpdateWhereVersioned(), but runs in a transaction.
+func (t *Transaction) UpdateWhereVersioned(ctx context.Context, i interface{}, set map[string]interface{}, where string, args ...interface{}) (int64, error) {
+	return updateWhere(ctx, t.dbmap, t, i, true, set, where, args...)
+}
+
+// DeleteWhere has the same behavior as DbMap.DeleteWhere(), but runs in a
+// transaction.
+func (t *Transaction) DeleteWhere(ctx context.Context, i interface{}, where string, args ...interface{}) (int64, error) {
+	return deleteWhere(ctx, t.dbmap, t, i, where, args...)
+}
+
 // Get has the Same behavior as DbMap.Get(), but runs in a transaction.
 func (t *Transaction) GetContext(ctx context.Context, dest interface{}, keys ...interface{}) error {
 	return get(ctx, t.dbmap, t, dest, keys...)
 }
 
+// GetManyContext has the same behavior as DbMap.GetManyContext(), but runs in
+// a transaction.
+func (t *Transaction) GetManyContext(ctx context.Context, dest interface{}, keys interface{}) ([]interface{}, error) {
+	return getMany(ctx, t.dbmap, t, dest, keys)
+}
+
 // Select has the Same behavior as DbMap.Select(), but runs in a transaction.
 func (t *Transaction) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
 	return hookedselect(ctx, t.dbmap, t, dest, query, args...)
@@ -45,10 +102,53 @@ func (t *Transaction) SelectOneContext(ctx context.Context, dest interface{}, qu
 	return hookedget(ctx, t.dbmap, t, dest, query, args...)
 }
 
+// SelectIntContext has the same behavior as DbMap.SelectIntContext(), but
+// runs in a transaction.
+func (t *Transaction) SelectIntContext(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	return selectInt(ctx, t, query, args...)
+}
+
+// SelectNullIntContext has the same behavior as DbMap.SelectNullIntContext(),
+// but runs in a transaction.
+func (t *Transaction) SelectNullIntContext(ctx context.Context, query string, args ...interface{}) (sql.NullInt64, error) {
+	return selectNullInt(ctx, t, query, args...)
+}
+
+// SelectFloatContext has the same behavior as DbMap.SelectFloatContext(), but
+// runs in a transaction.
+func (t *Transaction) SelectFloatContext(ctx context.Context, query string, args ...interface{}) (float64, error) {
+	return selectFloat(ctx, t, query, args...)
+}
+
+// SelectNullFloatContext has the same behavior as
+// DbMap.SelectNullFloatContext(), but runs in a transaction.
+func (t *Transaction) SelectNullFloatContext(ctx context.Context, query string, args ...interface{}) (sql.NullFloat64, error) {
+	return selectNullFloat(ctx, t, query, args...)
+}
+
+// SelectStrContext has the same behavior as DbMap.SelectStrContext(), but
+// runs in a transaction.
+func (t *Transaction) SelectStrContext(ctx context.Context, query string, args ...interface{}) (string, error) {
+	return selectStr(ctx, t, query, args...)
+}
+
+// SelectNullStrContext has the same behavior as DbMap.SelectNullStrContext(),
+// but runs in a transaction.
+func (t *Transaction) SelectNullStrContext(ctx context.Context, query string, args ...interface{}) (sql.NullString, error) {
+	return selectNullStr(ctx, t, query, args...)
+}
+
 // Exec has the same behavior as DbMap.Exec(), but runs in a transaction.
 func (t *Transaction) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
-	t.dbmap.trace(query, args)
-	return t.Tx.Exec(query, args...)
+	t.dbmap.trace(query, args...)
+	return t.Tx.ExecContext(ctx, query, args...)
+}
+
+// TxOptions returns the isolation level and read-only flag this transaction
+// was started with.  It is never nil for a Transaction.
+func (t *Transaction) TxOptions() *sql.TxOptions {
+	opts := t.opts
+	return &opts
 }
 
 // Commit commits the underlying database transaction.
@@ -63,6 +163,85 @@ func (t *Transaction) Rollback() error {
 	return t.Tx.Rollback()
 }
 
+// Savepoint creates a savepoint with the given name.  Work done after the
+// savepoint can be undone with RollbackTo without aborting the transaction,
+// which lets hooks attempt partial work that is allowed to fail.
+func (t *Transaction) Savepoint(ctx context.Context, name string) error {
+	_, err := t.ExecContext(ctx, t.dbmap.Dialect.SavepointClause(name))
+	return err
+}
+
+// RollbackTo rolls the transaction back to the named savepoint.  The
+// savepoint remains defined and can be rolled back to again.
+func (t *Transaction) RollbackTo(ctx context.Context, name string) error {
+	_, err := t.ExecContext(ctx, t.dbmap.Dialect.RollbackToSavepointClause(name))
+	return err
+}
+
+// Release destroys the named savepoint, keeping all work done since it was
+// created as part of the transaction.
+func (t *Transaction) Release(ctx context.Context, name string) error {
+	_, err := t.ExecContext(ctx, t.dbmap.Dialect.ReleaseSavepointClause(name))
+	return err
+}
+
 func (t *Transaction) handle() handle {
 	return &tracingHandle{h: t.Tx, d: t.dbmap}
 }
+
+// TxMaxRetries is the number of times InTransaction will run its function
+// again after the dialect reports a retryable error.
+var TxMaxRetries = 5
+
+// TxRetryBackoff is the delay before the first retry in InTransaction.  It is
+// doubled, with some jitter added, before each subsequent retry.
+var TxRetryBackoff = 10 * time.Millisecond
+
+// InTransaction runs fn in a new transaction started with opts.  If fn
+// returns nil the transaction is committed; if it returns an error or panics
+// the transaction is rolled back, and the error is returned or the panic
+// propagated.
+//
+// If fn or Commit fails with an error the Dialect considers retryable, such
+// as a serialization failure or deadlock, the whole function is run again in
+// a fresh transaction, up to TxMaxRetries times.  fn should therefore not
+// have side effects outside of the transaction.
+func (m *DbMap) InTransaction(ctx context.Context, opts *sql.TxOptions, fn func(*Transaction) error) error {
+	backoff := TxRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := m.inTransaction(ctx, opts, fn)
+		if err == nil || attempt >= TxMaxRetries || !m.Dialect.IsRetryable(err) {
+			return err
+		}
+
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+		m.trace("retrying transaction after", err, wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+func (m *DbMap) inTransaction(ctx context.Context, opts *sql.TxOptions, fn func(*Transaction) error) error {
+	t, err := m.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	done := false
+	defer func() {
+		if !done {
+			t.Rollback()
+		}
+	}()
+
+	err = fn(t)
+	if err != nil {
+		return err
+	}
+	done = true
+	return t.Commit()
+}